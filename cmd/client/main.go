@@ -30,6 +30,8 @@ package main
 
 import (
 	"context"
+	"crypto/x509/pkix"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -90,6 +92,15 @@ func main() {
 		}
 	}
 
+	if cfg.GRPCAddress != "" {
+		err = enrollGRPC(ctx, cfg, rwc, id, jwt)
+		if err != nil {
+			log.Printf("gRPC enrollment failed: %v", err)
+		}
+
+		return
+	}
+
 	sessionCookie, err := authorize(id, cfg.URL, jwt)
 	if err != nil {
 		log.Printf("authorization failed: %v", err)
@@ -102,7 +113,7 @@ func main() {
 		return
 	}
 
-	cResp, err := challengeRequest(requestData, requestSig, sessionCookie, cfg.URL, jwt)
+	cResp, sessionCookie, err := challengeRequest(requestData, requestSig, sessionCookie, cfg.URL, jwt)
 	if err != nil {
 		log.Printf("challenge request failed: %v", err)
 		return
@@ -114,15 +125,40 @@ func main() {
 		return
 	}
 
-	devID, err := challengeSubmit(cSubmit, sessionCookie, cfg.URL, jwt)
+	devID, ak, err := challengeSubmit(cSubmit, requestData, sessionCookie, cfg.URL, jwt)
 	if err != nil {
 		log.Printf("challenge submission failed: %v", err)
 		return
 	}
 
-	err = client.WriteDevID(cfg.OutputDir, resources, devID)
+	err = client.WriteDevID(cfg.OutputDir, resources, devID, ak)
 	if err != nil {
 		log.Printf("failed to write blobs to %s: %v", cfg.OutputDir, err)
 		return
 	}
 }
+
+// enrollGRPC requests a DevID over the gRPC Enrollment service and writes it
+// to the output directory.
+func enrollGRPC(ctx context.Context, cfg client.Config, rwc io.ReadWriter, id pkix.Name, jwt string) error {
+	nodeType := strings.Split(id.CommonName, "/")[0]
+	xname := strings.Split(id.CommonName, "/")[1]
+
+	conn, err := client.DialEnrollment(cfg.GRPCAddress, cfg.GRPCPlaintext)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Error closing gRPC connection: %v", err)
+		}
+	}()
+
+	devID, ak, resources, err := client.Enroll(ctx, conn, rwc, xname, nodeType, id, jwt)
+	if err != nil {
+		return err
+	}
+
+	return client.WriteDevID(cfg.OutputDir, resources, devID, ak)
+}
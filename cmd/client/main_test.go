@@ -27,12 +27,18 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/cray-hpe/tpm-provisioner/pkg/client"
 	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
@@ -55,10 +61,48 @@ func openTestTPM(tb testing.TB) io.ReadWriteCloser {
 // TestHappyPath validates that the entire DevID sign request process works
 // properly.
 func TestHappyPath(t *testing.T) {
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	happyPath(t)
+}
+
+// TestHappyPathTokenSessions validates that the DevID sign request process
+// works when the session state is carried in the session cookie.
+func TestHappyPathTokenSessions(t *testing.T) {
+	key := make([]byte, 32)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.Sessions, err = provisioner.NewTokenSessionStore(time.Minute, [][]byte{key})
+	if err != nil {
+		t.Fatalf("Unable to create token session store: %v", err)
+	}
+
+	defer func() {
+		provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+	}()
+
+	happyPath(t)
+}
+
+// happyPath runs the DevID sign request process against the provisioner
+// router.
+func happyPath(t *testing.T) {
+	t.Helper()
+
 	ctx := context.Background()
 
 	rwc := openTestTPM(t)
 
+	defer func() {
+		if err := rwc.Close(); err != nil {
+			t.Errorf("Unable to close simulator: %v", err)
+		}
+	}()
+
 	caCRT, err := simulateTPM.CreateEK(rwc)
 	if err != nil {
 		t.Fatalf("Unable to create EK: %v", err)
@@ -96,7 +140,7 @@ func TestHappyPath(t *testing.T) {
 		SpireTokensURL: server.URL,
 	}
 
-	provisioner.WhiteList = append(provisioner.WhiteList, "x1000c0s0b0n0")
+	provisioner.WhiteList = append(provisioner.WhiteList, provisioner.WhiteListEntry{Pattern: "x1000c0s0b0n0"})
 
 	id := pkix.Name{
 		CommonName: "compute/x1000c0s0b0n0",
@@ -118,7 +162,7 @@ func TestHappyPath(t *testing.T) {
 		t.Fatalf("creating raw request failed: %v", err)
 	}
 
-	cResp, err := challengeRequest(requestData, requestSig, sessionCookie, tsURL, "")
+	cResp, sessionCookie, err := challengeRequest(requestData, requestSig, sessionCookie, tsURL, "")
 	if err != nil {
 		t.Fatalf("challenge request failed: %v", err)
 	}
@@ -128,10 +172,73 @@ func TestHappyPath(t *testing.T) {
 		t.Fatalf("generate challenge response failed: %v", err)
 	}
 
-	_, err = challengeSubmit(cSubmit, sessionCookie, tsURL, "")
+	devID, ak, err := challengeSubmit(cSubmit, requestData, sessionCookie, tsURL, "")
 	if err != nil {
 		t.Fatalf("challenge submission failed: %v", err)
 	}
 
+	if len(ak) == 0 {
+		t.Fatalf("no AK certificate issued")
+	}
+
+	outputDir := t.TempDir()
+
+	err = client.WriteDevID(outputDir, resources, devID, ak)
+	if err != nil {
+		t.Fatalf("writing DevID failed: %v", err)
+	}
+
+	for _, name := range []string{"devid.crt.pem", "ak.crt.pem", "ak.pub.blob", "ak.priv.blob"} {
+		if _, err = os.Stat(filepath.Join(outputDir, name)); err != nil {
+			t.Errorf("missing %s: %v", name, err)
+		}
+	}
+
 	ts.Close()
 }
+
+// TestAuthorizeNotWhitelisted validates that API errors are mapped to typed
+// errors.
+func TestAuthorizeNotWhitelisted(t *testing.T) {
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	id := pkix.Name{
+		CommonName: "compute/x9999c0s0b0n0",
+	}
+
+	_, err := authorize(id, ts.URL+"/apis/tpm-provisioner", "")
+	if !errors.Is(err, ErrNotWhitelisted) {
+		t.Fatalf("Expected ErrNotWhitelisted, received: %v", err)
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a %d APIError, received: %v", http.StatusForbidden, err)
+	}
+}
+
+// TestErrorCodes validates that error responses unwrap to the typed error of
+// their code.
+func TestErrorCodes(t *testing.T) {
+	for code, expected := range map[provisioner.ErrorCode]error{
+		provisioner.CodeNodeTypeMismatch:    ErrNodeTypeMismatch,
+		provisioner.CodeComponentIneligible: ErrComponentIneligible,
+		provisioner.CodeUnavailable:         ErrUnavailable,
+		provisioner.CodeSubjectMismatch:     ErrSubjectMismatch,
+		"unknown":                           ErrServer,
+	} {
+		rec := httptest.NewRecorder()
+		rec.WriteHeader(http.StatusForbidden)
+
+		err := json.NewEncoder(rec).Encode(provisioner.ErrorResponse{Code: code, Reason: string(code)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = responseError(rec.Result())
+		if !errors.Is(err, expected) {
+			t.Errorf("Code %s returned %v, expected %v", code, err, expected)
+		}
+	}
+}
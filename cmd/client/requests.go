@@ -30,6 +30,7 @@ import (
 	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -39,6 +40,85 @@ import (
 	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
 )
 
+// Typed errors for the tpm-provisioner API error codes.
+var (
+	ErrBadRequest        = errors.New("bad request")
+	ErrUnauthenticated   = errors.New("unauthenticated")
+	ErrInvalidSession    = errors.New("invalid session")
+	ErrNotWhitelisted    = errors.New("xname is not whitelisted")
+	ErrEKUntrusted       = errors.New("EK is not trusted")
+	ErrEKMismatch        = errors.New("EK does not match the xname binding")
+	ErrNodeTypeMismatch  = errors.New("node type does not match the xname")
+	ErrSubjectMismatch   = errors.New("requested subject does not match the session")
+	ErrChallengeMismatch = errors.New("challenge mismatch")
+	ErrOutOfOrder        = errors.New("request out of order")
+	ErrSessionExpired    = errors.New("session expired")
+	ErrRateLimited       = errors.New("rate limited")
+	// ErrComponentIneligible is permanent, the Hardware State Manager does
+	// not allow the component to enroll. ErrUnavailable may be retried.
+	ErrComponentIneligible = errors.New("component is not eligible to enroll")
+	ErrUnavailable         = errors.New("service unavailable")
+	ErrServer              = errors.New("server error")
+)
+
+var codeErrors = map[provisioner.ErrorCode]error{
+	provisioner.CodeBadRequest:          ErrBadRequest,
+	provisioner.CodeUnauthenticated:     ErrUnauthenticated,
+	provisioner.CodeInvalidSession:      ErrInvalidSession,
+	provisioner.CodeNotWhitelisted:      ErrNotWhitelisted,
+	provisioner.CodeEKUntrusted:         ErrEKUntrusted,
+	provisioner.CodeEKMismatch:          ErrEKMismatch,
+	provisioner.CodeNodeTypeMismatch:    ErrNodeTypeMismatch,
+	provisioner.CodeSubjectMismatch:     ErrSubjectMismatch,
+	provisioner.CodeChallengeMismatch:   ErrChallengeMismatch,
+	provisioner.CodeOutOfOrder:          ErrOutOfOrder,
+	provisioner.CodeSessionExpired:      ErrSessionExpired,
+	provisioner.CodeRateLimited:         ErrRateLimited,
+	provisioner.CodeComponentIneligible: ErrComponentIneligible,
+	provisioner.CodeUnavailable:         ErrUnavailable,
+}
+
+// APIError is an error response from the tpm-provisioner server. It unwraps to
+// the typed error of its code, or ErrServer for unknown codes.
+type APIError struct {
+	StatusCode int
+	Code       provisioner.ErrorCode
+	Reason     string
+}
+
+// Error returns the error message.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("tpm-provisioner returned %d %s: %s", e.StatusCode, e.Code, e.Reason)
+}
+
+// Unwrap returns the typed error of the error code.
+func (e *APIError) Unwrap() error {
+	if err, ok := codeErrors[e.Code]; ok {
+		return err
+	}
+
+	return ErrServer
+}
+
+// responseError returns the APIError of a failed response.
+func responseError(resp *http.Response) error {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	apiErr := &APIError{StatusCode: resp.StatusCode, Reason: string(data)}
+
+	var body provisioner.ErrorResponse
+
+	if json.Unmarshal(data, &body) == nil && body.Code != "" {
+		apiErr.Code = body.Code
+		apiErr.Reason = body.Reason
+	}
+
+	return apiErr
+}
+
 // authorize requests a session cookie from the tpm-provisioning server.
 func authorize(id pkix.Name, url string, jwt string) (string, error) {
 	nodeType := strings.Split(id.CommonName, "/")[0]
@@ -66,12 +146,10 @@ func authorize(id pkix.Name, url string, jwt string) (string, error) {
 		return "", err
 	}
 
-	if resp.StatusCode != 200 {
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
-		}
-		return "", fmt.Errorf("error authorizing to tpm-provisioner: %+v: %v", resp.StatusCode, string(data))
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error authorizing to tpm-provisioner: %w", responseError(resp))
 	}
 
 	var j provisioner.AuthorizeResponse
@@ -81,13 +159,8 @@ func authorize(id pkix.Name, url string, jwt string) (string, error) {
 		return "", err
 	}
 
-	err = resp.Body.Close()
-	if err != nil {
-		return "", err
-	}
-
 	if !j.Success {
-		log.Fatalf("Received Failure Reason: %v", j.Reason)
+		return "", fmt.Errorf("%w: %s", ErrServer, j.Reason)
 	}
 
 	if len(resp.Cookies()) == 0 {
@@ -111,8 +184,9 @@ func authorize(id pkix.Name, url string, jwt string) (string, error) {
 	return sessionCookie, nil
 }
 
-// challengeRequest sends a challenge request to the tpm-provisioner server.
-func challengeRequest(data []byte, sig []byte, sessionCookie string, url string, jwt string) (provisioner.CertificateResponse, error) {
+// challengeRequest sends a challenge request to the tpm-provisioner server. It
+// returns the session cookie to use when submitting the challenge.
+func challengeRequest(data []byte, sig []byte, sessionCookie string, url string, jwt string) (provisioner.CertificateResponse, string, error) {
 	reqData := provisioner.CertificateRequest{
 		Data: base64.StdEncoding.EncodeToString(data),
 		Sig:  base64.StdEncoding.EncodeToString(sig),
@@ -127,7 +201,7 @@ func challengeRequest(data []byte, sig []byte, sessionCookie string, url string,
 
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/challenge/request", url), bytes.NewBuffer(body))
 	if err != nil {
-		return provisioner.CertificateResponse{}, err
+		return provisioner.CertificateResponse{}, "", err
 	}
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
@@ -142,42 +216,49 @@ func challengeRequest(data []byte, sig []byte, sessionCookie string, url string,
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return provisioner.CertificateResponse{}, err
+		return provisioner.CertificateResponse{}, "", err
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&certResp)
-	if err != nil {
-		return provisioner.CertificateResponse{}, err
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return provisioner.CertificateResponse{}, "", responseError(resp)
 	}
 
-	err = resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&certResp)
 	if err != nil {
-		return provisioner.CertificateResponse{}, err
+		return provisioner.CertificateResponse{}, "", err
 	}
 
-	if !certResp.Success {
-		log.Fatalf("Failed to request challenge: %v", certResp.Reason)
+	// The server may hand out a new session cookie for the next step.
+	for _, v := range resp.Cookies() {
+		if v.Name == "session" {
+			sessionCookie = v.Value
+		}
 	}
 
-	return certResp, nil
+	return certResp, sessionCookie, nil
 }
 
 // challengeSubmit submits the challenge response to the tpm-provisioner server.
-func challengeSubmit(data []byte, sessionCookie string, url string, jwt string) ([]byte, error) {
+// reqData is the data sent with the challenge request. It returns the DevID
+// and AK certificates.
+func challengeSubmit(data []byte, reqData []byte, sessionCookie string, url string, jwt string) ([]byte, []byte, error) {
 	submission := provisioner.SubmitRequest{
-		Data: base64.StdEncoding.EncodeToString(data),
+		Data:    base64.StdEncoding.EncodeToString(data),
+		Request: base64.StdEncoding.EncodeToString(reqData),
 	}
 
 	httpClient := http.Client{}
 
 	body, err := json.Marshal(submission)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/challenge/submit", url), bytes.NewBuffer(body))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
@@ -190,29 +271,31 @@ func challengeSubmit(data []byte, sessionCookie string, url string, jwt string)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, responseError(resp)
 	}
 
 	var submitResp provisioner.SubmitResponse
 
 	err = json.NewDecoder(resp.Body).Decode(&submitResp)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	err = resp.Body.Close()
+	devID, err := base64.RawStdEncoding.DecodeString(submitResp.DevIDCertificate)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if !submitResp.Success {
-		log.Fatalf("Failed to request challenge: %v", submitResp.Reason)
-	}
-
-	devID, err := base64.RawStdEncoding.DecodeString(submitResp.DevIDCertificate)
+	ak, err := base64.RawStdEncoding.DecodeString(submitResp.AttestationCertificate)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return devID, nil
+	return devID, ak, nil
 }
@@ -0,0 +1,400 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// adminRequest sends an admin request with an optional bearer token and
+// checks its status and error code.
+func adminRequest(t *testing.T, client *http.Client, method string, target string, token string, status int, code provisioner.ErrorCode) {
+	t.Helper()
+
+	var body *strings.Reader
+
+	if i := strings.Index(target, "?"); method == http.MethodPost && i >= 0 {
+		body = strings.NewReader(target[i+1:])
+		target = target[:i]
+	} else {
+		body = strings.NewReader("")
+	}
+
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s returned %d, expected %d", method, target, resp.StatusCode, status)
+	}
+
+	if code == "" {
+		return
+	}
+
+	var e provisioner.ErrorResponse
+
+	if err = json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Code != code {
+		t.Fatalf("%s %s returned %+v, expected %s: %v", method, target, e, code, err)
+	}
+}
+
+// writeAdminTokens writes an admin tokens file for the tokens mapped to
+// their name and role.
+func writeAdminTokens(t *testing.T, tokens map[string][2]string) string {
+	t.Helper()
+
+	var b strings.Builder
+
+	b.WriteString("tokens:\n")
+
+	for token, identity := range tokens {
+		sum := sha256.Sum256([]byte(token))
+		b.WriteString("  - name: " + identity[0] + "\n    role: " + identity[1] + "\n    sha256: " + hex.EncodeToString(sum[:]) + "\n")
+	}
+
+	path := filepath.Join(t.TempDir(), "tokens.yaml")
+
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// TestAdminAuthTokens validates the roles required by the admin routes with
+// static tokens, and that enrollment routes stay public.
+func TestAdminAuthTokens(t *testing.T) {
+	provisioner.CFG = provisioner.Config{WhiteList: filepath.Join(t.TempDir(), "whitelist")}
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	auth, err := provisioner.NewAdminAuthenticator(provisioner.Config{
+		AdminAuthMode: provisioner.AdminAuthModeRequired,
+		AdminTokens: writeAdminTokens(t, map[string][2]string{
+			"viewer-token":   {"dashboard", "viewer"},
+			"operator-token": {"ops", "operator"},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.AdminAuth = auth
+
+	defer func() {
+		provisioner.AdminAuth = nil
+		provisioner.WhiteList = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	apiURL := ts.URL + "/apis/tpm-provisioner"
+	client := ts.Client()
+
+	adminRequest(t, client, "GET", apiURL+"/whitelist/get", "", http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+	adminRequest(t, client, "GET", apiURL+"/whitelist/get", "wrong-token", http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+	adminRequest(t, client, "GET", apiURL+"/whitelist/get", "viewer-token", http.StatusOK, "")
+	adminRequest(t, client, "POST", apiURL+"/whitelist/add?xname=x1000c0s0b0n0", "", http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+	adminRequest(t, client, "POST", apiURL+"/whitelist/add?xname=x1000c0s0b0n0", "viewer-token", http.StatusForbidden, provisioner.CodeForbidden)
+	adminRequest(t, client, "POST", apiURL+"/whitelist/add?xname=x1000c0s0b0n0", "operator-token", http.StatusOK, "")
+	adminRequest(t, client, "POST", apiURL+"/revoke?serial=1", "operator-token", http.StatusForbidden, provisioner.CodeForbidden)
+	adminRequest(t, client, "GET", apiURL+"/v2/whitelist", "", http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+	adminRequest(t, client, "GET", apiURL+"/authorize?type=compute&xname=x1000c0s0b0n0", "", http.StatusOK, "")
+	adminRequest(t, client, "GET", apiURL+"/v2/openapi.json", "", http.StatusOK, "")
+
+	entries := provisioner.WhiteListEntries()
+	if len(entries) != 1 || entries[0].CreatedBy != "ops" {
+		t.Fatalf("Expected one entry created by ops, found %+v", entries)
+	}
+}
+
+// TestAdminAuthJWT validates admin JWTs signed by a key in the JWKS file and
+// the mapping of their role claim.
+func TestAdminAuthJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: key.Public(), KeyID: "admin", Algorithm: string(jose.ES256), Use: "sig"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksFile := filepath.Join(t.TempDir(), "admin.jwks")
+
+	if err = os.WriteFile(jwksFile, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = provisioner.NewAdminAuthenticator(provisioner.Config{
+		AdminAuthMode: provisioner.AdminAuthModeRequired,
+		AdminJWKS:     jwksFile,
+	}); err == nil {
+		t.Fatal("Admin JWKS without an issuer was accepted")
+	}
+
+	auth, err := provisioner.NewAdminAuthenticator(provisioner.Config{
+		AdminAuthMode:    provisioner.AdminAuthModeRequired,
+		AdminJWKS:        jwksFile,
+		AdminJWTIssuer:   "https://keycloak/realms/shasta",
+		AdminJWTAudience: "tpm-provisioner",
+		AdminJWTRoles:    map[string][]string{"viewer": {"tpm-viewer"}, "operator": {"tpm-operator"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.AdminAuth = auth
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+
+	defer func() {
+		provisioner.AdminAuth = nil
+		provisioner.WhiteList = nil
+	}()
+
+	sign := func(signer *ecdsa.PrivateKey, issuer string, expiry time.Time, roles ...string) string {
+		t.Helper()
+
+		s, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.ES256, Key: signer},
+			(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "admin"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := jwt.Signed(s).Claims(jwt.Claims{
+			Issuer:   issuer,
+			Subject:  "4b1c7f2e",
+			Audience: jwt.Audience{"tpm-provisioner", "account"},
+			Expiry:   jwt.NewNumericDate(expiry),
+		}).Claims(map[string]any{
+			"preferred_username": "admin-user",
+			"realm_access":       map[string]any{"roles": roles},
+		}).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return token
+	}
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	whitelistURL := ts.URL + "/apis/tpm-provisioner/whitelist/get"
+	issuer := "https://keycloak/realms/shasta"
+	expiry := time.Now().Add(time.Hour)
+
+	adminRequest(t, ts.Client(), "GET", whitelistURL, sign(key, issuer, expiry, "offline_access", "tpm-viewer"), http.StatusOK, "")
+	adminRequest(t, ts.Client(), "GET", whitelistURL, sign(key, issuer, expiry, "offline_access"), http.StatusForbidden, provisioner.CodeForbidden)
+	adminRequest(t, ts.Client(), "GET", whitelistURL, sign(key, "https://other", expiry, "tpm-viewer"), http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+	adminRequest(t, ts.Client(), "GET", whitelistURL, sign(key, issuer, time.Now().Add(-time.Hour), "tpm-viewer"), http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+	adminRequest(t, ts.Client(), "GET", whitelistURL, sign(other, issuer, expiry, "tpm-viewer"), http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+}
+
+// TestAdminAuthClientCert validates admin callers authenticated by a client
+// certificate.
+func TestAdminAuthClientCert(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Admin CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCert := func(cn string) tls.Certificate {
+		t.Helper()
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, key.Public(), caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	auth, err := provisioner.NewAdminAuthenticator(provisioner.Config{
+		AdminClientCerts: map[string][]string{"admin": {"admin-cli"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.AdminAuth = auth
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+
+	defer func() {
+		provisioner.AdminAuth = nil
+		provisioner.WhiteList = nil
+	}()
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	ts := httptest.NewUnstartedServer(provisioner.NewRouter())
+	ts.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	ts.StartTLS()
+
+	defer ts.Close()
+
+	whitelistURL := ts.URL + "/apis/tpm-provisioner/whitelist/get"
+
+	withCert := func(cert tls.Certificate) *http.Client {
+		client := ts.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+		return &http.Client{Transport: transport}
+	}
+
+	adminRequest(t, ts.Client(), "GET", whitelistURL, "", http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+	adminRequest(t, withCert(clientCert("admin-cli")), "GET", whitelistURL, "", http.StatusOK, "")
+	adminRequest(t, withCert(clientCert("node")), "GET", whitelistURL, "", http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+}
+
+// TestAdminAuthRoutes validates the route role overrides.
+func TestAdminAuthRoutes(t *testing.T) {
+	_, err := provisioner.NewAdminAuthenticator(provisioner.Config{AdminRoutes: map[string]string{"nosuchroute": "viewer"}})
+	if err == nil {
+		t.Fatalf("Unknown route accepted")
+	}
+
+	_, err = provisioner.NewAdminAuthenticator(provisioner.Config{AdminRoutes: map[string]string{"metrics": "root"}})
+	if err == nil {
+		t.Fatalf("Unknown role accepted")
+	}
+
+	auth, err := provisioner.NewAdminAuthenticator(provisioner.Config{
+		AdminTokens: writeAdminTokens(t, map[string][2]string{"viewer-token": {"prometheus", "viewer"}}),
+		// Config keys are lower cased.
+		AdminRoutes: map[string]string{"metrics": "viewer", "listwhitelist": "public"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.AdminAuth = auth
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+
+	defer func() {
+		provisioner.AdminAuth = nil
+		provisioner.WhiteList = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	adminRequest(t, ts.Client(), "GET", ts.URL+"/metrics", "", http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+	adminRequest(t, ts.Client(), "GET", ts.URL+"/metrics", "viewer-token", http.StatusOK, "")
+	adminRequest(t, ts.Client(), "GET", ts.URL+"/apis/tpm-provisioner/whitelist/get", "", http.StatusOK, "")
+	adminRequest(t, ts.Client(), "GET", ts.URL+"/apis/tpm-provisioner/v2/whitelist", "", http.StatusUnauthorized, provisioner.CodeUnauthenticated)
+}
+
+// TestAdminAuthOff validates that admin routes are public when admin
+// authentication is off.
+func TestAdminAuthOff(t *testing.T) {
+	auth, err := provisioner.NewAdminAuthenticator(provisioner.Config{AdminAuthMode: provisioner.AdminAuthModeOff})
+	if err != nil || auth != nil {
+		t.Fatalf("Expected no authenticator, got %v: %v", auth, err)
+	}
+}
@@ -0,0 +1,346 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/gorilla/mux"
+)
+
+// openAPIDocument is the part of the OpenAPI document checked by the tests.
+type openAPIDocument struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+// TestOpenAPIRoutes validates that the OpenAPI document describes exactly the
+// v2 routes.
+func TestOpenAPIRoutes(t *testing.T) {
+	var doc openAPIDocument
+
+	if err := json.Unmarshal(provisioner.OpenAPI, &doc); err != nil {
+		t.Fatalf("Unable to parse the OpenAPI document: %v", err)
+	}
+
+	documented := []string{}
+
+	for path, item := range doc.Paths {
+		for method, raw := range item {
+			if method == "parameters" {
+				continue
+			}
+
+			var op struct {
+				OperationID string `json:"operationId"`
+			}
+
+			if err := json.Unmarshal(raw, &op); err != nil {
+				t.Fatal(err)
+			}
+
+			documented = append(documented, strings.ToUpper(method)+" "+path+" "+op.OperationID)
+		}
+	}
+
+	prefix := "/apis/tpm-provisioner/v2"
+	pattern := regexp.MustCompile(`\{(\w+):[^}]*\}`)
+	routed := []string{}
+
+	err := provisioner.NewRouter().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, prefix+"/") {
+			return nil
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+
+		path = pattern.ReplaceAllString(strings.TrimPrefix(path, prefix), "{$1}")
+
+		for _, method := range methods {
+			routed = append(routed, method+" "+path+" "+route.GetName())
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(documented)
+	sort.Strings(routed)
+
+	if !reflect.DeepEqual(documented, routed) {
+		t.Fatalf("OpenAPI paths do not match the v2 routes\ndocumented: %v\nrouted: %v", documented, routed)
+	}
+}
+
+// TestRouteNames validates that every route has a unique name, since the
+// admin route roles are looked up by name.
+func TestRouteNames(t *testing.T) {
+	names := map[string]string{}
+
+	err := provisioner.NewRouter().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+
+		if other, ok := names[route.GetName()]; ok {
+			t.Errorf("Route %s names both %s and %s", route.GetName(), other, path)
+		}
+
+		names[route.GetName()] = path
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOpenAPISchemas validates that the OpenAPI schemas match the JSON fields
+// of the api types.
+func TestOpenAPISchemas(t *testing.T) {
+	var doc openAPIDocument
+
+	if err := json.Unmarshal(provisioner.OpenAPI, &doc); err != nil {
+		t.Fatalf("Unable to parse the OpenAPI document: %v", err)
+	}
+
+	types := map[string]any{
+		"ErrorResponse":           provisioner.ErrorResponse{},
+		"WhiteListEntry":          provisioner.WhiteListEntry{},
+		"WhiteListMatch":          provisioner.WhiteListMatch{},
+		"TestWhiteListResponse":   provisioner.TestWhiteListResponse{},
+		"SessionRequest":          provisioner.SessionRequest{},
+		"SessionResponse":         provisioner.SessionResponse{},
+		"CertificateRequest":      provisioner.CertificateRequest{},
+		"CertificateResponse":     provisioner.CertificateResponse{},
+		"SubmitRequest":           provisioner.SubmitRequest{},
+		"SubmitResponse":          provisioner.SubmitResponse{},
+		"RevokeRequest":           provisioner.RevokeRequest{},
+		"RevokeResponse":          provisioner.RevokeResponse{},
+		"BindingRequest":          provisioner.BindingRequest{},
+		"EKBinding":               provisioner.EKBinding{},
+		"IssuedCertificate":       provisioner.IssuedCertificate{},
+		"EKInventoryEntry":        provisioner.EKInventoryEntry{},
+		"ImportInventoryResponse": provisioner.ImportInventoryResponse{},
+	}
+
+	for name, v := range types {
+		schema, ok := doc.Components.Schemas[name]
+		if !ok {
+			t.Errorf("Schema %s is not documented", name)
+			continue
+		}
+
+		fields := []string{}
+		rt := reflect.TypeOf(v)
+
+		for i := 0; i < rt.NumField(); i++ {
+			tag := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+			if tag != "" && tag != "-" {
+				fields = append(fields, tag)
+			}
+		}
+
+		properties := []string{}
+
+		for p := range schema.Properties {
+			properties = append(properties, p)
+		}
+
+		sort.Strings(fields)
+		sort.Strings(properties)
+
+		if !reflect.DeepEqual(fields, properties) {
+			t.Errorf("Schema %s has properties %v, expected %v", name, properties, fields)
+		}
+	}
+}
+
+// TestAPIV2 validates the v2 verbs and status codes and that v1 still serves
+// the same state.
+func TestAPIV2(t *testing.T) {
+	provisioner.CFG = provisioner.Config{WhiteList: filepath.Join(t.TempDir(), "whitelist")}
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	defer func() {
+		provisioner.WhiteList = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	apiURL := ts.URL + "/apis/tpm-provisioner"
+
+	do := func(method string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, apiURL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	entry := "/v2/whitelist/" + provisioner.WhiteListEntryID("x1000c0s0b0n[0-9]")
+	createdAt := time.Time{}
+
+	for _, status := range []int{http.StatusCreated, http.StatusOK} {
+		resp := do("PUT", entry, `{"nodeTypes": ["compute"], "comment": "cabinet 1000"}`)
+
+		var put provisioner.WhiteListEntry
+
+		err := json.NewDecoder(resp.Body).Decode(&put)
+		resp.Body.Close()
+
+		if resp.StatusCode != status || err != nil {
+			t.Fatalf("PUT whitelist entry returned %d, expected %d: %v", resp.StatusCode, status, err)
+		}
+
+		if createdAt.IsZero() {
+			createdAt = put.CreatedAt
+		} else if !put.CreatedAt.Equal(createdAt) {
+			t.Fatalf("PUT replaced the creation time %v with %v", createdAt, put.CreatedAt)
+		}
+	}
+
+	resp := do("GET", "/whitelist/get", "")
+
+	var list []provisioner.WhiteListEntry
+
+	err := json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+
+	if err != nil || len(list) != 1 || list[0].Pattern != "x1000c0s0b0n[0-9]" || list[0].Comment != "cabinet 1000" || list[0].CreatedBy == "" {
+		t.Fatalf("Unexpected v1 white list %+v: %v", list, err)
+	}
+
+	if "/v2/whitelist/"+list[0].ID != entry || !list[0].CreatedAt.Equal(createdAt) {
+		t.Fatalf("Listed entry has id %q and creation time %v", list[0].ID, list[0].CreatedAt)
+	}
+
+	// Regexps may contain a / or +, which the id encodes.
+	slash := "/v2/whitelist/" + provisioner.WhiteListEntryID("x1000c0s0b0n(1|2)+/?")
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		resp = do(method, slash, "")
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("%s of a whitelist entry with a / returned %d", method, resp.StatusCode)
+		}
+	}
+
+	resp = do("DELETE", "/v2/whitelist/"+url.PathEscape("x1000c0s0b0n[0-9]"), "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("DELETE by an unencoded pattern returned %d", resp.StatusCode)
+	}
+
+	resp = do("POST", "/v2/sessions", `{"xname": "x1000c0s0b0n1", "type": "ncn"}`)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Session for a node type the entry does not allow returned %d", resp.StatusCode)
+	}
+
+	resp = do("POST", "/v2/sessions", `{"xname": "x1000c0s0b0n1", "type": "compute"}`)
+
+	var session provisioner.SessionResponse
+
+	err = json.NewDecoder(resp.Body).Decode(&session)
+	resp.Body.Close()
+
+	if err != nil || resp.StatusCode != http.StatusCreated || !session.Success || session.ExpiresAt.IsZero() {
+		t.Fatalf("Unexpected session response %d %+v: %v", resp.StatusCode, session, err)
+	}
+
+	if len(resp.Cookies()) == 0 || resp.Cookies()[0].Name != "session" {
+		t.Fatalf("No session cookie set")
+	}
+
+	resp = do("POST", "/v2/sessions", `{"xname": "x1000c0s0b0n1", "unknown": true}`)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unknown session request field returned %d", resp.StatusCode)
+	}
+
+	resp = do("DELETE", entry, "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE whitelist entry returned %d", resp.StatusCode)
+	}
+
+	resp = do("DELETE", entry, "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("DELETE of a missing whitelist entry returned %d", resp.StatusCode)
+	}
+
+	resp = do("GET", "/v2/certificates?xname=x1000c0s0b0n1", "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("Certificates without a ledger returned %d", resp.StatusCode)
+	}
+
+	resp = do("GET", "/v2/openapi.json", "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("OpenAPI document returned %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// TestAuditLog validates that admin and enrollment requests are audited with
+// their request ID and outcome, and that the hash chain continues when the
+// log is reopened.
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	audit, err := provisioner.OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.Audit = audit
+	provisioner.CFG = provisioner.Config{WhiteList: filepath.Join(t.TempDir(), "whitelist")}
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	defer func() {
+		provisioner.Audit = nil
+		provisioner.WhiteList = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	apiURL := ts.URL + "/apis/tpm-provisioner"
+
+	resp, err := http.PostForm(apiURL+"/whitelist/add", url.Values{"xname": {"x1000c0s0b0n0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	req, err := http.NewRequest("GET", apiURL+"/authorize?type=compute&xname=x9999c0s0b0n0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("X-Request-Id", "test-request")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.Header.Get("X-Request-Id") != "test-request" {
+		t.Fatalf("Request ID not returned: %q", resp.Header.Get("X-Request-Id"))
+	}
+
+	if err = audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reopened log continues the chain.
+	provisioner.Audit, err = provisioner.OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.Get(apiURL + "/authorize?type=compute&xname=x1000c0s0b0n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+	provisioner.Audit.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	events := []provisioner.AuditEvent{}
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var ev provisioner.AuditEvent
+
+		if err = json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+
+		events = append(events, ev)
+	}
+
+	expected := []struct {
+		event   string
+		xname   string
+		outcome string
+	}{
+		{provisioner.AuditWhiteListAdd, "", provisioner.AuditSuccess},
+		{provisioner.AuditAuthorize, "x9999c0s0b0n0", provisioner.AuditFailure},
+		{provisioner.AuditAuthorize, "x1000c0s0b0n0", provisioner.AuditSuccess},
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d audit events, found %d", len(expected), len(events))
+	}
+
+	for i, e := range expected {
+		ev := events[i]
+		if ev.Event != e.event || ev.Xname != e.xname || ev.Outcome != e.outcome || ev.Seq != uint64(i+1) || ev.SourceIP == "" {
+			t.Errorf("Unexpected audit event %d: %+v", i, ev)
+		}
+	}
+
+	if events[0].Details["pattern"] != "x1000c0s0b0n0" {
+		t.Errorf("Whitelist pattern not audited: %+v", events[0])
+	}
+
+	if events[1].RequestID != "test-request" || events[1].Reason == "" {
+		t.Errorf("Rejected authorize not audited with its request ID and reason: %+v", events[1])
+	}
+
+	if _, err = f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	n, _, err := provisioner.VerifyAuditLog(f, "")
+	if err != nil || n != 3 {
+		t.Fatalf("Audit log verification failed after %d records: %v", n, err)
+	}
+}
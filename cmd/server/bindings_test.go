@@ -0,0 +1,132 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// TestEKBindingTOFU validates that an xname is bound to the first EK that
+// enrolls it and rejects other EKs until it is rebound.
+func TestEKBindingTOFU(t *testing.T) {
+	ledger := openTestLedger(t)
+
+	first := strings.Repeat("aa", 32)
+	second := strings.Repeat("bb", 32)
+
+	if _, err := ledger.Bind("x1000c0s0b0n0", first); err != nil {
+		t.Fatalf("First enrollment was not bound: %v", err)
+	}
+
+	if _, err := ledger.Bind("x1000c0s0b0n0", first); err != nil {
+		t.Fatalf("Re-enrollment with the bound EK failed: %v", err)
+	}
+
+	_, err := ledger.Bind("x1000c0s0b0n0", second)
+
+	expected := "EK does not match the EK bound to the xname"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected: %s\nReceived: %v", expected, err)
+	}
+
+	provisioner.Issued = ledger
+
+	defer func() {
+		provisioner.Issued = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	apiURL := ts.URL + "/apis/tpm-provisioner/bindings"
+
+	resp, err := http.PostForm(apiURL+"/set", url.Values{"xname": {"x1000c0s0b0n0"}, "ek": {"not-a-fingerprint"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("Invalid fingerprint accepted")
+	}
+
+	resp, err = http.PostForm(apiURL+"/set", url.Values{"xname": {"x1000c0s0b0n0"}, "ek": {second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Rebinding failed with status %d", resp.StatusCode)
+	}
+
+	if _, err = ledger.Bind("x1000c0s0b0n0", second); err != nil {
+		t.Fatalf("Enrollment with the rebound EK failed: %v", err)
+	}
+
+	resp, err = http.Get(apiURL + "/get?xname=x1000c0s0b0n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var binding provisioner.EKBinding
+
+	err = json.NewDecoder(resp.Body).Decode(&binding)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if binding.EKFingerprint != second || binding.Source != provisioner.BindingSourceAdmin {
+		t.Fatalf("Unexpected binding: %+v", binding)
+	}
+
+	resp, err = http.PostForm(apiURL+"/clear", url.Values{"xname": {"x1000c0s0b0n0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	bindings, err := ledger.Bindings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bindings) != 0 {
+		t.Fatalf("Binding was not cleared: %+v", bindings)
+	}
+}
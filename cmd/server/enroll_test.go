@@ -0,0 +1,417 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/client"
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/cray-hpe/tpm-provisioner/tests/simulateTPM"
+	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/proto/enrollapi"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// TestEnrollGRPC validates that a DevID can be issued over the gRPC
+// Enrollment service.
+func TestEnrollGRPC(t *testing.T) {
+	rw := openTPM(t)
+
+	defer func() {
+		if err := rw.Close(); err != nil {
+			t.Errorf("Unable to close simulator: %v", err)
+		}
+	}()
+
+	caCRT, err := simulateTPM.CreateEK(rw)
+	if err != nil {
+		t.Fatalf("Unable to provision EK: %v", err)
+	}
+
+	certPool := x509.NewCertPool()
+
+	if !certPool.AppendCertsFromPEM(caCRT) {
+		t.Fatalf("Unable to Add CA to cert pool")
+	}
+
+	pCA, pPrivKey, pCAPEM, err := simulateTPM.GenerateCA("Provisioner CA")
+	if err != nil {
+		t.Fatalf("Unable to provision CA: %v", err)
+	}
+
+	spireTokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer spireTokens.Close()
+
+	provisioner.CFG = provisioner.Config{
+		ManufactuerCAs:  certPool,
+		ProviderCA:      pCA,
+		ProviderKey:     pPrivKey,
+		SpireTokensURL:  spireTokens.URL,
+		EKInventoryMode: provisioner.EKInventoryModeXname,
+	}
+
+	provisioner.WhiteList = append(provisioner.WhiteList, provisioner.WhiteListEntry{Pattern: "x1000c0s0b0n0"})
+
+	provisioner.Issued = openTestLedger(t)
+
+	defer func() {
+		provisioner.Issued = nil
+	}()
+
+	// Only the simulator's EK may enroll x1000c0s0b0n0.
+	ekCert, err := tpm2.NVRead(rw, tpmutil.Handle(0x01c00002))
+	if err != nil {
+		t.Fatalf("Unable to read EK certificate: %v", err)
+	}
+
+	// The NV index is padded, keep only the DER encoded certificate.
+	var ekDER asn1.RawValue
+
+	if _, err = asn1.Unmarshal(ekCert, &ekDER); err != nil {
+		t.Fatalf("Unable to decode EK certificate: %v", err)
+	}
+
+	ekPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ekDER.FullBytes})
+
+	inventory, err := json.Marshal([]provisioner.EKInventoryEntry{{Xname: "x1000c0s0b0n0", Certificate: string(ekPEM)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := provisioner.ParseEKInventory(provisioner.InventoryFormatJSON, bytes.NewReader(inventory))
+	if err != nil {
+		t.Fatalf("Unable to parse EK inventory: %v", err)
+	}
+
+	if err = provisioner.Issued.AddInventory(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1024 * 1024)
+
+	srv := provisioner.NewGRPCServer()
+
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			t.Errorf("gRPC server failed: %v", err)
+		}
+	}()
+
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Unable to dial gRPC server: %v", err)
+	}
+
+	defer conn.Close()
+
+	id := pkix.Name{
+		CommonName: "compute/x1000c0s0b0n0",
+	}
+
+	devID, ak, _, err := client.Enroll(context.Background(), conn, rw, "x1000c0s0b0n0", "compute", id, "")
+	if err != nil {
+		t.Fatalf("gRPC enrollment failed: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(devID)
+	if err != nil {
+		t.Fatalf("Unable to parse DevID certificate: %v", err)
+	}
+
+	block, _ := pem.Decode(pCAPEM.Bytes())
+
+	issuer, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cert.CheckSignatureFrom(issuer); err != nil {
+		t.Fatalf("DevID not signed by the provider CA: %v", err)
+	}
+
+	akCert, err := x509.ParseCertificate(ak)
+	if err != nil {
+		t.Fatalf("Unable to parse AK certificate: %v", err)
+	}
+
+	if err = akCert.CheckSignatureFrom(issuer); err != nil {
+		t.Fatalf("AK certificate not signed by the provider CA: %v", err)
+	}
+
+	if len(akCert.UnknownExtKeyUsage) != 1 || !akCert.UnknownExtKeyUsage[0].Equal(asn1.ObjectIdentifier{2, 23, 133, 8, 3}) {
+		t.Fatalf("Unexpected AK certificate extended key usage: %v", akCert.UnknownExtKeyUsage)
+	}
+
+	if !bytes.Equal(subjectAltName(akCert), subjectAltName(cert)) {
+		t.Fatalf("AK and DevID certificates have different SANs")
+	}
+
+	issued, err := provisioner.Issued.ByXname("x1000c0s0b0n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(issued) != 2 {
+		t.Fatalf("Expected 2 ledger records, found %d", len(issued))
+	}
+
+	rec, err := provisioner.Issued.BySerial(provisioner.SerialString(cert.SerialNumber.Bytes()))
+	if err != nil {
+		t.Fatalf("DevID not recorded in the ledger: %v", err)
+	}
+
+	if rec.Kind != provisioner.KindDevID || rec.NodeType != "compute" || rec.EKFingerprint == "" {
+		t.Fatalf("Unexpected ledger record: %+v", rec)
+	}
+
+	binding, err := provisioner.Issued.Binding("x1000c0s0b0n0")
+	if err != nil {
+		t.Fatalf("xname was not bound to its EK: %v", err)
+	}
+
+	if binding.EKFingerprint != rec.EKFingerprint {
+		t.Fatalf("xname bound to %s, enrolled with %s", binding.EKFingerprint, rec.EKFingerprint)
+	}
+
+	// Serials are random, at most 20 octets and distinct for every
+	// certificate, not derived from the certified keys.
+	for _, c := range []*x509.Certificate{cert, akCert} {
+		if c.SerialNumber.Sign() <= 0 || len(c.SerialNumber.Bytes()) > 20 {
+			t.Fatalf("Unexpected serial %x", c.SerialNumber)
+		}
+	}
+
+	if cert.SerialNumber.Cmp(akCert.SerialNumber) == 0 {
+		t.Fatalf("DevID and AK certificates share the serial %x", cert.SerialNumber)
+	}
+
+	// An xname that is not white listed is rejected before any TPM data is
+	// looked at.
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "xname", "x9999c0s0b0n0", "type", "compute")
+
+	stream, err := enrollapi.NewEnrollmentClient(conn).Enroll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = stream.Recv()
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied, received: %v", err)
+	}
+}
+
+// subjectAltName returns the subject alternative name extension of cert.
+func subjectAltName(cert *x509.Certificate) []byte {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 17}) {
+			return ext.Value
+		}
+	}
+
+	return nil
+}
+
+// TestEnrollGRPCExpired validates that an enrollment exceeding the session
+// TTL fails and issues nothing.
+func TestEnrollGRPCExpired(t *testing.T) {
+	pCA, pPrivKey, _, err := simulateTPM.GenerateCA("Provisioner CA")
+	if err != nil {
+		t.Fatalf("Unable to provision CA: %v", err)
+	}
+
+	provisioner.CFG = provisioner.Config{
+		ProviderCA:  pCA,
+		ProviderKey: pPrivKey,
+		SessionTTL:  time.Second,
+	}
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{{Pattern: "x1000c0s0b0n0"}}
+
+	provisioner.Issued, err = provisioner.OpenLedger(filepath.Join(t.TempDir(), "issued.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		provisioner.Issued.Close()
+		provisioner.Issued = nil
+		provisioner.WhiteList = nil
+	}()
+
+	conn := dialTestEnrollment(t)
+
+	err = enrollRaw(t, conn, "x1000c0s0b0n0", "compute", pkix.Name{CommonName: "compute/x1000c0s0b0n0"}, 2*time.Second)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded for an expired enrollment, received: %v", err)
+	}
+
+	issued, err := provisioner.Issued.ByXname("x1000c0s0b0n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(issued) != 0 {
+		t.Fatalf("Expired enrollment issued %d certificates", len(issued))
+	}
+}
+
+// TestGRPCTLS validates that the Enrollment service is served over TLS when
+// the server has a TLS certificate.
+func TestGRPCTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tpm-provisioner"},
+		DNSNames:     []string{"tpm-provisioner"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "tpm-provisioner"}}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cfg := provisioner.Config{TLSCert: filepath.Join(dir, "tls.crt"), TLSKey: filepath.Join(dir, "tls.key")}
+
+	if err = os.WriteFile(cfg.TLSCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(cfg.TLSKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := grpcServerOptions(cfg)
+	if err != nil {
+		t.Fatalf("Unable to configure gRPC TLS: %v", err)
+	}
+
+	lis := bufconn.Listen(1024 * 1024)
+	srv := provisioner.NewGRPCServer(opts...)
+
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			t.Errorf("gRPC server failed: %v", err)
+		}
+	}()
+
+	defer srv.Stop()
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	for _, tt := range []struct {
+		creds credentials.TransportCredentials
+		ok    bool
+	}{
+		{credentials.NewTLS(&tls.Config{RootCAs: roots, ServerName: "tpm-provisioner", MinVersion: tls.VersionTLS12}), true},
+		{insecure.NewCredentials(), false},
+	} {
+		conn, err := grpc.Dial(
+			"bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(tt.creds),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		// An empty enrollment fails in the service, or in the transport
+		// without TLS.
+		stream, err := enrollapi.NewEnrollmentClient(conn).Enroll(ctx)
+		if err == nil {
+			err = stream.CloseSend()
+		}
+
+		if err == nil {
+			_, err = stream.Recv()
+		}
+
+		cancel()
+		conn.Close()
+
+		if reached := status.Code(err) != codes.Unavailable && status.Code(err) != codes.DeadlineExceeded; reached != tt.ok {
+			t.Errorf("%s connection reached the service: %v, expected %v (%v)", tt.creds.Info().SecurityProtocol, reached, tt.ok, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// TestErrorCodes validates the HTTP status and error code of API errors.
+func TestErrorCodes(t *testing.T) {
+	provisioner.WhiteList = []provisioner.WhiteListEntry{{Pattern: "x1000c0s0b0n0"}}
+
+	defer func() {
+		provisioner.WhiteList = nil
+		provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+	}()
+
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	apiURL := ts.URL + "/apis/tpm-provisioner"
+
+	authorize := func(xname string) *http.Cookie {
+		resp, err := http.Get(apiURL + "/authorize?type=compute&xname=" + xname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		for _, c := range resp.Cookies() {
+			if c.Name == "session" {
+				return c
+			}
+		}
+
+		return nil
+	}
+
+	session := authorize("x1000c0s0b0n0")
+	if session == nil {
+		t.Fatalf("No session cookie set")
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		cookie *http.Cookie
+		status int
+		code   provisioner.ErrorCode
+	}{
+		{"not whitelisted", "GET", "/authorize?type=compute&xname=x9999c0s0b0n0", "", nil, http.StatusForbidden, provisioner.CodeNotWhitelisted},
+		{"missing session", "POST", "/challenge/request", "{}", nil, http.StatusUnauthorized, provisioner.CodeInvalidSession},
+		{"out of order", "POST", "/challenge/submit", "{}", session, http.StatusConflict, provisioner.CodeOutOfOrder},
+		{"bad request", "POST", "/challenge/request", "not json", session, http.StatusBadRequest, provisioner.CodeBadRequest},
+		{"whitelist not found", "POST", "/whitelist/remove?xname=x1", "", nil, http.StatusNotFound, provisioner.CodeNotFound},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, apiURL+tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var body provisioner.ErrorResponse
+
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if resp.StatusCode != tt.status || body.Code != tt.code || body.Success {
+			t.Errorf("%s: expected %d %s, received %d %+v", tt.name, tt.status, tt.code, resp.StatusCode, body)
+		}
+	}
+
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Millisecond)
+
+	session = authorize("x1000c0s0b0n0")
+
+	time.Sleep(5 * time.Millisecond)
+
+	req, err := http.NewRequest("POST", apiURL+"/challenge/request", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.AddCookie(session)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("Expected %d for an expired session, received %d", http.StatusGone, resp.StatusCode)
+	}
+}
@@ -59,6 +59,12 @@ func openTPM(tb testing.TB) io.ReadWriteCloser {
 func TestHappyPath(t *testing.T) {
 	rw := openTPM(t)
 
+	defer func() {
+		if err := rw.Close(); err != nil {
+			t.Errorf("Unable to close simulator: %v", err)
+		}
+	}()
+
 	caCRT, err := simulateTPM.CreateEK(rw)
 
 	certPool := x509.NewCertPool()
@@ -97,7 +103,7 @@ func TestHappyPath(t *testing.T) {
 
 	rr := httptest.NewRecorder()
 
-	provisioner.WhiteList = append(provisioner.WhiteList, "x1000c0s0b0n0")
+	provisioner.WhiteList = append(provisioner.WhiteList, provisioner.WhiteListEntry{Pattern: "x1000c0s0b0n0"})
 
 	r := strings.NewReader("")
 
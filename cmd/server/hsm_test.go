@@ -0,0 +1,185 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// fakeHSM is a Hardware State Manager serving fixed components.
+type fakeHSM struct {
+	mu         sync.Mutex
+	components map[string]provisioner.Component
+	requests   map[string]int
+	failing    bool
+}
+
+func (f *fakeHSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	xname, ok := strings.CutPrefix(r.URL.Path, "/hsm/v2/State/Components/")
+	if !ok || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.requests[xname]++
+
+	if f.failing {
+		http.Error(w, "database unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	component, ok := f.components[xname]
+	if !ok {
+		http.Error(w, `{"title":"Not Found","status":404}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(component); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// TestHSM validates the Hardware State Manager component checks, caching,
+// node type cross check and failure policies.
+func TestHSM(t *testing.T) {
+	hsm := &fakeHSM{
+		components: map[string]provisioner.Component{
+			"x1000c0s0b0n0": {ID: "x1000c0s0b0n0", Type: "Node", State: "Ready", Enabled: true, Role: "Compute"},
+			"x1000c0s0b0n1": {ID: "x1000c0s0b0n1", Type: "Node", State: "Off", Enabled: true, Role: "Compute"},
+			"x1000c0s0b0n2": {ID: "x1000c0s0b0n2", Type: "Node", State: "Ready", Enabled: false, Role: "Compute"},
+			"x1000c0s0b0n3": {ID: "x1000c0s0b0n3", Type: "Node", State: "On", Enabled: true, Role: "Management", SubRole: "Storage"},
+			"x1000c0s0b0n5": {ID: "x1000c0s0b0n5", Type: "Node", State: "Ready", Enabled: true, Role: "Compute"},
+		},
+		requests: map[string]int{},
+	}
+
+	hsmServer := httptest.NewServer(hsm)
+	defer hsmServer.Close()
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{{Pattern: "x1000c0s0b0n[0-7]"}}
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	defer func() {
+		provisioner.WhiteList = nil
+		provisioner.HSM = nil
+	}()
+
+	newClient := func(policy string) {
+		t.Helper()
+
+		client, err := provisioner.NewHSMClient(provisioner.Config{
+			HSMURL:           hsmServer.URL + "/hsm/v2/",
+			HSMFailurePolicy: policy,
+			// Config keys are lower cased.
+			HSMRoles: map[string]string{"compute": "compute", "management/storage": "storage"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		provisioner.HSM = client
+	}
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	authorize := func(xname string, nodeType string, status int, code provisioner.ErrorCode) {
+		t.Helper()
+
+		resp, err := http.Get(ts.URL + "/apis/tpm-provisioner/authorize?type=" + nodeType + "&xname=" + xname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var body provisioner.ErrorResponse
+
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != status || body.Code != code {
+			t.Errorf("Authorizing %s as %s returned %d %s, expected %d %s", xname, nodeType, resp.StatusCode, body.Code, status, code)
+		}
+	}
+
+	newClient(provisioner.HSMFailClosed)
+
+	authorize("x1000c0s0b0n0", "compute", http.StatusOK, "")
+	authorize("x1000c0s0b0n0", "compute", http.StatusOK, "")
+	authorize("x1000c0s0b0n1", "compute", http.StatusForbidden, provisioner.CodeComponentIneligible)
+	authorize("x1000c0s0b0n2", "compute", http.StatusForbidden, provisioner.CodeComponentIneligible)
+	authorize("x1000c0s0b0n4", "compute", http.StatusForbidden, provisioner.CodeComponentIneligible)
+	authorize("x1000c0s0b0n4", "compute", http.StatusForbidden, provisioner.CodeComponentIneligible)
+	authorize("x1000c0s0b0n3", "compute", http.StatusForbidden, provisioner.CodeNodeTypeMismatch)
+	authorize("x1000c0s0b0n3", "storage", http.StatusOK, "")
+	// Xnames that are not white listed are not looked up.
+	authorize("x1000c0s1b0n0", "compute", http.StatusForbidden, provisioner.CodeNotWhitelisted)
+
+	hsm.mu.Lock()
+	requests := hsm.requests
+	hsm.requests = map[string]int{}
+	hsm.failing = true
+	hsm.mu.Unlock()
+
+	if requests["x1000c0s0b0n0"] != 1 || requests["x1000c0s0b0n4"] != 1 || requests["x1000c0s1b0n0"] != 0 {
+		t.Fatalf("Unexpected hardware state manager requests %v", requests)
+	}
+
+	// Cached components are still checked while the service fails.
+	authorize("x1000c0s0b0n0", "compute", http.StatusOK, "")
+	authorize("x1000c0s0b0n5", "compute", http.StatusServiceUnavailable, provisioner.CodeUnavailable)
+	authorize("x1000c0s0b0n5", "compute", http.StatusServiceUnavailable, provisioner.CodeUnavailable)
+
+	hsm.mu.Lock()
+	if hsm.requests["x1000c0s0b0n5"] != 2 {
+		t.Errorf("Failed lookups were cached: %v", hsm.requests)
+	}
+	hsm.mu.Unlock()
+
+	newClient(provisioner.HSMFailOpen)
+
+	authorize("x1000c0s0b0n5", "compute", http.StatusOK, "")
+
+	if _, err := provisioner.NewHSMClient(provisioner.Config{HSMURL: hsmServer.URL, HSMFailurePolicy: "maybe"}); err == nil {
+		t.Fatalf("Unknown failure policy accepted")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/cray-hpe/tpm-provisioner/tests/simulateTPM"
+)
+
+// TestParseEKInventory validates the EK inventory import formats.
+func TestParseEKInventory(t *testing.T) {
+	fingerprint := strings.Repeat("ab", 32)
+
+	csvInventory := "ek_sha256,xname\n" + strings.Repeat("AB:", 31) + "AB,x1000c0s0b0n0\n" + strings.Repeat("cd", 32) + "\n"
+
+	entries, err := provisioner.ParseEKInventory(provisioner.InventoryFormatCSV, strings.NewReader(csvInventory))
+	if err != nil {
+		t.Fatalf("Unable to parse CSV inventory: %v", err)
+	}
+
+	if len(entries) != 2 || entries[0].EKFingerprint != fingerprint || entries[0].Xname != "x1000c0s0b0n0" || entries[1].Xname != "" {
+		t.Fatalf("Unexpected CSV inventory: %+v", entries)
+	}
+
+	_, err = provisioner.ParseEKInventory(provisioner.InventoryFormatCSV, strings.NewReader("header\nnot-hex\n"))
+	if err == nil {
+		t.Fatalf("Invalid fingerprint accepted")
+	}
+
+	_, _, caPEM, err := simulateTPM.GenerateCA("EK")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = provisioner.ParseEKInventory(provisioner.InventoryFormatPEM, bytes.NewReader(caPEM.Bytes()))
+	if err != nil {
+		t.Fatalf("Unable to parse PEM inventory: %v", err)
+	}
+
+	if len(entries) != 1 || len(entries[0].EKFingerprint) != 64 || entries[0].Serial == "" {
+		t.Fatalf("Unexpected PEM inventory: %+v", entries)
+	}
+}
+
+// TestEKInventoryAPI validates the EK inventory import, list and remove apis.
+func TestEKInventoryAPI(t *testing.T) {
+	provisioner.Issued = openTestLedger(t)
+
+	defer func() {
+		provisioner.Issued = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	apiURL := ts.URL + "/apis/tpm-provisioner/inventory"
+	fingerprint := strings.Repeat("ab", 32)
+
+	body := `[{"ekFingerprint":"` + fingerprint + `","xname":"x1000c0s0b0n0"},{"ekFingerprint":"` + strings.Repeat("cd", 32) + `"}]`
+
+	resp, err := http.Post(apiURL+"/import", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var imported provisioner.ImportInventoryResponse
+
+	err = json.NewDecoder(resp.Body).Decode(&imported)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !imported.Success || imported.Imported != 2 {
+		t.Fatalf("Unexpected import response: %+v", imported)
+	}
+
+	resp, err = http.PostForm(apiURL+"/remove", url.Values{"ek": {fingerprint}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	resp, err = http.Get(apiURL + "/get")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []provisioner.EKInventoryEntry
+
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].EKFingerprint != strings.Repeat("cd", 32) {
+		t.Fatalf("Unexpected inventory: %+v", entries)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// signJWTSVID returns an ES256 signed JWT-SVID.
+func signJWTSVID(t *testing.T, key *ecdsa.PrivateKey, sub string, aud string) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": "test", "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"sub": sub,
+		"aud": []string{aud},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newJWTAuthenticator returns a JWT authenticator trusting key.
+func newJWTAuthenticator(t *testing.T, key *ecdsa.PrivateKey, mode string) *provisioner.JWTAuthenticator {
+	t.Helper()
+
+	td := spiffeid.RequireTrustDomainFromString("shasta")
+
+	bundle := jwtbundle.FromJWTAuthorities(td, map[string]crypto.PublicKey{"test": key.Public()})
+
+	data, err := bundle.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundleFile := filepath.Join(t.TempDir(), "bundle.jwks")
+
+	err = os.WriteFile(bundleFile, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := provisioner.NewJWTAuthenticator(provisioner.Config{
+		JWTMode:        mode,
+		JWTTrustDomain: "shasta",
+		JWTBundle:      bundleFile,
+		JWTAudience:    "system-compute",
+		JWTIDTemplate:  "/{type}/{xname}",
+	})
+	if err != nil {
+		t.Fatalf("Unable to create JWT authenticator: %v", err)
+	}
+
+	return auth
+}
+
+// authorizeWithJWT sends an authorize request with an optional bearer token.
+func authorizeWithJWT(t *testing.T, xname string, jwt string) provisioner.AuthorizeResponse {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "/api/authorize?xname="+xname+"&type=compute", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if jwt != "" {
+		req.Header.Set("Authorization", "Bearer "+jwt)
+	}
+
+	http.HandlerFunc(provisioner.Authorize).ServeHTTP(rr, req)
+
+	var resp provisioner.AuthorizeResponse
+
+	err = json.NewDecoder(rr.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// TestAuthorizeJWTRequired validates that authorize enforces JWT-SVIDs when
+// they are required.
+func TestAuthorizeJWTRequired(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.JWTAuth = newJWTAuthenticator(t, key, provisioner.JWTModeRequired)
+
+	defer func() {
+		provisioner.JWTAuth = nil
+	}()
+
+	provisioner.WhiteList = append(provisioner.WhiteList, provisioner.WhiteListEntry{Pattern: "x3000c0s1b0n0"})
+
+	if resp := authorizeWithJWT(t, "x3000c0s1b0n0", ""); resp.Success || resp.Reason != "missing JWT-SVID" {
+		t.Fatalf("Expected missing JWT-SVID failure, received: %+v", resp)
+	}
+
+	valid := signJWTSVID(t, key, "spiffe://shasta/compute/x3000c0s1b0n0", "system-compute")
+	if resp := authorizeWithJWT(t, "x3000c0s1b0n0", valid); !resp.Success {
+		t.Fatalf("Received Failure Reason: %v", resp.Reason)
+	}
+
+	otherNode := signJWTSVID(t, key, "spiffe://shasta/compute/x3000c0s2b0n0", "system-compute")
+	if resp := authorizeWithJWT(t, "x3000c0s1b0n0", otherNode); resp.Success {
+		t.Fatalf("JWT-SVID for another xname was accepted")
+	}
+
+	wrongAudience := signJWTSVID(t, key, "spiffe://shasta/compute/x3000c0s1b0n0", "system-ncn")
+	if resp := authorizeWithJWT(t, "x3000c0s1b0n0", wrongAudience); resp.Success {
+		t.Fatalf("JWT-SVID for another audience was accepted")
+	}
+
+	untrustedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	untrusted := signJWTSVID(t, untrustedKey, "spiffe://shasta/compute/x3000c0s1b0n0", "system-compute")
+	if resp := authorizeWithJWT(t, "x3000c0s1b0n0", untrusted); resp.Success {
+		t.Fatalf("JWT-SVID signed by an untrusted key was accepted")
+	}
+}
+
+// TestAuthorizeJWTOptional validates that authorize accepts requests without a
+// JWT-SVID when they are optional.
+func TestAuthorizeJWTOptional(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.JWTAuth = newJWTAuthenticator(t, key, provisioner.JWTModeOptional)
+
+	defer func() {
+		provisioner.JWTAuth = nil
+	}()
+
+	provisioner.WhiteList = append(provisioner.WhiteList, provisioner.WhiteListEntry{Pattern: "x3000c0s1b0n0"})
+
+	if resp := authorizeWithJWT(t, "x3000c0s1b0n0", ""); !resp.Success {
+		t.Fatalf("Received Failure Reason: %v", resp.Reason)
+	}
+
+	if resp := authorizeWithJWT(t, "x3000c0s1b0n0", "not-a-jwt"); resp.Success {
+		t.Fatalf("Invalid JWT-SVID was accepted")
+	}
+}
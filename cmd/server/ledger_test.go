@@ -0,0 +1,137 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// openTestLedger opens an issuance ledger in a temporary directory.
+func openTestLedger(t *testing.T) *provisioner.Ledger {
+	t.Helper()
+
+	ledger, err := provisioner.OpenLedger(filepath.Join(t.TempDir(), "issued.db"))
+	if err != nil {
+		t.Fatalf("Unable to open ledger: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := ledger.Close(); err != nil {
+			t.Errorf("Unable to close ledger: %v", err)
+		}
+	})
+
+	return ledger
+}
+
+// TestLedgerQueries validates that issued certificates can be looked up by
+// xname, serial and EK.
+func TestLedgerQueries(t *testing.T) {
+	ledger := openTestLedger(t)
+
+	recs := []provisioner.IssuedCertificate{
+		{Serial: "01", Kind: provisioner.KindDevID, Xname: "x1000c0s0b0n0", EKFingerprint: "aa", NotAfter: time.Now()},
+		{Serial: "02", Kind: provisioner.KindAttestation, Xname: "x1000c0s0b0n0", EKFingerprint: "aa"},
+		{Serial: "03", Kind: provisioner.KindDevID, Xname: "x1000c0s0b0n01", EKFingerprint: "bb"},
+	}
+
+	for _, rec := range recs {
+		if err := ledger.Record(rec); err != nil {
+			t.Fatalf("Unable to record %s: %v", rec.Serial, err)
+		}
+	}
+
+	byXname, err := ledger.ByXname("x1000c0s0b0n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(byXname) != 2 {
+		t.Fatalf("Expected 2 certificates for x1000c0s0b0n0, found %d", len(byXname))
+	}
+
+	byEK, err := ledger.ByEK("bb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(byEK) != 1 || byEK[0].Serial != "03" {
+		t.Fatalf("Unexpected certificates for EK bb: %+v", byEK)
+	}
+
+	rec, err := ledger.BySerial("02")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Kind != provisioner.KindAttestation {
+		t.Fatalf("Unexpected kind: %s", rec.Kind)
+	}
+
+	provisioner.Issued = ledger
+
+	defer func() {
+		provisioner.Issued = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/apis/tpm-provisioner/issued/xname/x1000c0s0b0n01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	var listed []provisioner.IssuedCertificate
+
+	if err = json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || len(listed) != 1 || listed[0].Serial != "03" {
+		t.Fatalf("Unexpected response %d: %+v", resp.StatusCode, listed)
+	}
+
+	resp, err = http.Get(ts.URL + "/apis/tpm-provisioner/issued/serial/ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected %d, received %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
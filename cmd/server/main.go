@@ -27,15 +27,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/cray-hpe/tpm-provisioner/pkg/casigner"
 	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func requestLoggerMiddleware(r *mux.Router) mux.MiddlewareFunc {
@@ -57,6 +67,42 @@ func requestLoggerMiddleware(r *mux.Router) mux.MiddlewareFunc {
 	}
 }
 
+// grpcServerOptions returns the gRPC server options of cfg. The Enrollment
+// service is served with the TLS certificate of the server when configured.
+func grpcServerOptions(cfg provisioner.Config) ([]grpc.ServerOption, error) {
+	if cfg.TLSCert == "" {
+		log.Printf("No TLS certificate configured, serving plaintext gRPC")
+		return nil, nil
+	}
+
+	creds, err := credentials.NewServerTLSFromFile(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return []grpc.ServerOption{grpc.Creds(creds)}, nil
+}
+
+// serveGRPC serves the gRPC Enrollment service on port.
+func serveGRPC(port int) {
+	opts, err := grpcServerOptions(provisioner.CFG)
+	if err != nil {
+		log.Fatalf("Unable to configure gRPC TLS: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatalf("Unable to listen for gRPC: %v", err)
+	}
+
+	log.Printf("gRPC Enrollment service listening on %s", lis.Addr())
+
+	err = provisioner.NewGRPCServer(opts...).Serve(lis)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func main() {
 	log.Printf("Server started")
 
@@ -82,11 +128,66 @@ func main() {
 		log.Fatalf("Unable to parse config: %v", err)
 	}
 
+	var caKey io.Closer
+
+	provisioner.CFG.ProviderKey, caKey, err = casigner.New(provisioner.CFG)
+	if err != nil {
+		log.Fatalf("Unable to open platform CA key: %v", err)
+	}
+
+	provisioner.Profiles, err = provisioner.NewProfiles(provisioner.CFG)
+	if err != nil {
+		log.Fatalf("Unable to configure certificate profiles: %v", err)
+	}
+
 	err = provisioner.LoadWhiteList(provisioner.CFG.WhiteList)
 	if err != nil {
 		log.Fatalf("Unable to load whitelist: %v", err)
 	}
 
+	sessions, err := provisioner.NewSessionStore(provisioner.CFG)
+	if err != nil {
+		log.Fatalf("Unable to create session store: %v", err)
+	}
+
+	provisioner.Sessions = sessions
+
+	provisioner.JWTAuth, err = provisioner.NewJWTAuthenticator(provisioner.CFG)
+	if err != nil {
+		log.Fatalf("Unable to configure JWT-SVID authentication: %v", err)
+	}
+
+	if provisioner.CFG.Ledger != "" {
+		provisioner.Issued, err = provisioner.OpenLedger(provisioner.CFG.Ledger)
+		if err != nil {
+			log.Fatalf("Unable to open issuance ledger: %v", err)
+		}
+	}
+
+	if provisioner.CFG.AuditLog != "" {
+		provisioner.Audit, err = provisioner.OpenAuditLog(provisioner.CFG.AuditLog)
+		if err != nil {
+			log.Fatalf("Unable to open audit log: %v", err)
+		}
+	}
+
+	provisioner.Limiter = provisioner.NewRateLimiter(provisioner.CFG)
+
+	provisioner.NodeTypes, err = provisioner.NewNodeTypeMapper(provisioner.CFG)
+	if err != nil {
+		log.Fatalf("Unable to configure node types: %v", err)
+	}
+
+	provisioner.HSM, err = provisioner.NewHSMClient(provisioner.CFG)
+	if err != nil {
+		log.Fatalf("Unable to configure the hardware state manager client: %v", err)
+	}
+
+	provisioner.AdminAuth, err = provisioner.NewAdminAuthenticator(provisioner.CFG)
+	if err != nil {
+		log.Fatalf("Unable to configure admin authentication: %v", err)
+	}
+
 	router := provisioner.NewRouter()
 	address := fmt.Sprintf(":%d", provisioner.CFG.Port)
 
@@ -99,10 +200,57 @@ func main() {
 		WriteTimeout:      10 * time.Second,
 	}
 
-	go provisioner.CleanSessions()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	err = srv.ListenAndServe()
-	if err != nil {
+	go func() {
+		<-ctx.Done()
+
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdown); err != nil {
+			log.Printf("Unable to shut down: %v", err)
+		}
+	}()
+
+	go provisioner.CleanSessions(context.Background(), sessions, provisioner.CFG.SessionTTL)
+
+	go func() {
+		err := provisioner.WatchWhiteList(context.Background(), provisioner.CFG.WhiteList)
+		if err != nil {
+			log.Printf("Unable to watch whitelist for changes: %v", err)
+		}
+	}()
+
+	if provisioner.Issued != nil {
+		go provisioner.PublishCRL(context.Background(), provisioner.CFG.CRLInterval)
+	}
+
+	if provisioner.CFG.GRPCPort != 0 {
+		go serveGRPC(provisioner.CFG.GRPCPort)
+	}
+
+	if provisioner.CFG.TLSCert != "" {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+		if provisioner.CFG.AdminClientCAs != nil {
+			srv.TLSConfig.ClientCAs = provisioner.CFG.AdminClientCAs
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+
+		err = srv.ListenAndServeTLS(provisioner.CFG.TLSCert, provisioner.CFG.TLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
+
+	if err = caKey.Close(); err != nil {
+		log.Printf("Unable to close platform CA key: %v", err)
+	}
+
+	log.Printf("Server stopped")
 }
@@ -0,0 +1,101 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// TestMetrics validates that enrollment steps, verification failures and the
+// white list size are exposed on the metrics endpoint.
+func TestMetrics(t *testing.T) {
+	provisioner.WhiteList = []provisioner.WhiteListEntry{{Pattern: "x1000c0s0b0n0"}, {Pattern: "x1000c0s0b0n1"}}
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	defer func() {
+		provisioner.WhiteList = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	apiURL := ts.URL + "/apis/tpm-provisioner"
+
+	resp, err := http.Get(apiURL + "/authorize?type=compute&xname=x1000c0s0b0n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	req, err := http.NewRequest("POST", apiURL+"/challenge/request", strings.NewReader(`{"data": "not base64", "sig": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range resp.Cookies() {
+		req.AddCookie(c)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, metric := range []string{
+		`tpm_provisioner_enrollment_steps_total{outcome="success",step="authorize"}`,
+		`tpm_provisioner_enrollment_steps_total{outcome="failure",step="challenge_request"}`,
+		`tpm_provisioner_enrollment_step_duration_seconds_count{outcome="success",step="authorize"}`,
+		`tpm_provisioner_verification_failures_total{stage="decode"}`,
+		`tpm_provisioner_whitelist_entries 2`,
+		`tpm_provisioner_active_sessions 1`,
+	} {
+		if !strings.Contains(string(body), metric) {
+			t.Errorf("Metric %s not found", metric)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// TestNodeTypes validates that node types are derived from the node type
+// rules and the white list, and that sessions claiming another node type are
+// rejected.
+func TestNodeTypes(t *testing.T) {
+	provisioner.WhiteList = []provisioner.WhiteListEntry{
+		{Pattern: "x3000c0s*b0n0", Type: provisioner.WhiteListTypeXname},
+		{Pattern: "x1000c0s0b0n[0-1]"},
+		{Pattern: "x5000c0s0b0n0", NodeTypes: []string{"storage"}},
+		{Pattern: "x6000c0s0b0n0"},
+	}
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	rules := []provisioner.NodeTypeRule{
+		{Xname: "x3000c0s[1-9]b0n0", Type: "ncn"},
+		{Xname: "x1000c*s*b*n*", Type: "compute"},
+	}
+
+	defer func() {
+		provisioner.WhiteList = nil
+		provisioner.NodeTypes = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		mode     string
+		xname    string
+		claimed  string
+		status   int
+		code     provisioner.ErrorCode
+		nodeType string
+	}{
+		{provisioner.NodeTypeModeVerify, "x3000c0s1b0n0", "ncn", http.StatusOK, "", "ncn"},
+		{provisioner.NodeTypeModeVerify, "x3000c0s1b0n0", "compute", http.StatusForbidden, provisioner.CodeNodeTypeMismatch, ""},
+		{provisioner.NodeTypeModeVerify, "x1000c0s0b0n0", "ncn", http.StatusForbidden, provisioner.CodeNodeTypeMismatch, ""},
+		{provisioner.NodeTypeModeVerify, "x1000c0s0b0n1", "", http.StatusOK, "", "compute"},
+		{provisioner.NodeTypeModeVerify, "x5000c0s0b0n0", "compute", http.StatusForbidden, provisioner.CodeNodeTypeMismatch, ""},
+		{provisioner.NodeTypeModeVerify, "x5000c0s0b0n0", "", http.StatusOK, "", "storage"},
+		{provisioner.NodeTypeModeVerify, "x6000c0s0b0n0", "compute", http.StatusOK, "", "compute"},
+		{provisioner.NodeTypeModeVerify, "x6000c0s0b0n0", "", http.StatusBadRequest, provisioner.CodeBadRequest, ""},
+		{provisioner.NodeTypeModeRequired, "x6000c0s0b0n0", "compute", http.StatusForbidden, provisioner.CodeNotWhitelisted, ""},
+		{provisioner.NodeTypeModeRequired, "x3000c0s2b0n0", "ncn", http.StatusOK, "", "ncn"},
+		{provisioner.NodeTypeModeOff, "x3000c0s1b0n0", "compute", http.StatusOK, "", "compute"},
+	} {
+		mapper, err := provisioner.NewNodeTypeMapper(provisioner.Config{NodeTypeMode: tt.mode, NodeTypeRules: rules})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		provisioner.NodeTypes = mapper
+
+		resp, err := http.Get(ts.URL + "/apis/tpm-provisioner/authorize?type=" + tt.claimed + "&xname=" + tt.xname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var body provisioner.ErrorResponse
+
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != tt.status || body.Code != tt.code {
+			t.Errorf("%s: authorizing %s as %q returned %d %s, expected %d %s", tt.mode, tt.xname, tt.claimed, resp.StatusCode, body.Code, tt.status, tt.code)
+			continue
+		}
+
+		for _, c := range resp.Cookies() {
+			if c.Name != "session" {
+				continue
+			}
+
+			session, err := provisioner.Sessions.Get(c.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if session.NodeType() != tt.nodeType {
+				t.Errorf("%s: session of %s has node type %s, expected %s", tt.mode, tt.xname, session.NodeType(), tt.nodeType)
+			}
+		}
+	}
+
+	for _, cfg := range []provisioner.Config{
+		{NodeTypeMode: "trust"},
+		{NodeTypeRules: []provisioner.NodeTypeRule{{Xname: "x1000c0s0b0n0"}}},
+		{NodeTypeRules: []provisioner.NodeTypeRule{{Xname: "x1000c0s0b0n.*", Type: "compute"}}},
+		{NodeTypeRules: []provisioner.NodeTypeRule{{Xname: "x1000c0", Type: "compute"}}},
+	} {
+		if _, err := provisioner.NewNodeTypeMapper(cfg); err == nil {
+			t.Errorf("Invalid node type config %+v accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/cray-hpe/tpm-provisioner/tests/simulateTPM"
+	"golang.org/x/crypto/ocsp"
+)
+
+var oidOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+// ocspRequestWithNonce adds a nonce extension to an OCSP request.
+func ocspRequestWithNonce(t *testing.T, der []byte, nonce []byte) []byte {
+	t.Helper()
+
+	var req struct {
+		TBSRequest struct {
+			RequestList []asn1.RawValue
+			Extensions  []pkix.Extension `asn1:"explicit,tag:2,optional"`
+		}
+	}
+
+	if _, err := asn1.Unmarshal(der, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := asn1.Marshal(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.TBSRequest.Extensions = []pkix.Extension{{Id: oidOCSPNonce, Value: value}}
+
+	der, err = asn1.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+// postOCSP sends an OCSP request to the responder.
+func postOCSP(t *testing.T, responder string, der []byte) []byte {
+	t.Helper()
+
+	resp, err := http.Post(responder, "application/ocsp-request", bytes.NewReader(der))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+// TestOCSP validates the good, revoked and unknown OCSP answers, nonces and
+// delegated responders.
+func TestOCSP(t *testing.T) {
+	pCA, pPrivKey, _, err := simulateTPM.GenerateCA("Provisioner CA")
+	if err != nil {
+		t.Fatalf("Unable to provision CA: %v", err)
+	}
+
+	provisioner.CFG = provisioner.Config{
+		ProviderCA:  pCA,
+		ProviderKey: pPrivKey,
+	}
+
+	provisioner.Issued = openTestLedger(t)
+
+	defer func() {
+		provisioner.Issued = nil
+	}()
+
+	for _, serial := range []string{"0a", "0b"} {
+		err = provisioner.Issued.Record(provisioner.IssuedCertificate{Serial: serial, Xname: "x1000c0s0b0n0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	responder := ts.URL + "/apis/tpm-provisioner/ocsp"
+
+	request := func(serial int64) []byte {
+		der, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: big.NewInt(serial)}, pCA, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return der
+	}
+
+	for serial, expected := range map[int64]int{0x0a: ocsp.Good, 0x0c: ocsp.Unknown} {
+		resp, err := ocsp.ParseResponse(postOCSP(t, responder, request(serial)), pCA)
+		if err != nil {
+			t.Fatalf("Unable to parse OCSP response for %x: %v", serial, err)
+		}
+
+		if resp.Status != expected {
+			t.Fatalf("Expected status %d for %x, received %d", expected, serial, resp.Status)
+		}
+	}
+
+	// GET requests are URL encoded base64, which may contain / and +, sent
+	// with or without escaping them.
+	var get string
+
+	for !strings.Contains(get, "//") || !strings.Contains(get, "+") {
+		serial, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		get = base64.StdEncoding.EncodeToString(request(serial.Int64()))
+	}
+
+	for _, path := range []string{get, url.QueryEscape(get)} {
+		for _, prefix := range []string{"/apis/tpm-provisioner/ocsp/", "/apis/tpm-provisioner/v2/ocsp/"} {
+			resp, err := http.Get(ts.URL + prefix + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ocspResp, err := ocsp.ParseResponse(body, pCA)
+			if err != nil || ocspResp.Status != ocsp.Unknown {
+				t.Fatalf("Unexpected OCSP response to GET %s%s: %v", prefix, path, err)
+			}
+		}
+	}
+
+	// Responses to requests without a nonce are cached until revocation.
+	first := postOCSP(t, responder, request(0x0b))
+
+	if !bytes.Equal(first, postOCSP(t, responder, request(0x0b))) {
+		t.Fatalf("OCSP response was not cached")
+	}
+
+	resp, err := http.PostForm(ts.URL+"/apis/tpm-provisioner/revoke", url.Values{"serial": {"0b"}, "reason": {"superseded"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	nonce := []byte("0123456789abcdef")
+
+	ocspResp, err := ocsp.ParseResponse(postOCSP(t, responder, ocspRequestWithNonce(t, request(0x0b), nonce)), pCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ocspResp.Status != ocsp.Revoked || ocspResp.RevocationReason != ocsp.Superseded {
+		t.Fatalf("Unexpected revocation status %d reason %d", ocspResp.Status, ocspResp.RevocationReason)
+	}
+
+	var echoed []byte
+
+	for _, ext := range ocspResp.Extensions {
+		if ext.Id.Equal(oidOCSPNonce) {
+			if _, err = asn1.Unmarshal(ext.Value, &echoed); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if !bytes.Equal(echoed, nonce) {
+		t.Fatalf("Nonce not echoed, received %x", echoed)
+	}
+
+	// A delegated responder signs the responses with its own key.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "OCSP Responder"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}, pCA, &key.PublicKey, pPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.CFG.OCSPResponderCert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = provisioner.CheckOCSPResponder(pCA, provisioner.CFG.OCSPResponderCert); err != nil {
+		t.Fatalf("Delegated responder certificate rejected: %v", err)
+	}
+
+	provisioner.CFG.OCSPResponderKey = key
+
+	ocspResp, err = ocsp.ParseResponse(postOCSP(t, responder, ocspRequestWithNonce(t, request(0x0a), nonce)), pCA)
+	if err != nil {
+		t.Fatalf("Unable to verify delegated OCSP response: %v", err)
+	}
+
+	if ocspResp.Certificate == nil || !ocspResp.Certificate.Equal(provisioner.CFG.OCSPResponderCert) {
+		t.Fatalf("Delegated responder certificate missing from the response")
+	}
+
+	// Responder certificates without the OCSP signing EKU or from another CA
+	// are rejected.
+	der, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "OCSP Responder"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, pCA, &key.PublicKey, pPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noEKU, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = provisioner.CheckOCSPResponder(pCA, noEKU); err == nil {
+		t.Errorf("Responder certificate without the OCSP signing EKU accepted")
+	}
+
+	otherCA, _, _, err := simulateTPM.GenerateCA("Other CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = provisioner.CheckOCSPResponder(otherCA, provisioner.CFG.OCSPResponderCert); err == nil {
+		t.Errorf("Responder certificate of another CA accepted")
+	}
+}
@@ -0,0 +1,318 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/client"
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/cray-hpe/tpm-provisioner/tests/simulateTPM"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// TestCertProfiles validates that issued certificates are driven by the
+// certificate profile selected by the white list or the node type.
+func TestCertProfiles(t *testing.T) {
+	pCA, pPrivKey, _, err := simulateTPM.GenerateCA("Provisioner CA")
+	if err != nil {
+		t.Fatalf("Unable to provision CA: %v", err)
+	}
+
+	spireTokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer spireTokens.Close()
+
+	provisioner.CFG = provisioner.Config{
+		ProviderCA:     pCA,
+		ProviderKey:    pPrivKey,
+		SpireTokensURL: spireTokens.URL,
+		CRLURL:         "http://tpm-provisioner/crl",
+		// SPIFFEIDTemplate is overridden by the mtls profile.
+		SPIFFEIDTemplate: "spiffe://shasta/{type}/{xname}",
+		CertProfiles: map[string]provisioner.CertProfile{
+			"Compute": {
+				NodeTypes: []string{"compute"},
+				Validity:  24 * time.Hour,
+				Subject:   "CN={type}/{xname},O=HPE",
+				DNSNames:  []string{"{xname}.nmn"},
+			},
+			"mtls": {
+				Validity:    time.Hour,
+				KeyUsage:    []string{"digitalSignature", "keyEncipherment"},
+				ExtKeyUsage: []string{"devid", "clientAuth"},
+				CRLURL:      "http://mtls/crl",
+				IssuerURL:   "http://mtls/ca.crt",
+				SPIFFEID:    "spiffe://shasta/mtls/{xname}",
+				SubjectMode: provisioner.SubjectModeClient,
+			},
+			"ca": {
+				CA:         true,
+				MaxPathLen: new(int),
+			},
+		},
+	}
+
+	provisioner.Profiles, err = provisioner.NewProfiles(provisioner.CFG)
+	if err != nil {
+		t.Fatalf("Unable to configure certificate profiles: %v", err)
+	}
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{
+		{Pattern: "x1000c0s0b0n0"},
+		{Pattern: "x3000c0s1b0n0", Profile: "mtls"},
+		{Pattern: "x3000c0s2b0n0", Profile: "ca"},
+	}
+
+	defer func() {
+		provisioner.Profiles = nil
+		provisioner.WhiteList = nil
+	}()
+
+	conn := dialTestEnrollment(t)
+
+	enroll := func(xname string, nodeType string) *x509.Certificate {
+		t.Helper()
+
+		cert, err := enrollWithNewTPM(t, conn, xname, nodeType, pkix.Name{CommonName: "self-asserted"})
+		if err != nil {
+			t.Fatalf("Enrollment of %s failed: %v", xname, err)
+		}
+
+		return cert
+	}
+
+	cert := enroll("x1000c0s0b0n0", "compute")
+
+	if validity := cert.NotAfter.Sub(cert.NotBefore); validity != 24*time.Hour {
+		t.Errorf("Compute DevID is valid for %s, expected 24h", validity)
+	}
+
+	if cert.Subject.CommonName != "compute/x1000c0s0b0n0" || len(cert.Subject.Organization) != 1 || cert.Subject.Organization[0] != "HPE" {
+		t.Errorf("Unexpected compute DevID subject: %s", cert.Subject)
+	}
+
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "x1000c0s0b0n0.nmn" {
+		t.Errorf("Unexpected compute DevID DNS names: %v", cert.DNSNames)
+	}
+
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != "spiffe://shasta/compute/x1000c0s0b0n0" {
+		t.Errorf("Unexpected compute DevID URIs: %v", cert.URIs)
+	}
+
+	// The SPIFFE ID is added to the SAN extension with the TCG names.
+	var sans []asn1.RawValue
+
+	if _, err = asn1.Unmarshal(subjectAltName(cert), &sans); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sans) != 4 {
+		t.Errorf("Compute DevID has %d SANs, expected 4", len(sans))
+	}
+
+	if len(cert.CRLDistributionPoints) != 1 || cert.CRLDistributionPoints[0] != "http://tpm-provisioner/crl" {
+		t.Errorf("Unexpected compute DevID CRL distribution points: %v", cert.CRLDistributionPoints)
+	}
+
+	cert = enroll("x3000c0s1b0n0", "ncn")
+
+	if validity := cert.NotAfter.Sub(cert.NotBefore); validity != time.Hour {
+		t.Errorf("mtls DevID is valid for %s, expected 1h", validity)
+	}
+
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != "spiffe://shasta/mtls/x3000c0s1b0n0" {
+		t.Errorf("Unexpected mtls DevID URIs: %v", cert.URIs)
+	}
+
+	if cert.Subject.CommonName != "self-asserted" {
+		t.Errorf("Unexpected mtls DevID subject: %s", cert.Subject)
+	}
+
+	if cert.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		t.Errorf("Unexpected mtls DevID key usage: %v", cert.KeyUsage)
+	}
+
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth ||
+		len(cert.UnknownExtKeyUsage) != 1 || !cert.UnknownExtKeyUsage[0].Equal(asn1.ObjectIdentifier{2, 23, 133, 11, 1, 2}) {
+		t.Errorf("Unexpected mtls DevID extended key usage: %v %v", cert.ExtKeyUsage, cert.UnknownExtKeyUsage)
+	}
+
+	if len(cert.CRLDistributionPoints) != 1 || cert.CRLDistributionPoints[0] != "http://mtls/crl" {
+		t.Errorf("Unexpected mtls DevID CRL distribution points: %v", cert.CRLDistributionPoints)
+	}
+
+	if len(cert.IssuingCertificateURL) != 1 || cert.IssuingCertificateURL[0] != "http://mtls/ca.crt" {
+		t.Errorf("Unexpected mtls DevID issuer URLs: %v", cert.IssuingCertificateURL)
+	}
+
+	if cert.IsCA {
+		t.Errorf("mtls DevID is a CA")
+	}
+
+	cert = enroll("x3000c0s2b0n0", "ncn")
+
+	if !cert.IsCA || cert.MaxPathLen != 0 || !cert.MaxPathLenZero || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		t.Errorf("Unexpected ca DevID basic constraints: CA %v, path length %d, key usage %v", cert.IsCA, cert.MaxPathLen, cert.KeyUsage)
+	}
+
+	pathLen, negative := 1, -1
+
+	for _, profiles := range []map[string]provisioner.CertProfile{
+		{"leaf": {MaxPathLen: &pathLen}},
+		{"negative": {CA: true, MaxPathLen: &negative}},
+		{"short": {Validity: -time.Hour}},
+		{"usage": {KeyUsage: []string{"certSign"}}},
+		{"eku": {ExtKeyUsage: []string{"codeSigning"}}},
+		{"subject": {Subject: "CN={xname},EMAIL=root"}},
+		{"spiffe": {SPIFFEID: "https://shasta/{xname}"}},
+		{"svid": {SPIFFEID: "spiffe://shasta/{xname}", URIs: []string{"https://shasta/{xname}"}}},
+		{"mode": {SubjectMode: "trust"}},
+		{"a": {NodeTypes: []string{"compute"}}, "b": {NodeTypes: []string{"compute"}}},
+	} {
+		if _, err := provisioner.NewProfiles(provisioner.Config{CertProfiles: profiles}); err == nil {
+			t.Errorf("Invalid certificate profiles %+v accepted", profiles)
+		}
+	}
+
+	// Profiles inheriting the server SPIFFE ID template can not add URIs.
+	_, err = provisioner.NewProfiles(provisioner.Config{
+		SPIFFEIDTemplate: "spiffe://shasta/{type}/{xname}",
+		CertProfiles:     map[string]provisioner.CertProfile{"uris": {URIs: []string{"https://shasta/{xname}"}}},
+	})
+	if err == nil {
+		t.Errorf("Certificate profile with URIs and the server SPIFFE ID template accepted")
+	}
+
+	// Without a SPIFFE ID the profile URIs are added.
+	provisioner.Profiles, err = provisioner.NewProfiles(provisioner.Config{
+		CertProfiles: map[string]provisioner.CertProfile{"compute": {NodeTypes: []string{"compute"}, URIs: []string{"https://shasta/{xname}"}}},
+	})
+	if err != nil {
+		t.Fatalf("Unable to configure certificate profiles: %v", err)
+	}
+
+	cert = enroll("x1000c0s0b0n0", "compute")
+
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != "https://shasta/x1000c0s0b0n0" {
+		t.Errorf("Unexpected compute DevID URIs without a SPIFFE ID: %v", cert.URIs)
+	}
+
+	err = provisioner.AddWhiteListItem(t.TempDir()+"/whitelist.tpm", provisioner.WhiteListEntry{Pattern: "x1000c0s1b0n0", Profile: "missing"})
+	if err == nil {
+		t.Errorf("White list entry with an unknown certificate profile accepted")
+	}
+}
+
+// dialTestEnrollment serves the gRPC Enrollment service on an in memory
+// listener and returns a connection to it.
+func dialTestEnrollment(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+
+	lis := bufconn.Listen(1024 * 1024)
+
+	srv := provisioner.NewGRPCServer()
+
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			t.Errorf("gRPC server failed: %v", err)
+		}
+	}()
+
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Unable to dial gRPC server: %v", err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return conn
+}
+
+// openTrustedTPM opens a new simulated TPM whose EK is trusted by the server.
+// Only one simulator may be open at a time.
+func openTrustedTPM(t *testing.T) io.ReadWriteCloser {
+	t.Helper()
+
+	rw := openTPM(t)
+
+	caCRT, err := simulateTPM.CreateEK(rw)
+	if err != nil {
+		t.Fatalf("Unable to provision EK: %v", err)
+	}
+
+	provisioner.CFG.ManufactuerCAs = x509.NewCertPool()
+
+	if !provisioner.CFG.ManufactuerCAs.AppendCertsFromPEM(caCRT) {
+		t.Fatalf("Unable to Add CA to cert pool")
+	}
+
+	return rw
+}
+
+// enrollWithNewTPM enrolls xname as nodeType over conn, requesting the subject
+// pi, with a new trusted simulated TPM. It returns the DevID certificate.
+func enrollWithNewTPM(t *testing.T, conn *grpc.ClientConn, xname string, nodeType string, pi pkix.Name) (*x509.Certificate, error) {
+	t.Helper()
+
+	rw := openTrustedTPM(t)
+
+	defer func() {
+		if err := rw.Close(); err != nil {
+			t.Errorf("Unable to close simulator: %v", err)
+		}
+	}()
+
+	devID, _, _, err := client.Enroll(context.Background(), conn, rw, xname, nodeType, pi, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(devID)
+}
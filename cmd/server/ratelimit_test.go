@@ -0,0 +1,144 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// TestRateLimit validates the per source and per xname rate limits and the
+// lockout after failed challenge responses.
+func TestRateLimit(t *testing.T) {
+	provisioner.WhiteList = []provisioner.WhiteListEntry{{Pattern: "x1000c0s0b0n[0-9]"}}
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	defer func() {
+		provisioner.WhiteList = nil
+		provisioner.Limiter = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	apiURL := ts.URL + "/apis/tpm-provisioner"
+
+	get := func(path string, status int) {
+		t.Helper()
+
+		resp, err := http.Get(apiURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Fatalf("GET %s returned %d, expected %d", path, resp.StatusCode, status)
+		}
+
+		if status != http.StatusTooManyRequests {
+			return
+		}
+
+		retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || retryAfter <= 0 {
+			t.Fatalf("GET %s returned an invalid Retry-After %q", path, resp.Header.Get("Retry-After"))
+		}
+
+		var body provisioner.ErrorResponse
+
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		if err != nil || body.Code != provisioner.CodeRateLimited {
+			t.Fatalf("GET %s returned %+v: %v", path, body, err)
+		}
+	}
+
+	provisioner.Limiter = provisioner.NewRateLimiter(provisioner.Config{SourceRateLimit: 0.01, SourceRateBurst: 2})
+
+	get("/whitelist/get", http.StatusOK)
+	get("/whitelist/get", http.StatusOK)
+	get("/whitelist/get", http.StatusTooManyRequests)
+
+	// Behind a proxy the client can not pick a new source with a spoofed
+	// leading X-Forwarded-For entry.
+	provisioner.Limiter = provisioner.NewRateLimiter(provisioner.Config{
+		SourceRateLimit:       0.01,
+		SourceRateBurst:       1,
+		RateLimitForwardedFor: true,
+	})
+
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req, err := http.NewRequest(http.MethodGet, apiURL+"/whitelist/get", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("X-Forwarded-For", "192.0.2."+strconv.Itoa(i)+", 198.51.100.7")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Fatalf("Spoofed X-Forwarded-For request %d returned %d, expected %d", i, resp.StatusCode, status)
+		}
+	}
+
+	provisioner.Limiter = provisioner.NewRateLimiter(provisioner.Config{XnameRateLimit: 0.01, XnameRateBurst: 1})
+
+	get("/authorize?type=compute&xname=x1000c0s0b0n0", http.StatusOK)
+	get("/authorize?type=compute&xname=x1000c0s0b0n0", http.StatusTooManyRequests)
+	get("/authorize?type=compute&xname=x1000c0s0b0n1", http.StatusOK)
+	// Only enrollment requests are limited per xname.
+	get("/whitelist/get?xname=x1000c0s0b0n0", http.StatusOK)
+
+	provisioner.Limiter = provisioner.NewRateLimiter(provisioner.Config{LockoutThreshold: 2, LockoutDuration: time.Minute})
+
+	provisioner.Limiter.ChallengeFailed("x1000c0s0b0n0", "aa")
+	get("/authorize?type=compute&xname=x1000c0s0b0n0", http.StatusOK)
+
+	provisioner.Limiter.ChallengeFailed("x1000c0s0b0n0", "aa")
+	get("/authorize?type=compute&xname=x1000c0s0b0n0", http.StatusTooManyRequests)
+	get("/authorize?type=compute&xname=x1000c0s0b0n1", http.StatusOK)
+
+	if err := provisioner.Limiter.AllowEK("aa"); err == nil {
+		t.Fatalf("Locked out EK allowed")
+	}
+
+	if err := provisioner.Limiter.AllowEK("bb"); err != nil {
+		t.Fatalf("EK without failures rejected: %v", err)
+	}
+}
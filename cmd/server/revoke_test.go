@@ -0,0 +1,311 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/cray-hpe/tpm-provisioner/tests/simulateTPM"
+)
+
+// TestRevokeCRL validates that revoked certificates are published in the CRL
+// and that revocations persist across restarts.
+func TestRevokeCRL(t *testing.T) {
+	pCA, pPrivKey, _, err := simulateTPM.GenerateCA("Provisioner CA")
+	if err != nil {
+		t.Fatalf("Unable to provision CA: %v", err)
+	}
+
+	provisioner.CFG = provisioner.Config{
+		ProviderCA:  pCA,
+		ProviderKey: pPrivKey,
+	}
+
+	path := filepath.Join(t.TempDir(), "issued.db")
+
+	ledger, err := provisioner.OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rec := range []provisioner.IssuedCertificate{
+		{Serial: "0a", Kind: provisioner.KindDevID, Xname: "x1000c0s0b0n0"},
+		{Serial: "0b", Kind: provisioner.KindAttestation, Xname: "x1000c0s0b0n0"},
+		{Serial: "0c", Kind: provisioner.KindDevID, Xname: "x1000c0s0b0n1"},
+	} {
+		if err = ledger.Record(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	provisioner.Issued = ledger
+
+	defer func() {
+		provisioner.Issued = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	revokeURL := ts.URL + "/apis/tpm-provisioner/revoke"
+
+	resp, err := http.PostForm(revokeURL, url.Values{"xname": {"x1000c0s0b0n0"}, "serial": {"0c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("Revocation with two selectors accepted")
+	}
+
+	for _, reason := range []string{"certificateHold", "6", "removeFromCRL"} {
+		resp, err = http.PostForm(revokeURL, url.Values{"serial": {"0c"}, "reason": {reason}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Revocation reason %s accepted with status %d", reason, resp.StatusCode)
+		}
+	}
+
+	resp, err = http.PostForm(revokeURL, url.Values{"xname": {"x1000c0s0b0n0"}, "reason": {"keyCompromise"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Revocation failed with status %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/apis/tpm-provisioner/crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("Unable to parse CRL: %v", err)
+	}
+
+	if err = list.CheckSignatureFrom(pCA); err != nil {
+		t.Fatalf("CRL not signed by the provider CA: %v", err)
+	}
+
+	if len(list.RevokedCertificateEntries) != 2 {
+		t.Fatalf("Expected 2 revoked certificates, found %d", len(list.RevokedCertificateEntries))
+	}
+
+	for _, entry := range list.RevokedCertificateEntries {
+		if entry.ReasonCode != 1 {
+			t.Fatalf("Unexpected reason code: %d", entry.ReasonCode)
+		}
+	}
+
+	// Revocations survive a restart.
+	if err = ledger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.Issued, err = provisioner.OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer provisioner.Issued.Close()
+
+	revoked, err := provisioner.Issued.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(revoked) != 2 {
+		t.Fatalf("Expected 2 revoked certificates after reopening, found %d", len(revoked))
+	}
+}
+
+// TestRevokeReenroll validates that a recorded certificate is never replaced,
+// so its revocation stays in the ledger and the CRL.
+func TestRevokeReenroll(t *testing.T) {
+	pCA, pPrivKey, _, err := simulateTPM.GenerateCA("Provisioner CA")
+	if err != nil {
+		t.Fatalf("Unable to provision CA: %v", err)
+	}
+
+	provisioner.CFG = provisioner.Config{
+		ProviderCA:  pCA,
+		ProviderKey: pPrivKey,
+	}
+
+	provisioner.Issued, err = provisioner.OpenLedger(filepath.Join(t.TempDir(), "issued.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		provisioner.Issued.Close()
+		provisioner.Issued = nil
+	}()
+
+	rec := provisioner.IssuedCertificate{Serial: "0a", Kind: provisioner.KindDevID, Xname: "x1000c0s0b0n0"}
+
+	if err = provisioner.Issued.Record(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = provisioner.Issued.Revoke(rec.Serial, 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = provisioner.Issued.Record(rec); err == nil {
+		t.Fatal("Recorded certificate was replaced")
+	}
+
+	got, err := provisioner.Issued.BySerial(rec.Serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.RevokedAt == nil || got.RevocationReason != 1 {
+		t.Fatalf("Revocation lost on re-enrollment: %+v", got)
+	}
+
+	if err = provisioner.GenerateCRL(time.Hour); err != nil {
+		t.Fatalf("Unable to generate CRL: %v", err)
+	}
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/apis/tpm-provisioner/crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("Unable to parse CRL: %v", err)
+	}
+
+	if len(list.RevokedCertificateEntries) != 1 {
+		t.Fatalf("Expected 1 revoked certificate, found %d", len(list.RevokedCertificateEntries))
+	}
+}
+
+// TestCRLConcurrent validates that concurrent CRL generations publish the CRL
+// with the last number.
+func TestCRLConcurrent(t *testing.T) {
+	pCA, pPrivKey, _, err := simulateTPM.GenerateCA("Provisioner CA")
+	if err != nil {
+		t.Fatalf("Unable to provision CA: %v", err)
+	}
+
+	provisioner.CFG = provisioner.Config{
+		ProviderCA:  pCA,
+		ProviderKey: pPrivKey,
+	}
+
+	provisioner.Issued, err = provisioner.OpenLedger(filepath.Join(t.TempDir(), "issued.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		provisioner.Issued.Close()
+		provisioner.Issued = nil
+	}()
+
+	const generations = 16
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < generations; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := provisioner.GenerateCRL(time.Hour); err != nil {
+				t.Errorf("Unable to generate CRL: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/apis/tpm-provisioner/crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("Unable to parse CRL: %v", err)
+	}
+
+	if list.Number.Int64() != generations {
+		t.Fatalf("Published CRL number %v, expected %d", list.Number, generations)
+	}
+}
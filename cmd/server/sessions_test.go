@@ -0,0 +1,267 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// TestSessionStoreConcurrentEnrollments validates that many enrollments can
+// run through the session store at the same time.
+func TestSessionStoreConcurrentEnrollments(t *testing.T) {
+	store := provisioner.NewMemorySessionStore(time.Minute)
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 500)
+
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			token, _, err := store.Create("x1000c0s0b0n0", "compute")
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if _, _, err = store.Advance(token, 1); err != nil {
+				errs <- err
+				return
+			}
+
+			if _, err = store.SetChallenge(token, "nonce", "data"); err != nil {
+				errs <- err
+				return
+			}
+
+			if _, _, err = store.Advance(token, 2); err != nil {
+				errs <- err
+				return
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Unexpected session error: %v", err)
+	}
+
+	if store.Len() != 500 {
+		t.Fatalf("Expected 500 sessions, found %d", store.Len())
+	}
+}
+
+// TestSessionStoreOutOfOrder validates that a step can not be run twice.
+func TestSessionStoreOutOfOrder(t *testing.T) {
+	store := provisioner.NewMemorySessionStore(time.Minute)
+
+	token, _, err := store.Create("x1000c0s0b0n0", "compute")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = store.Advance(token, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = store.Advance(token, 1)
+
+	expected := "request out of order"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected: %s\nReceived: %v", expected, err)
+	}
+}
+
+// TestSessionStoreExpire validates that expired sessions are rejected and
+// removed by the reaper.
+func TestSessionStoreExpire(t *testing.T) {
+	store := provisioner.NewMemorySessionStore(time.Millisecond)
+
+	token, _, err := store.Create("x1000c0s0b0n0", "compute")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, _, err = store.Advance(token, 1)
+
+	expected := "session expired"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected: %s\nReceived: %v", expected, err)
+	}
+
+	if n := store.Expire(time.Now()); n != 1 {
+		t.Fatalf("Expected 1 expired session, removed %d", n)
+	}
+
+	_, err = store.Get(token)
+
+	expected = "invalid session cookie"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected: %s\nReceived: %v", expected, err)
+	}
+}
+
+// newSessionKey returns a random session key.
+func newSessionKey(t *testing.T) []byte {
+	t.Helper()
+
+	key := make([]byte, 32)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// TestTokenSessionStoreKeyRotation validates that a token minted with an old
+// session key is accepted by a server that has rotated to a new key.
+func TestTokenSessionStoreKeyRotation(t *testing.T) {
+	oldKey := newSessionKey(t)
+	newKey := newSessionKey(t)
+
+	oldStore, err := provisioner.NewTokenSessionStore(time.Minute, [][]byte{oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := provisioner.NewTokenSessionStore(time.Minute, [][]byte{oldKey, newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newOnly, err := provisioner.NewTokenSessionStore(time.Minute, [][]byte{newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := oldStore.Create("x1000c0s0b0n0", "compute")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, session, err := rotated.Advance(token, 1)
+	if err != nil {
+		t.Fatalf("Rotated store rejected old token: %v", err)
+	}
+
+	if session.Xname() != "x1000c0s0b0n0" || session.NodeType() != "compute" {
+		t.Fatalf("Unexpected session: %s %s", session.Xname(), session.NodeType())
+	}
+
+	// Tokens minted after the rotation must be sealed with the new key.
+	if _, err = newOnly.Get(token); err != nil {
+		t.Fatalf("Token was not minted with the newest key: %v", err)
+	}
+
+	if _, err = oldStore.Get(token); err == nil {
+		t.Fatalf("Token minted with the new key accepted with the old key")
+	}
+}
+
+// TestTokenSessionStoreTampered validates that a modified token is rejected.
+func TestTokenSessionStoreTampered(t *testing.T) {
+	store, err := provisioner.NewTokenSessionStore(time.Minute, [][]byte{newSessionKey(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := store.Create("x1000c0s0b0n0", "compute")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a character in the middle of the token, the last character may only
+	// carry padding bits.
+	b := []byte(token)
+	i := len(b) / 2
+
+	if b[i] == 'A' {
+		b[i] = 'B'
+	} else {
+		b[i] = 'A'
+	}
+
+	_, _, err = store.Advance(string(b), 1)
+
+	expected := "invalid session cookie"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected: %s\nReceived: %v", expected, err)
+	}
+}
+
+// TestTokenSessionStoreSteps validates that token sessions enforce step order
+// and expiry.
+func TestTokenSessionStoreSteps(t *testing.T) {
+	store, err := provisioner.NewTokenSessionStore(time.Minute, [][]byte{newSessionKey(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := store.Create("x1000c0s0b0n0", "compute")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = store.Advance(token, 2)
+
+	expected := "request out of order"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected: %s\nReceived: %v", expected, err)
+	}
+
+	expiring, err := provisioner.NewTokenSessionStore(time.Nanosecond, [][]byte{newSessionKey(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err = expiring.Create("x1000c0s0b0n0", "compute")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	_, _, err = expiring.Advance(token, 1)
+
+	expected = "session expired"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected: %s\nReceived: %v", expected, err)
+	}
+}
@@ -0,0 +1,117 @@
+//go:build cgo
+
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"crypto/elliptic"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/cray-hpe/tpm-provisioner/pkg/casigner"
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// TestCASignerPKCS11 validates that the platform CA key may be a key pair on
+// a PKCS #11 token. It runs when SoftHSM is installed, or with the module in
+// PKCS11_MODULE.
+func TestCASignerPKCS11(t *testing.T) {
+	module := os.Getenv("PKCS11_MODULE")
+
+	for _, path := range []string{
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib64/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	} {
+		if _, err := os.Stat(path); module == "" && err == nil {
+			module = path
+		}
+	}
+
+	util, err := exec.LookPath("softhsm2-util")
+	if module == "" || err != nil {
+		t.Skip("SoftHSM is not installed")
+	}
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+
+	err = os.WriteFile(conf, []byte("directories.tokendir = "+dir+"\nobjectstore.backend = file\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	out, err := exec.Command(util, "--init-token", "--free", "--label", "platform-ca", "--pin", "1234", "--so-pin", "5678").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Unable to initialize token: %v: %s", err, out)
+	}
+
+	pinFile := filepath.Join(dir, "pin")
+
+	if err = os.WriteFile(pinFile, []byte("1234\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := provisioner.Config{
+		CAKeyBackend:     provisioner.CAKeyBackendPKCS11,
+		PKCS11Module:     module,
+		PKCS11TokenLabel: "platform-ca",
+		PKCS11PINFile:    pinFile,
+		PKCS11KeyLabel:   "platform-ca-key",
+	}
+
+	if _, _, err = casigner.New(cfg); err == nil {
+		t.Fatalf("Missing PKCS #11 key pair accepted")
+	}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{Path: module, TokenLabel: "platform-ca", Pin: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ctx.Close()
+
+	if _, err = ctx.GenerateECDSAKeyPairWithLabel([]byte("ca"), []byte(cfg.PKCS11KeyLabel), elliptic.P256()); err != nil {
+		t.Fatalf("Unable to generate PKCS #11 key pair: %v", err)
+	}
+
+	signer, closer, err := casigner.New(cfg)
+	if err != nil {
+		t.Fatalf("Unable to use PKCS #11 key pair: %v", err)
+	}
+
+	checkCASigner(t, newTestCA(t, signer), signer)
+
+	if err = closer.Close(); err != nil {
+		t.Fatalf("Unable to close the PKCS #11 session: %v", err)
+	}
+}
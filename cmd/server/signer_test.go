@@ -0,0 +1,258 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/casigner"
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// newTestCA returns a self signed CA certificate for signer.
+func newTestCA(t *testing.T, signer crypto.Signer) *x509.Certificate {
+	t.Helper()
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Platform CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "Platform CA"}}, signer.Public(), signer)
+	if err != nil {
+		t.Fatalf("Unable to create CA certificate: %v", err)
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca
+}
+
+// checkCASigner validates that signer issues certificates and CRLs verified
+// by ca.
+func checkCASigner(t *testing.T, ca *x509.Certificate, signer crypto.Signer) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "compute/x1000c0s0b0n0"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, ca, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("Unable to issue a certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cert.CheckSignatureFrom(ca); err != nil {
+		t.Fatalf("Certificate not signed by the CA: %v", err)
+	}
+
+	der, err = x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, ca, signer)
+	if err != nil {
+		t.Fatalf("Unable to sign a CRL: %v", err)
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = crl.CheckSignatureFrom(ca); err != nil {
+		t.Fatalf("CRL not signed by the CA: %v", err)
+	}
+}
+
+// TestCASignerFile validates that RSA, ECDSA and Ed25519 platform CA keys are
+// loaded from PEM files and must match the platform CA certificate.
+func TestCASignerFile(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+
+	for _, tt := range []struct {
+		name   string
+		key    crypto.Signer
+		pemKey *pem.Block
+	}{
+		{"rsa", rsaKey, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}},
+		{"ecdsa", ecKey, &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}},
+		{"ed25519", edKey, &pem.Block{Type: "PRIVATE KEY", Bytes: edDER}},
+	} {
+		file := filepath.Join(dir, tt.name+".key")
+
+		if err = os.WriteFile(file, pem.EncodeToMemory(tt.pemKey), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		ca := newTestCA(t, tt.key)
+
+		signer, closer, err := casigner.New(provisioner.Config{CAKeyFile: file, ProviderCA: ca})
+		if err != nil {
+			t.Fatalf("%s: unable to load CA key: %v", tt.name, err)
+		}
+
+		checkCASigner(t, ca, signer)
+
+		if err = closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The key of another CA is rejected.
+		if _, _, err = casigner.New(provisioner.Config{CAKeyFile: file, ProviderCA: newTestCA(t, rsaKey)}); tt.name != "rsa" && err == nil {
+			t.Errorf("%s: CA key accepted for another CA certificate", tt.name)
+		}
+	}
+
+	_, _, err = casigner.New(provisioner.Config{
+		CAKeyFile: filepath.Join(dir, "ed25519.key"),
+		OCSPURL:   "http://tpm-provisioner/ocsp",
+	})
+	if err == nil {
+		t.Errorf("Ed25519 CA key accepted without a delegated OCSP responder")
+	}
+
+	if _, _, err = casigner.New(provisioner.Config{CAKeyBackend: "vault"}); err == nil {
+		t.Errorf("Unknown CA key backend accepted")
+	}
+}
+
+// TestCASignerTPM validates that the platform CA key may be a persistent TPM
+// key.
+func TestCASignerTPM(t *testing.T) {
+	rw := openTPM(t)
+
+	defer func() {
+		if err := rw.Close(); err != nil {
+			t.Errorf("Unable to close simulator: %v", err)
+		}
+	}()
+
+	for i, template := range []tpm2.Public{
+		{
+			Type:       tpm2.AlgECC,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: tpm2.FlagSign | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth | tpm2.FlagFixedTPM | tpm2.FlagFixedParent,
+			ECCParameters: &tpm2.ECCParams{
+				Sign:    &tpm2.SigScheme{Alg: tpm2.AlgNull},
+				CurveID: tpm2.CurveNISTP256,
+			},
+		},
+		{
+			Type:       tpm2.AlgRSA,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: tpm2.FlagSign | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth | tpm2.FlagFixedTPM | tpm2.FlagFixedParent,
+			RSAParameters: &tpm2.RSAParams{
+				Sign:    &tpm2.SigScheme{Alg: tpm2.AlgNull},
+				KeyBits: 2048,
+			},
+		},
+	} {
+		key, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+		if err != nil {
+			t.Fatalf("Unable to create TPM key: %v", err)
+		}
+
+		handle := tpmutil.Handle(0x81000100 + i)
+
+		err = tpm2.EvictControl(rw, "", tpm2.HandleOwner, key, handle)
+		if err != nil {
+			t.Fatalf("Unable to persist TPM key: %v", err)
+		}
+
+		if err = tpm2.FlushContext(rw, key); err != nil {
+			t.Fatal(err)
+		}
+
+		signer, err := casigner.NewTPMSigner(rw, handle)
+		if err != nil {
+			t.Fatalf("Unable to use TPM key: %v", err)
+		}
+
+		checkCASigner(t, newTestCA(t, signer), signer)
+	}
+
+	if _, err := casigner.NewTPMSigner(rw, 0x81000200); err == nil {
+		t.Errorf("Missing TPM key accepted")
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/client"
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/cray-hpe/tpm-provisioner/tests/simulateTPM"
+	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/proto/enrollapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestSubjectEnforcement validates that the subject of issued certificates is
+// built from the enrolling xname and node type, and that a different subject
+// requested by the client is replaced and audited, or rejected.
+func TestSubjectEnforcement(t *testing.T) {
+	pCA, pPrivKey, _, err := simulateTPM.GenerateCA("Provisioner CA")
+	if err != nil {
+		t.Fatalf("Unable to provision CA: %v", err)
+	}
+
+	spireTokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer spireTokens.Close()
+
+	provisioner.CFG = provisioner.Config{
+		ProviderCA:     pCA,
+		ProviderKey:    pPrivKey,
+		SpireTokensURL: spireTokens.URL,
+		CertProfiles: map[string]provisioner.CertProfile{
+			"strict": {SubjectMode: provisioner.SubjectModeReject},
+		},
+	}
+
+	provisioner.Profiles, err = provisioner.NewProfiles(provisioner.CFG)
+	if err != nil {
+		t.Fatalf("Unable to configure certificate profiles: %v", err)
+	}
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{
+		{Pattern: "x1000c0s0b0n0"},
+		{Pattern: "x1000c0s1b0n0", Profile: "strict"},
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	provisioner.Audit, err = provisioner.OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		provisioner.Audit.Close()
+		provisioner.Audit = nil
+		provisioner.Profiles = nil
+		provisioner.WhiteList = nil
+	}()
+
+	conn := dialTestEnrollment(t)
+
+	// A node authorized as x1000c0s0b0n0 asking for x1000c0s0b0n1 gets a
+	// certificate for x1000c0s0b0n0.
+	cert, err := enrollWithNewTPM(t, conn, "x1000c0s0b0n0", "compute", pkix.Name{CommonName: "compute/x1000c0s0b0n1"})
+	if err != nil {
+		t.Fatalf("Enrollment of x1000c0s0b0n0 failed: %v", err)
+	}
+
+	if cert.Subject.String() != "CN=compute/x1000c0s0b0n0" {
+		t.Errorf("Unexpected DevID subject: %s", cert.Subject)
+	}
+
+	err = enrollRejected(t, conn, "x1000c0s1b0n0", "compute", pkix.Name{CommonName: "compute/x1000c0s1b0n1"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied for a mismatching subject, received: %v", err)
+	}
+
+	cert, err = enrollWithNewTPM(t, conn, "x1000c0s1b0n0", "compute", pkix.Name{CommonName: "compute/x1000c0s1b0n0"})
+	if err != nil {
+		t.Fatalf("Enrollment of x1000c0s1b0n0 with a matching subject failed: %v", err)
+	}
+
+	if cert.Subject.String() != "CN=compute/x1000c0s1b0n0" {
+		t.Errorf("Unexpected DevID subject: %s", cert.Subject)
+	}
+
+	// The enroll event is audited once the stream ends, after the client
+	// received its certificate.
+	var events []provisioner.AuditEvent
+
+	for deadline := time.Now().Add(5 * time.Second); len(events) < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+
+		events = readAuditEvents(t, path)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 audit events, found %d", len(events))
+	}
+
+	if events[0].Outcome != provisioner.AuditSuccess || events[0].Details["requestedSubject"] != "CN=compute/x1000c0s0b0n1" {
+		t.Errorf("Overridden subject not audited: %+v", events[0])
+	}
+
+	if events[1].Outcome != provisioner.AuditFailure || events[2].Details["requestedSubject"] != "" {
+		t.Errorf("Unexpected audit events: %+v %+v", events[1], events[2])
+	}
+}
+
+// readAuditEvents reads the events of the audit log at path.
+func readAuditEvents(t *testing.T, path string) []provisioner.AuditEvent {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	var events []provisioner.AuditEvent
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev provisioner.AuditEvent
+
+		if err = json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+
+		events = append(events, ev)
+	}
+
+	return events
+}
+
+// enrollRejected runs an enrollment of xname as nodeType over conn, requesting
+// the subject pi, that is expected to fail once the challenge is answered. It
+// returns the error of the signing response. The client library is not used
+// as it gives up on a failed enrollment by flushing the simulator's EK.
+func enrollRejected(t *testing.T, conn *grpc.ClientConn, xname string, nodeType string, pi pkix.Name) error {
+	t.Helper()
+
+	return enrollRaw(t, conn, xname, nodeType, pi, 0)
+}
+
+// enrollRaw runs an enrollment with a new TPM over a raw stream, waiting for
+// delay before answering the challenge, and returns the final stream error.
+func enrollRaw(t *testing.T, conn *grpc.ClientConn, xname string, nodeType string, pi pkix.Name, delay time.Duration) error {
+	t.Helper()
+
+	rw := openTrustedTPM(t)
+
+	defer func() {
+		if err := rw.Close(); err != nil {
+			t.Errorf("Unable to close simulator: %v", err)
+		}
+	}()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "xname", xname, "type", nodeType)
+
+	data, sig, res, err := client.CreateRawRequest(ctx, rw, pi)
+	if err != nil {
+		t.Fatalf("Unable to create signing request: %v", err)
+	}
+
+	stream, err := enrollapi.NewEnrollmentClient(conn).Enroll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = stream.Send(&enrollapi.EnrollRequest{
+		RequestOrResponse: &enrollapi.EnrollRequest_SigningRequest{
+			SigningRequest: &enrollapi.RawSigningRequest{Data: data, Signature: sig},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Receiving challenge failed: %v", err)
+	}
+
+	challengeResponse, err := client.GenerateChallengeResponse(
+		rw,
+		base64.RawStdEncoding.EncodeToString(resp.GetChallenge().GetCredentialBlob()),
+		base64.RawStdEncoding.EncodeToString(resp.GetChallenge().GetSecret()),
+		res,
+	)
+	if err != nil {
+		t.Fatalf("Unable to answer the challenge: %v", err)
+	}
+
+	time.Sleep(delay)
+
+	err = stream.Send(&enrollapi.EnrollRequest{
+		RequestOrResponse: &enrollapi.EnrollRequest_ChallengeResponse{ChallengeResponse: challengeResponse},
+	})
+	if err != nil && !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+
+	_, err = stream.Recv()
+
+	return err
+}
@@ -0,0 +1,488 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// TestWhiteListMigration validates that a white list in the line format is
+// migrated to structured entries.
+func TestWhiteListMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.tpm")
+
+	if err := os.WriteFile(path, []byte("x1000c0s0b0n0\nx3000c0s[0-9]+b0n0\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+
+	defer func() {
+		provisioner.WhiteList = nil
+	}()
+
+	if err := provisioner.LoadWhiteList(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(provisioner.WhiteList) != 2 || provisioner.WhiteList[1].Pattern != "x3000c0s[0-9]+b0n0" || provisioner.WhiteList[1].CreatedAt.IsZero() {
+		t.Fatalf("Unexpected migrated white list: %+v", provisioner.WhiteList)
+	}
+
+	if _, err := os.Stat(path + ".v1"); err != nil {
+		t.Fatalf("Legacy white list not kept: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(data), "entries:") {
+		t.Fatalf("White list not rewritten in the structured format:\n%s", data)
+	}
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+
+	if err = provisioner.LoadWhiteList(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(provisioner.WhiteList) != 2 || provisioner.WhiteList[0].CreatedBy != "migration" {
+		t.Fatalf("Unexpected reloaded white list: %+v", provisioner.WhiteList)
+	}
+}
+
+// TestWhiteListLegacyRegex validates that migrated and untyped white list
+// file entries keep their regexp meaning.
+func TestWhiteListLegacyRegex(t *testing.T) {
+	dir := t.TempDir()
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+
+	defer func() {
+		provisioner.WhiteList = nil
+	}()
+
+	for _, data := range []string{
+		"x1000c0s[1-12]b0n0\n",
+		"entries:\n  - pattern: x1000c0s[1-12]b0n0\n",
+	} {
+		path := filepath.Join(dir, "whitelist.tpm")
+
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := provisioner.LoadWhiteList(path); err != nil {
+			t.Fatal(err)
+		}
+
+		if entries := provisioner.WhiteListEntries(); len(entries) != 1 || entries[0].Type != provisioner.WhiteListTypeRegex {
+			t.Fatalf("Untyped entry of %q not loaded as a regexp: %+v", data, entries)
+		}
+
+		for slot, allowed := range map[string]bool{"1": true, "2": true, "5": false, "12": false} {
+			matches, err := provisioner.MatchWhiteList("x1000c0s"+slot+"b0n0", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (len(matches) == 1) != allowed {
+				t.Errorf("Slot %s of %q matched %v, expected %v", slot, data, len(matches) == 1, allowed)
+			}
+		}
+
+		if err := os.Remove(path + ".v1"); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestWhiteListBrokenYAML validates that a structured white list with a
+// syntax error is rejected and left untouched instead of being migrated.
+func TestWhiteListBrokenYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.tpm")
+	broken := []byte("entries:\n  - pattern: x1000c0s0b0n0\n    comment: rack one\n   createdBy: admin\n")
+
+	if err := os.WriteFile(path, broken, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+
+	defer func() {
+		provisioner.WhiteList = nil
+	}()
+
+	if err := provisioner.LoadWhiteList(path); err == nil {
+		t.Fatalf("Broken YAML white list accepted: %+v", provisioner.WhiteList)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != string(broken) {
+		t.Fatalf("Broken YAML white list rewritten:\n%s", data)
+	}
+
+	if _, err = os.Stat(path + ".v1"); err == nil {
+		t.Fatalf("Broken YAML white list migrated")
+	}
+}
+
+// TestWhiteListWindow validates that entries only allow their node types
+// within their time window.
+func TestWhiteListWindow(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{
+		{Pattern: "x1000c0s0b0n0", NodeTypes: []string{"compute"}},
+		{Pattern: "x1000c0s1b0n0", NotBefore: &past, NotAfter: &future},
+		{Pattern: "x1000c0s2b0n0", NotAfter: &past},
+		{Pattern: "x1000c0s3b0n0", NotBefore: &future},
+	}
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	defer func() {
+		provisioner.WhiteList = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		xname    string
+		nodeType string
+		status   int
+	}{
+		{"x1000c0s0b0n0", "compute", http.StatusOK},
+		{"x1000c0s0b0n0", "ncn", http.StatusForbidden},
+		{"x1000c0s1b0n0", "compute", http.StatusOK},
+		{"x1000c0s2b0n0", "compute", http.StatusForbidden},
+		{"x1000c0s3b0n0", "compute", http.StatusForbidden},
+	} {
+		resp, err := http.Get(ts.URL + "/apis/tpm-provisioner/authorize?type=" + tt.nodeType + "&xname=" + tt.xname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("Authorize %s as %s returned %d, expected %d", tt.xname, tt.nodeType, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+// TestWhiteListPersistence validates that concurrent updates are all saved,
+// that the previous file is kept as a backup and that no temporary files are
+// left behind.
+func TestWhiteListPersistence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "whitelist.tpm")
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+
+	defer func() {
+		provisioner.WhiteList = nil
+	}()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			err := provisioner.AddWhiteListItem(path, provisioner.WhiteListEntry{Pattern: fmt.Sprintf("x%dc0s0b0n0", 1000+i)})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = provisioner.RemoveWhiteListItem(path, "x1000c0s0b0n0"); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := os.ReadFile(path + ".bak")
+	if err != nil {
+		t.Fatalf("No whitelist backup: %v", err)
+	}
+
+	if string(backup) != string(before) {
+		t.Fatalf("Whitelist backup is not the previous file")
+	}
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+
+	if err = provisioner.LoadWhiteList(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(provisioner.WhiteList) != 19 {
+		t.Fatalf("Expected 19 saved entries, found %d", len(provisioner.WhiteList))
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("Unexpected files left in the whitelist directory: %v", files)
+	}
+}
+
+// TestWatchWhiteList validates that the white list is reloaded when its file
+// is replaced.
+func TestWatchWhiteList(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "whitelist.tpm")
+
+	if err := os.WriteFile(path, []byte("entries:\n  - pattern: x1000c0s0b0n0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+
+	defer func() {
+		provisioner.WhiteList = nil
+	}()
+
+	if err := provisioner.LoadWhiteList(path); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watching := make(chan error, 1)
+
+	go func() {
+		watching <- provisioner.WatchWhiteList(ctx, path)
+	}()
+
+	// Give the watcher time to start.
+	time.Sleep(100 * time.Millisecond)
+
+	// Replace the file the way a ConfigMap update does.
+	tmp := filepath.Join(dir, "new")
+
+	if err := os.WriteFile(tmp, []byte("entries:\n  - pattern: x3000c0s0b0n0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		entries := provisioner.WhiteListEntries()
+		if len(entries) == 1 && entries[0].Pattern == "x3000c0s0b0n0" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Whitelist not reloaded: %+v", entries)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// An invalid file keeps the current white list.
+	if err := os.WriteFile(path, []byte("entries: [\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if entries := provisioner.WhiteListEntries(); len(entries) != 1 || entries[0].Pattern != "x3000c0s0b0n0" {
+		t.Fatalf("Invalid whitelist replaced the current one: %+v", entries)
+	}
+
+	cancel()
+
+	if err := <-watching; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWhiteListPatterns validates xname pattern entries, the regexp fallback
+// and the white list test endpoint.
+func TestWhiteListPatterns(t *testing.T) {
+	provisioner.CFG = provisioner.Config{WhiteList: filepath.Join(t.TempDir(), "whitelist")}
+	provisioner.WhiteList = []provisioner.WhiteListEntry{}
+	provisioner.Sessions = provisioner.NewMemorySessionStore(time.Minute)
+
+	defer func() {
+		provisioner.WhiteList = nil
+	}()
+
+	ts := httptest.NewServer(provisioner.NewRouter())
+	defer ts.Close()
+
+	apiURL := ts.URL + "/apis/tpm-provisioner"
+
+	for _, tt := range []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{"xname": {"x1000c[0-7]s*b0n[0-1]"}, "type": {"compute"}}, http.StatusOK},
+		{url.Values{"xname": {"x3000c0s[1-10]b0n0"}}, http.StatusOK},
+		{url.Values{"xname": {"x4000c0s0b0n.*"}}, http.StatusOK},
+		{url.Values{"xname": {"x5000c0s0b0n[0-1"}, "patternType": {"xname"}}, http.StatusBadRequest},
+		{url.Values{"xname": {"x1000c[0-8]s0b0n0"}, "patternType": {"xname"}}, http.StatusBadRequest},
+		{url.Values{"xname": {"x1000c0s0b0"}, "patternType": {"xname"}}, http.StatusBadRequest},
+		{url.Values{"xname": {"x1000c0s0b0n("}}, http.StatusBadRequest},
+		{url.Values{"xname": {"x6000c0s0b0n0"}, "patternType": {"glob"}}, http.StatusBadRequest},
+	} {
+		resp, err := http.PostForm(apiURL+"/whitelist/add", tt.form)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("Adding %v returned %d, expected %d", tt.form, resp.StatusCode, tt.status)
+		}
+	}
+
+	types := map[string]string{}
+
+	for _, e := range provisioner.WhiteListEntries() {
+		types[e.Pattern] = e.Type
+	}
+
+	expected := map[string]string{
+		"x1000c[0-7]s*b0n[0-1]": provisioner.WhiteListTypeXname,
+		"x3000c0s[1-10]b0n0":    provisioner.WhiteListTypeXname,
+		"x4000c0s0b0n.*":        provisioner.WhiteListTypeRegex,
+	}
+
+	if fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Fatalf("White list types are %v, expected %v", types, expected)
+	}
+
+	for _, tt := range []struct {
+		xname    string
+		nodeType string
+		status   int
+	}{
+		{"x1000c7s12b0n1", "compute", http.StatusOK},
+		{"x1000c7s12b0n1", "ncn", http.StatusForbidden},
+		{"x1000c7s12b1n1", "compute", http.StatusForbidden},
+		{"x3000c0s10b0n0", "ncn", http.StatusOK},
+		{"x3000c0s11b0n0", "ncn", http.StatusForbidden},
+		{"x4000c0s0b0n3", "compute", http.StatusOK},
+		{"x1000c8s0b0n0", "compute", http.StatusBadRequest},
+		{"x1000c0s0b0", "compute", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(apiURL + "/authorize?type=" + tt.nodeType + "&xname=" + url.QueryEscape(tt.xname))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("Authorize %s as %s returned %d, expected %d", tt.xname, tt.nodeType, resp.StatusCode, tt.status)
+		}
+	}
+
+	resp, err := http.Get(apiURL + "/whitelist/test?type=ncn&xname=x1000c0s0b0n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report provisioner.TestWhiteListResponse
+
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Allowed || len(report.Matches) != 1 || report.Matches[0].Entry.Pattern != "x1000c[0-7]s*b0n[0-1]" || report.Matches[0].Reason == "" {
+		t.Fatalf("Unexpected white list test report %+v", report)
+	}
+
+	resp, err = http.Get(apiURL + "/v2/whitelist/test?xname=x1000c0s0b0n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Allowed || len(report.Matches) != 1 || !report.Matches[0].Allowed {
+		t.Fatalf("Unexpected white list test report %+v", report)
+	}
+
+	resp, err = http.Get(apiURL + "/whitelist/test?xname=x1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Testing a cabinet xname returned %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+// tpm-provisioner-verify-audit checks the hash chain of a TPM Provisioner
+// audit log.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// verify checks the audit log read from r and prints a summary to out.
+func verify(r io.Reader, out io.Writer, prevHash string, lastHash string) error {
+	n, hash, err := provisioner.VerifyAuditLog(r, prevHash)
+	if err != nil {
+		return err
+	}
+
+	if lastHash != "" && hash != lastHash {
+		return fmt.Errorf("last record hash %s does not match %s, the log was truncated", hash, lastHash)
+	}
+
+	fmt.Fprintf(out, "OK: %d records, last hash %s\n", n, hash)
+
+	return nil
+}
+
+func main() {
+	prevHash := flag.String("prev", "", "hash of the record before the first one in the log, for rotated logs")
+	lastHash := flag.String("last", "", "expected hash of the last record, to detect truncation")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s [-prev HASH] [-last HASH] AUDIT LOG\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(filepath.Clean(flag.Arg(0)))
+	if err != nil {
+		log.Fatalf("Unable to open audit log: %v", err)
+	}
+
+	defer f.Close()
+
+	err = verify(f, os.Stdout, *prevHash, *lastHash)
+	if err != nil {
+		log.Fatalf("Audit log verification failed: %v", err)
+	}
+}
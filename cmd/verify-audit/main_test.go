@@ -0,0 +1,101 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// writeAuditLog writes n audit events and returns the log lines.
+func writeAuditLog(t *testing.T, n int) []string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	audit, err := provisioner.OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		err = audit.Write(provisioner.AuditEvent{
+			Event:   provisioner.AuditWhiteListAdd,
+			Outcome: provisioner.AuditSuccess,
+			Details: map[string]string{"pattern": "x1000c0s0b0n" + strings.Repeat("0", i+1)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestVerify(t *testing.T) {
+	lines := writeAuditLog(t, 4)
+
+	var out bytes.Buffer
+
+	if err := verify(strings.NewReader(strings.Join(lines, "")), &out, "", ""); err != nil {
+		t.Fatalf("Valid audit log rejected: %v", err)
+	}
+
+	lastHash := strings.Fields(out.String())[5]
+
+	tests := []struct {
+		name  string
+		lines []string
+	}{
+		{"edited", append(append([]string{}, lines[:1]...), append([]string{strings.Replace(lines[1], "x1000", "x2000", 1)}, lines[2:]...)...)},
+		{"deleted", append(append([]string{}, lines[:1]...), lines[2:]...)},
+		{"reordered", append([]string{lines[1], lines[0]}, lines[2:]...)},
+		{"head truncated", lines[1:]},
+		{"tail truncated", lines[:3]},
+	}
+
+	for _, tt := range tests {
+		err := verify(strings.NewReader(strings.Join(tt.lines, "")), io.Discard, "", lastHash)
+		if err == nil {
+			t.Errorf("%s audit log accepted", tt.name)
+		}
+	}
+}
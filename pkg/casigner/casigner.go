@@ -0,0 +1,143 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+// Package casigner opens the platform CA key of the tpm-provisioner server
+// from a PEM file, a PKCS #11 token or the TPM of the server.
+package casigner
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// nopCloser closes a signer holding no resources.
+type nopCloser struct{}
+
+// Close does nothing.
+func (nopCloser) Close() error {
+	return nil
+}
+
+// New returns the signer of the platform CA key for the configured backend,
+// and the closer releasing the token session or TPM device it holds. The
+// signer must match the public key of the provider CA.
+func New(cfg provisioner.Config) (crypto.Signer, io.Closer, error) {
+	var (
+		signer crypto.Signer
+		closer io.Closer = nopCloser{}
+		err    error
+	)
+
+	switch cfg.CAKeyBackend {
+	case "", provisioner.CAKeyBackendFile:
+		signer, err = loadKeyFile(cfg.CAKeyFile)
+	case provisioner.CAKeyBackendPKCS11:
+		signer, closer, err = openPKCS11Signer(cfg)
+	case provisioner.CAKeyBackendTPM:
+		signer, closer, err = openTPMSigner(cfg)
+	default:
+		return nil, nil, fmt.Errorf("unknown CA key backend %q", cfg.CAKeyBackend)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = checkSigner(cfg, signer); err != nil {
+		closer.Close()
+		return nil, nil, err
+	}
+
+	return signer, closer, nil
+}
+
+// checkSigner validates that signer matches the provider CA and can sign
+// OCSP responses.
+func checkSigner(cfg provisioner.Config, signer crypto.Signer) error {
+	if cfg.ProviderCA != nil {
+		pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !pub.Equal(cfg.ProviderCA.PublicKey) {
+			return errors.New("platform CA key does not match the platform CA certificate")
+		}
+	}
+
+	// OCSP responses can not be signed with Ed25519 keys.
+	if _, ok := signer.Public().(ed25519.PublicKey); ok && cfg.OCSPURL != "" && cfg.OCSPResponderCert == nil {
+		return errors.New("an Ed25519 platform CA key requires a delegated OCSP responder")
+	}
+
+	return nil
+}
+
+// loadKeyFile reads an RSA, ECDSA or Ed25519 private key from a PEM file in
+// PKCS #8, PKCS #1 or SEC 1 form.
+func loadKeyFile(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in %s", file)
+	}
+
+	var key any
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported private key in %s", file)
+}
@@ -0,0 +1,77 @@
+//go:build cgo
+
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+
+package casigner
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+)
+
+// openPKCS11Signer finds the key pair labelled PKCS11KeyLabel on the PKCS #11
+// token labelled PKCS11TokenLabel. The returned closer ends the session.
+func openPKCS11Signer(cfg provisioner.Config) (crypto.Signer, io.Closer, error) {
+	pin := ""
+
+	if cfg.PKCS11PINFile != "" {
+		data, err := os.ReadFile(filepath.Clean(cfg.PKCS11PINFile))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pin = strings.TrimSpace(string(data))
+	}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       cfg.PKCS11Module,
+		TokenLabel: cfg.PKCS11TokenLabel,
+		Pin:        pin,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open PKCS #11 token %q: %w", cfg.PKCS11TokenLabel, err)
+	}
+
+	signer, err := ctx.FindKeyPair(nil, []byte(cfg.PKCS11KeyLabel))
+	if err == nil && signer == nil {
+		err = fmt.Errorf("key pair %q not found", cfg.PKCS11KeyLabel)
+	}
+
+	if err != nil {
+		ctx.Close()
+		return nil, nil, fmt.Errorf("PKCS #11 token %q: %w", cfg.PKCS11TokenLabel, err)
+	}
+
+	return signer, ctx, nil
+}
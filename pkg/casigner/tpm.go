@@ -0,0 +1,140 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package casigner
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/provisioner"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// openTPMSigner opens the TPM device and returns the signer of the key at
+// TPMKeyHandle. The returned closer closes the device.
+func openTPMSigner(cfg provisioner.Config) (crypto.Signer, io.Closer, error) {
+	device := cfg.TPMDevice
+	if device == "" {
+		device = provisioner.DefaultTPMDevice
+	}
+
+	rw, err := tpm2.OpenTPM(device)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, err := NewTPMSigner(rw, tpmutil.Handle(cfg.TPMKeyHandle))
+	if err != nil {
+		rw.Close()
+		return nil, nil, err
+	}
+
+	return signer, rw, nil
+}
+
+// tpmSigner signs digests with a TPM resident RSA or ECC key.
+type tpmSigner struct {
+	mu     sync.Mutex
+	rw     io.ReadWriter
+	handle tpmutil.Handle
+	pub    crypto.PublicKey
+}
+
+// NewTPMSigner returns a signer for the unrestricted signing key at the
+// persistent handle of the TPM rw. The key must not require authorization.
+func NewTPMSigner(rw io.ReadWriter, handle tpmutil.Handle) (crypto.Signer, error) {
+	public, _, _, err := tpm2.ReadPublic(rw, handle)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read TPM key 0x%x: %w", uint32(handle), err)
+	}
+
+	if public.Attributes&tpm2.FlagSign == 0 || public.Attributes&tpm2.FlagRestricted != 0 {
+		return nil, fmt.Errorf("TPM key 0x%x is not an unrestricted signing key", uint32(handle))
+	}
+
+	pub, err := public.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tpmSigner{rw: rw, handle: handle, pub: pub}, nil
+}
+
+// Public returns the public key of the TPM key.
+func (s *tpmSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs digest with the TPM key, using PKCS #1 v1.5 for RSA keys.
+func (s *tpmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := tpm2.HashToAlgorithm(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := &tpm2.SigScheme{Hash: hash}
+
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, errors.New("RSA-PSS signatures are not supported by TPM CA keys")
+		}
+
+		scheme.Alg = tpm2.AlgRSASSA
+	case *ecdsa.PublicKey:
+		scheme.Alg = tpm2.AlgECDSA
+	default:
+		return nil, fmt.Errorf("unsupported TPM key type %T", s.pub)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sig, err := tpm2.Sign(s.rw, s.handle, "", digest, nil, scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	if sig.RSA != nil {
+		return sig.RSA.Signature, nil
+	}
+
+	if sig.ECC == nil {
+		return nil, errors.New("TPM returned no signature")
+	}
+
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{sig.ECC.R, sig.ECC.S})
+}
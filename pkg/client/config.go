@@ -32,6 +32,9 @@ type Config struct {
 	OutputDir  string
 	URL        string
 	SocketPath string
+	// GRPCAddress selects the gRPC Enrollment service instead of the REST api.
+	GRPCAddress   string
+	GRPCPlaintext bool
 }
 
 // ParseConfig parses a configuration file and returns the Config.
@@ -48,6 +51,9 @@ func ParseConfig(path string, file string) (Config, error) {
 		OutputDir:  viper.GetString("OutputDir"),
 		URL:        viper.GetString("URL"),
 		SocketPath: viper.GetString("socketPath"),
+
+		GRPCAddress:   viper.GetString("grpcAddress"),
+		GRPCPlaintext: viper.GetBool("grpcPlaintext"),
 	}
 
 	return cfg, nil
@@ -0,0 +1,144 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/pkg/devid"
+	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/proto/enrollapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// DialEnrollment connects to the tpm-provisioner gRPC Enrollment service.
+// Plaintext connections are only meant for use behind a service mesh.
+func DialEnrollment(address string, plaintext bool) (*grpc.ClientConn, error) {
+	creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	if plaintext {
+		creds = insecure.NewCredentials()
+	}
+
+	return grpc.Dial(address, grpc.WithTransportCredentials(creds))
+}
+
+// Enroll requests a DevID certificate over the gRPC Enrollment service. The
+// whole enrollment runs over a single stream. It returns the DER encoded DevID
+// and AK certificates and the TPM resources the certificates were issued for.
+func Enroll(ctx context.Context, conn grpc.ClientConnInterface, rw io.ReadWriter, xname string, nodeType string, pi pkix.Name, jwt string) (
+	devIDCert []byte, akCert []byte, resources *devid.RequestResources, err error,
+) {
+	data, sig, res, err := CreateRawRequest(ctx, rw, pi)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	defer func() {
+		// Flush contexts on error
+		if err != nil {
+			res.Flush()
+		}
+	}()
+
+	md := metadata.Pairs("xname", xname, "type", nodeType)
+	if jwt != "" {
+		md.Set("authorization", fmt.Sprintf("Bearer %s", jwt))
+	}
+
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, md))
+	defer cancel()
+
+	stream, err := enrollapi.NewEnrollmentClient(conn).Enroll(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	err = stream.Send(&enrollapi.EnrollRequest{
+		RequestOrResponse: &enrollapi.EnrollRequest_SigningRequest{
+			SigningRequest: &enrollapi.RawSigningRequest{
+				Data:      data,
+				Signature: sig,
+			},
+		},
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("sending signing request failed: %w", err)
+	}
+
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("receiving challenge failed: %w", err)
+	}
+
+	challenge := resp.GetChallenge()
+	if challenge == nil {
+		return nil, nil, nil, errors.New("expected a challenge")
+	}
+
+	challengeResponse, err := GenerateChallengeResponse(
+		rw,
+		base64.RawStdEncoding.EncodeToString(challenge.GetCredentialBlob()),
+		base64.RawStdEncoding.EncodeToString(challenge.GetSecret()),
+		res,
+	)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("generating challenge response failed: %w", err)
+	}
+
+	err = stream.Send(&enrollapi.EnrollRequest{
+		RequestOrResponse: &enrollapi.EnrollRequest_ChallengeResponse{
+			ChallengeResponse: challengeResponse,
+		},
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("sending challenge response failed: %w", err)
+	}
+
+	resp, err = stream.Recv()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("receiving signing response failed: %w", err)
+	}
+
+	signingResponse := resp.GetSigningResponse()
+	if signingResponse == nil || len(signingResponse.GetDevIDCertificate()) == 0 {
+		return nil, nil, nil, errors.New("expected a DevID certificate")
+	}
+
+	err = stream.CloseSend()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return signingResponse.GetDevIDCertificate(), signingResponse.GetAttestationCertificate(), res, nil
+}
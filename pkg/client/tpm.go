@@ -87,8 +87,9 @@ func CreateRawRequest(ctx context.Context, rw io.ReadWriter, pi pkix.Name) (data
 }
 
 // WriteDevID writes the devid certificate and the public and private blob files
-// to the specificed directory.
-func WriteDevID(outputDir string, resources *devid.RequestResources, devIDCert []byte) error {
+// to the specificed directory. When akCert is set the AK certificate and blob
+// files are written next to them.
+func WriteDevID(outputDir string, resources *devid.RequestResources, devIDCert []byte, akCert []byte) error {
 	var devIDCertPem bytes.Buffer
 
 	err := pem.Encode(&devIDCertPem, &pem.Block{
@@ -124,5 +125,34 @@ func WriteDevID(outputDir string, resources *devid.RequestResources, devIDCert [
 		return fmt.Errorf("writing DevID private key at %q failed: %w", outputDir, err)
 	}
 
+	if len(akCert) == 0 {
+		return nil
+	}
+
+	var akCertPem bytes.Buffer
+
+	err = pem.Encode(&akCertPem, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: akCert,
+	})
+	if err != nil {
+		return fmt.Errorf("AK certificate PEM encoding failed: %w", err)
+	}
+
+	err = os.WriteFile(outputDir+"/ak.crt.pem", akCertPem.Bytes(), os.FileMode(0o600))
+	if err != nil {
+		return fmt.Errorf("writing AK certificate at %q failed: %w", outputDir, err)
+	}
+
+	err = os.WriteFile(outputDir+"/ak.pub.blob", resources.Attestation.PublicBlob, os.FileMode(0o600))
+	if err != nil {
+		return fmt.Errorf("writing AK public key at %q failed: %w", outputDir, err)
+	}
+
+	err = os.WriteFile(outputDir+"/ak.priv.blob", resources.Attestation.PrivateBlob, os.FileMode(0o600))
+	if err != nil {
+		return fmt.Errorf("writing AK private key at %q failed: %w", outputDir, err)
+	}
+
 	return nil
 }
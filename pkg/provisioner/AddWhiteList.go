@@ -28,7 +28,10 @@ package provisioner
 import (
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // AddWhiteListResponse  contains the response structure for the add whitelist
@@ -38,7 +41,7 @@ type AddWhiteListResponse struct {
 	Reason  string `json:"reason,omitempty"`
 }
 
-// AddWhiteList handles the add xname regexp to white list api endpoint.
+// AddWhiteList handles the add xname pattern to white list api endpoint.
 func AddWhiteList(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -46,20 +49,14 @@ func AddWhiteList(w http.ResponseWriter, r *http.Request) {
 
 	var resp AddWhiteListResponse
 
-	err := AddWhiteListItem(CFG.WhiteList, str)
-	if err != nil {
-		resp = AddWhiteListResponse{
-			Success: false,
-			Reason:  err.Error(),
-		}
-
-		w.WriteHeader(http.StatusInternalServerError)
-
-		err = json.NewEncoder(w).Encode(resp)
-		if err != nil {
-			log.Printf("Error encoding json response: %v", err)
-		}
+	entry, err := whiteListEntryFromForm(r)
+	if err == nil {
+		err = AddWhiteListItem(CFG.WhiteList, entry)
+	}
+	auditRequest(r, AuditEvent{Event: AuditWhiteListAdd, Details: map[string]string{"pattern": str}}, err)
 
+	if err != nil {
+		sendResponseError(w, err)
 		return
 	}
 
@@ -74,3 +71,69 @@ func AddWhiteList(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error encoding json response: %v", err)
 	}
 }
+
+// whiteListEntryFromForm returns the white list entry of the xname,
+// patternType, type, notBefore, notAfter and comment form values. Several
+// node types may be given as repeated or comma separated type values.
+func whiteListEntryFromForm(r *http.Request) (WhiteListEntry, error) {
+	entry := WhiteListEntry{
+		Pattern:   r.FormValue("xname"),
+		Type:      r.FormValue("patternType"),
+		CreatedBy: requestActor(r),
+		CreatedAt: time.Now().UTC(),
+		Comment:   r.FormValue("comment"),
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return entry, apiError(CodeBadRequest, err)
+	}
+
+	for _, v := range r.Form["type"] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				entry.NodeTypes = append(entry.NodeTypes, t)
+			}
+		}
+	}
+
+	for _, f := range []struct {
+		key string
+		t   **time.Time
+	}{
+		{"notBefore", &entry.NotBefore},
+		{"notAfter", &entry.NotAfter},
+	} {
+		v := r.FormValue(f.key)
+		if v == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return entry, apiErrorf(CodeBadRequest, "invalid %s: %w", f.key, err)
+		}
+
+		*f.t = &t
+	}
+
+	return entry, nil
+}
+
+// requestActor returns who made an admin request, the authenticated admin
+// caller, the subject of its bearer token or else its source IP.
+func requestActor(r *http.Request) string {
+	if id := AdminIdentityFromContext(r.Context()); id != nil {
+		return id.Name
+	}
+
+	if sub := bearerSubject(r.Header.Get("Authorization")); sub != "" {
+		return sub
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
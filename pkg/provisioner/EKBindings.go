@@ -0,0 +1,158 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+var errMissingXname = apiError(CodeBadRequest, errors.New("missing xname"))
+
+// GetEKBindings returns the EK bindings, or only the binding of the xname path
+// or form value when it is set.
+func GetEKBindings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if Issued == nil {
+		sendResponseError(w, errLedgerDisabled)
+		return
+	}
+
+	var (
+		v   any
+		err error
+	)
+
+	if xname := pathOrFormValue(r, "xname"); xname != "" {
+		v, err = Issued.Binding(xname)
+	} else {
+		v, err = Issued.Bindings()
+	}
+
+	if errors.Is(err, errNotFound) {
+		err = apiErrorf(CodeNotFound, "binding not found")
+	}
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Error encoding json response: %v", err)
+	}
+}
+
+// SetEKBinding binds the xname form value to the ek form value, a SHA-256 EK
+// certificate fingerprint. It pre-seeds a binding or rebinds an xname to a
+// replacement TPM.
+func SetEKBinding(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	err := setEKBinding(r.FormValue("xname"), r.FormValue("ek"))
+	auditRequest(r, AuditEvent{Event: AuditBindingSet, Xname: r.FormValue("xname"), EKFingerprint: normalizeHex(r.FormValue("ek"))}, err)
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	sendSuccess(w)
+}
+
+// setEKBinding binds xname to the EK with the SHA-256 fingerprint.
+func setEKBinding(xname string, fingerprint string) error {
+	if Issued == nil {
+		return errLedgerDisabled
+	}
+
+	fingerprint = normalizeHex(fingerprint)
+
+	if xname == "" {
+		return errMissingXname
+	}
+
+	err := validateFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	err = Issued.SetBinding(EKBinding{
+		Xname:         xname,
+		EKFingerprint: fingerprint,
+		BoundAt:       time.Now().UTC(),
+		Source:        BindingSourceAdmin,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Bound %s to EK %s", xname, fingerprint)
+
+	return nil
+}
+
+// ClearEKBinding removes the binding of the xname form value.
+func ClearEKBinding(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	err := clearEKBinding(r.FormValue("xname"))
+	auditRequest(r, AuditEvent{Event: AuditBindingClear, Xname: r.FormValue("xname")}, err)
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	sendSuccess(w)
+}
+
+// clearEKBinding removes the binding of xname.
+func clearEKBinding(xname string) error {
+	if Issued == nil {
+		return errLedgerDisabled
+	}
+
+	if xname == "" {
+		return errMissingXname
+	}
+
+	err := Issued.ClearBinding(xname)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Cleared the EK binding of %s", xname)
+
+	return nil
+}
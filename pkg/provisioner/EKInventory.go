@@ -0,0 +1,186 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// ImportInventoryResponse contains the response structure for the EK
+// inventory import api request.
+type ImportInventoryResponse struct {
+	Success  bool   `json:"success"`
+	Reason   string `json:"reason,omitempty"`
+	Imported int    `json:"imported"`
+}
+
+// inventoryFormat returns the import format of the format form value or the
+// request content type.
+func inventoryFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "text/csv":
+		return InventoryFormatCSV
+	case "application/json":
+		return InventoryFormatJSON
+	default:
+		return InventoryFormatPEM
+	}
+}
+
+// ImportEKInventory imports an EK inventory from the request body.
+func ImportEKInventory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if Issued == nil {
+		sendResponseError(w, errLedgerDisabled)
+		return
+	}
+
+	entries, err := ParseEKInventory(inventoryFormat(r), http.MaxBytesReader(w, r.Body, 32<<20))
+	if err != nil {
+		auditRequest(r, AuditEvent{Event: AuditInventoryImport}, err)
+		sendResponseError(w, apiError(CodeBadRequest, err))
+
+		return
+	}
+
+	err = Issued.AddInventory(entries)
+	auditRequest(r, AuditEvent{Event: AuditInventoryImport, Details: map[string]string{"count": strconv.Itoa(len(entries))}}, err)
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	log.Printf("Imported %d EKs into the inventory", len(entries))
+
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(ImportInventoryResponse{Success: true, Imported: len(entries)})
+	if err != nil {
+		log.Printf("Error encoding json response: %v", err)
+	}
+}
+
+// GetEKInventory returns the EK inventory, or only the entry of the
+// fingerprint path value or ek form value when it is set.
+func GetEKInventory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if Issued == nil {
+		sendResponseError(w, errLedgerDisabled)
+		return
+	}
+
+	var (
+		v   any
+		err error
+	)
+
+	ek := mux.Vars(r)["fingerprint"]
+	if ek == "" {
+		ek = r.FormValue("ek")
+	}
+
+	if ek != "" {
+		v, err = Issued.InventoryEntry(normalizeHex(ek))
+	} else {
+		v, err = Issued.Inventory()
+	}
+
+	if errors.Is(err, errNotFound) {
+		err = apiErrorf(CodeNotFound, "EK not found")
+	}
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Error encoding json response: %v", err)
+	}
+}
+
+// RemoveEKInventory removes the ek form value from the EK inventory.
+func RemoveEKInventory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if Issued == nil {
+		sendResponseError(w, errLedgerDisabled)
+		return
+	}
+
+	err := removeEKInventory(r.FormValue("ek"))
+	auditRequest(r, AuditEvent{Event: AuditInventoryRemove, EKFingerprint: normalizeHex(r.FormValue("ek"))}, err)
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	sendSuccess(w)
+}
+
+// removeEKInventory removes the EK with the SHA-256 fingerprint from the
+// inventory.
+func removeEKInventory(fingerprint string) error {
+	if Issued == nil {
+		return errLedgerDisabled
+	}
+
+	fingerprint = normalizeHex(fingerprint)
+
+	err := validateFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	err = Issued.RemoveInventory(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Removed EK %s from the inventory", fingerprint)
+
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var errLedgerDisabled = apiError(CodeNotEnabled, errors.New("issuance ledger is not enabled"))
+
+// ListIssuedByXname returns the certificates issued to an xname.
+func ListIssuedByXname(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if Issued == nil {
+		sendResponseError(w, errLedgerDisabled)
+		return
+	}
+
+	recs, err := Issued.ByXname(mux.Vars(r)["xname"])
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	sendIssued(w, recs)
+}
+
+// ListIssuedByEK returns the certificates issued for an EK. The EK is
+// identified by the SHA-256 fingerprint of its certificate.
+func ListIssuedByEK(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if Issued == nil {
+		sendResponseError(w, errLedgerDisabled)
+		return
+	}
+
+	recs, err := Issued.ByEK(normalizeHex(mux.Vars(r)["fingerprint"]))
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	sendIssued(w, recs)
+}
+
+// GetIssuedBySerial returns the certificate with a hex encoded serial number.
+func GetIssuedBySerial(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if Issued == nil {
+		sendResponseError(w, errLedgerDisabled)
+		return
+	}
+
+	rec, err := Issued.BySerial(normalizeHex(mux.Vars(r)["serial"]))
+	if errors.Is(err, errNotFound) {
+		err = apiErrorf(CodeNotFound, "certificate not found")
+	}
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	sendIssued(w, rec)
+}
+
+// sendIssued sends ledger records.
+func sendIssued(w http.ResponseWriter, v any) {
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("error encoding the response: %v", err)
+	}
+}
+
+// normalizeHex lower cases a hex string and removes colon separators.
+func normalizeHex(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, ":", ""))
+}
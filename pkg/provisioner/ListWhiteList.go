@@ -31,13 +31,13 @@ import (
 	"net/http"
 )
 
-// ListWhiteList returns a list of the xname regexp.
+// ListWhiteList returns the white list entries.
 func ListWhiteList(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
 	w.WriteHeader(http.StatusOK)
 
-	err := json.NewEncoder(w).Encode(WhiteList)
+	err := json.NewEncoder(w).Encode(WhiteListEntries())
 	if err != nil {
 		log.Printf("Failed to decode whitelist: %v", err)
 	}
@@ -46,19 +46,10 @@ func RemoveWhiteList(w http.ResponseWriter, r *http.Request) {
 	var resp RemoveWhiteListResponse
 
 	err := RemoveWhiteListItem(CFG.WhiteList, str)
-	if err != nil {
-		resp = RemoveWhiteListResponse{
-			Success: false,
-			Reason:  err.Error(),
-		}
-
-		w.WriteHeader(http.StatusInternalServerError)
-
-		err = json.NewEncoder(w).Encode(resp)
-		if err != nil {
-			log.Printf("Error encoding response: %v", err)
-		}
+	auditRequest(r, AuditEvent{Event: AuditWhiteListRemove, Details: map[string]string{"pattern": str}}, err)
 
+	if err != nil {
+		sendResponseError(w, err)
 		return
 	}
 
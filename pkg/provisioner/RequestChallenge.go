@@ -29,8 +29,6 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-
-	"github.com/cray-hpe/tpm-provisioner/pkg/verify"
 )
 
 // CertificateResponse contains the response structure for the certificate
@@ -52,7 +50,29 @@ type CertificateRequest struct {
 func RequestChallenge(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
-	err := validateCookie(r.Cookies(), 1)
+	var (
+		session     Session
+		fingerprint string
+		err         error
+	)
+
+	defer func() {
+		auditRequest(r, AuditEvent{Event: AuditChallengeRequest, Xname: session.xname, EKFingerprint: fingerprint}, err)
+	}()
+
+	token, err := sessionToken(r)
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	err = authenticateSession(r, token)
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	token, session, err = Sessions.Advance(token, 1)
 	if err != nil {
 		sendResponseError(w, err)
 		return
@@ -64,35 +84,56 @@ func RequestChallenge(w http.ResponseWriter, r *http.Request) {
 
 	err = decoder.Decode(&data)
 	if err != nil {
-		sendResponseError(w, err)
+		sendResponseError(w, apiError(CodeBadRequest, err))
+		return
+	}
+
+	err = validateRequest(data.Data, data.Sig)
+	if err != nil {
+		sendResponseError(w, apiError(CodeEKUntrusted, err))
+		return
+	}
+
+	ek, err := endorsementCertificate(data.Data)
+	if err != nil {
+		sendResponseError(w, apiError(CodeBadRequest, err))
 		return
 	}
 
-	err = verify.ValidateRequest(data.Data, data.Sig, CFG.ManufactuerCAs)
+	fingerprint = EKFingerprint(ek)
+
+	err = Limiter.AllowEK(fingerprint)
 	if err != nil {
 		sendResponseError(w, err)
 		return
 	}
 
-	blob, secret, nonce, err := CreateChallenge(data.Data)
+	err = checkEKInventory(session.xname, fingerprint)
 	if err != nil {
 		sendResponseError(w, err)
 		return
 	}
 
-	err = setNonce(r.Cookies(), nonce)
+	err = checkEKBinding(session.xname, fingerprint)
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
 
+	blob, secret, nonce, err := CreateChallenge(data.Data)
 	if err != nil {
 		sendResponseError(w, err)
 		return
 	}
 
-	err = setReqData(r.Cookies(), data.Data)
+	token, err = Sessions.SetChallenge(token, nonce, data.Data)
 	if err != nil {
 		sendResponseError(w, err)
 		return
 	}
 
+	setSessionCookie(w, token, session.expiry)
+
 	certResp := CertificateResponse{
 		Success: true,
 		Blob:    blob,
@@ -0,0 +1,201 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// revocationReasons maps the RFC 5280 CRLReason names to their codes.
+// Revocations are permanent, so certificateHold is not accepted, and
+// removeFromCRL is only valid in delta CRLs.
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"cACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"privilegeWithdrawn":   9,
+	"aACompromise":         10,
+}
+
+// RevokeResponse contains the response structure for the revoke api request.
+type RevokeResponse struct {
+	Success bool     `json:"success"`
+	Reason  string   `json:"reason,omitempty"`
+	Revoked []string `json:"revoked,omitempty"`
+}
+
+// parseRevocationReason parses an RFC 5280 reason code given by name or
+// number. An empty reason is unspecified.
+func parseRevocationReason(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	if code, ok := revocationReasons[s]; ok {
+		return code, nil
+	}
+
+	code, err := strconv.Atoi(s)
+	if err == nil {
+		for _, c := range revocationReasons {
+			if c == code {
+				return code, nil
+			}
+		}
+	}
+
+	return 0, apiErrorf(CodeBadRequest, "invalid revocation reason %q", s)
+}
+
+// RevokeCertificate handles the revoke api endpoint. Certificates are selected
+// by exactly one of the serial, xname or ek (SHA-256 fingerprint) form values.
+// Every certificate issued to an xname or EK is revoked.
+func RevokeCertificate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if Issued == nil {
+		sendResponseError(w, errLedgerDisabled)
+		return
+	}
+
+	reason, err := parseRevocationReason(r.FormValue("reason"))
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	revoked, err := revokeCertificates(r.FormValue("serial"), r.FormValue("xname"), r.FormValue("ek"), reason)
+	auditRevoke(r, r.FormValue("serial"), r.FormValue("xname"), r.FormValue("ek"), reason, revoked, err)
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(RevokeResponse{Success: true, Revoked: revoked})
+	if err != nil {
+		log.Printf("Error encoding json response: %v", err)
+	}
+}
+
+// revokeCertificates revokes the certificates selected by exactly one of the
+// serial, xname or ek (SHA-256 fingerprint) and regenerates the CRL. It
+// returns the revoked serial numbers.
+func revokeCertificates(serial string, xname string, ek string, reason int) ([]string, error) {
+	if Issued == nil {
+		return nil, errLedgerDisabled
+	}
+
+	serial = normalizeHex(serial)
+	ek = normalizeHex(ek)
+
+	var (
+		serials []string
+		err     error
+	)
+
+	switch {
+	case serial != "" && xname == "" && ek == "":
+		serials = []string{serial}
+	case xname != "" && serial == "" && ek == "":
+		serials, err = issuedSerials(Issued.ByXname(xname))
+	case ek != "" && serial == "" && xname == "":
+		serials, err = issuedSerials(Issued.ByEK(ek))
+	default:
+		err = apiError(CodeBadRequest, errors.New("exactly one of serial, xname or ek is required"))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	revoked := []string{}
+
+	for _, s := range serials {
+		_, err = Issued.Revoke(s, reason, now)
+		if err != nil {
+			return revoked, fmt.Errorf("revoking %s: %w", s, err)
+		}
+
+		log.Printf("Revoked certificate %s with reason %d", s, reason)
+
+		revoked = append(revoked, s)
+	}
+
+	purgeOCSPCache()
+
+	err = GenerateCRL(CFG.CRLInterval)
+	if err != nil {
+		log.Printf("Unable to generate CRL: %v", err)
+	}
+
+	return revoked, nil
+}
+
+// auditRevoke audits a revocation request.
+func auditRevoke(r *http.Request, serial string, xname string, ek string, reason int, revoked []string, err error) {
+	auditRequest(r, AuditEvent{
+		Event:         AuditRevoke,
+		Xname:         xname,
+		EKFingerprint: normalizeHex(ek),
+		Details: map[string]string{
+			"serial":  normalizeHex(serial),
+			"reason":  strconv.Itoa(reason),
+			"revoked": strings.Join(revoked, ","),
+		},
+	}, err)
+}
+
+// issuedSerials returns the serial numbers of the certificates that have not
+// been revoked yet.
+func issuedSerials(recs []IssuedCertificate, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	serials := []string{}
+
+	for _, rec := range recs {
+		if rec.RevokedAt == nil {
+			serials = append(serials, rec.Serial)
+		}
+	}
+
+	return serials, nil
+}
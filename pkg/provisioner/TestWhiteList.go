@@ -0,0 +1,62 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"net/http"
+)
+
+// TestWhiteListResponse contains the response for the test white list api.
+type TestWhiteListResponse struct {
+	Xname string `json:"xname"`
+	// Allowed reports whether an entry allows the xname to enroll now.
+	Allowed bool             `json:"allowed"`
+	Matches []WhiteListMatch `json:"matches"`
+}
+
+// TestWhiteList returns the white list entries matching the xname form value
+// and whether they allow it to enroll, as the node type form value when set.
+func TestWhiteList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	name := r.FormValue("xname")
+
+	matches, err := MatchWhiteList(name, r.FormValue("type"))
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	resp := TestWhiteListResponse{Xname: name, Matches: matches}
+
+	for _, m := range matches {
+		if m.Allowed {
+			resp.Allowed = true
+		}
+	}
+
+	sendJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,588 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// Admin authentication modes.
+const (
+	AdminAuthModeOff      = "off"
+	AdminAuthModeRequired = "required"
+)
+
+// DefaultAdminRoleClaim is the JWT claim holding the roles of an admin caller
+// when none is configured, the Keycloak realm roles.
+const DefaultAdminRoleClaim = "realm_access.roles"
+
+// adminRoutePublic makes an admin route public in the adminRoutes overrides.
+const adminRoutePublic = "public"
+
+// Admin authentication methods.
+const (
+	AdminMethodMTLS  = "mtls"
+	AdminMethodJWT   = "jwt"
+	AdminMethodToken = "token"
+)
+
+// Role is an admin api role. Each role has the permissions of the roles
+// below it.
+type Role int
+
+// Admin api roles.
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleOperator
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleViewer:   "viewer",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+// String returns the name of the role.
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+
+	return "none"
+}
+
+// ParseRole returns the role named name.
+func ParseRole(name string) (Role, error) {
+	for role, n := range roleNames {
+		if strings.EqualFold(name, n) {
+			return role, nil
+		}
+	}
+
+	return RoleNone, fmt.Errorf("unknown role %q", name)
+}
+
+// adminRoutes maps the names of the admin routes to the role they require.
+// Routes not listed are public.
+var adminRoutes = map[string]Role{
+	"ListWhiteList":          RoleViewer,
+	"ListWhiteListV2":        RoleViewer,
+	"TestWhiteList":          RoleViewer,
+	"TestWhiteListV2":        RoleViewer,
+	"ListIssuedByXname":      RoleViewer,
+	"GetIssuedBySerial":      RoleViewer,
+	"ListIssuedByEK":         RoleViewer,
+	"ListIssuedV2":           RoleViewer,
+	"GetIssuedBySerialV2":    RoleViewer,
+	"GetEKBindings":          RoleViewer,
+	"GetEKBindingsV2":        RoleViewer,
+	"GetEKBindingV2":         RoleViewer,
+	"GetEKInventory":         RoleViewer,
+	"GetEKInventoryV2":       RoleViewer,
+	"GetEKInventoryEntryV2":  RoleViewer,
+	"AddWhiteList":           RoleOperator,
+	"RemoveWhiteList":        RoleOperator,
+	"PutWhiteListEntryV2":    RoleOperator,
+	"DeleteWhiteListEntryV2": RoleOperator,
+	"SetEKBinding":           RoleOperator,
+	"ClearEKBinding":         RoleOperator,
+	"PutEKBindingV2":         RoleOperator,
+	"DeleteEKBindingV2":      RoleOperator,
+	"ImportEKInventory":      RoleOperator,
+	"ImportEKInventoryV2":    RoleOperator,
+	"RemoveEKInventory":      RoleOperator,
+	"DeleteEKInventoryV2":    RoleOperator,
+	"RevokeCertificate":      RoleAdmin,
+	"CreateRevocationV2":     RoleAdmin,
+}
+
+// AdminIdentity is an authenticated admin api caller.
+type AdminIdentity struct {
+	Name string
+	Role Role
+	// Method is how the caller authenticated, mtls, jwt or token.
+	Method string
+}
+
+type adminIdentityKey struct{}
+
+// AdminIdentityFromContext returns the admin api caller of a request, or nil
+// when the request was not authenticated.
+func AdminIdentityFromContext(ctx context.Context) *AdminIdentity {
+	id, _ := ctx.Value(adminIdentityKey{}).(*AdminIdentity)
+
+	return id
+}
+
+// adminTokens is the static admin tokens file. Only the SHA-256 of each
+// token is stored.
+type adminTokens struct {
+	Tokens []struct {
+		Name   string `yaml:"name"`
+		Role   string `yaml:"role"`
+		SHA256 string `yaml:"sha256"`
+	} `yaml:"tokens"`
+}
+
+// AdminAuthenticator authenticates the callers of the admin routes with a
+// client certificate, a JWT signed by a key in a JWKS file or a static token,
+// and checks their role against the role the route requires.
+type AdminAuthenticator struct {
+	routes      map[string]Role
+	clientCerts map[string]Role
+	jwtRoles    map[string]Role
+	roleClaim   []string
+	issuer      string
+	audience    string
+	tokensFile  string
+	jwksFile    string
+
+	mu             sync.RWMutex
+	tokens         map[[sha256.Size]byte]AdminIdentity
+	tokensModified time.Time
+	jwks           *jose.JSONWebKeySet
+	jwksModified   time.Time
+}
+
+// AdminAuth is the authenticator used for the admin routes. A nil AdminAuth
+// does not authenticate admin callers.
+var AdminAuth *AdminAuthenticator
+
+// NewAdminAuthenticator returns the AdminAuthenticator configured by cfg. It
+// returns nil when the mode is off.
+func NewAdminAuthenticator(cfg Config) (*AdminAuthenticator, error) {
+	switch cfg.AdminAuthMode {
+	case AdminAuthModeOff:
+		return nil, nil
+	case "", AdminAuthModeRequired:
+	default:
+		return nil, fmt.Errorf("unknown admin auth mode %q", cfg.AdminAuthMode)
+	}
+
+	// Without an issuer any token signed by the JWKS keys would be accepted,
+	// including tokens the identity provider minted for other realms.
+	if cfg.AdminJWKS != "" && cfg.AdminJWTIssuer == "" {
+		return nil, errors.New("adminJWKS requires adminJWTIssuer")
+	}
+
+	a := &AdminAuthenticator{
+		routes:      map[string]Role{},
+		clientCerts: map[string]Role{},
+		jwtRoles:    map[string]Role{},
+		roleClaim:   strings.Split(cfg.AdminRoleClaim, "."),
+		issuer:      cfg.AdminJWTIssuer,
+		audience:    cfg.AdminJWTAudience,
+		tokensFile:  cfg.AdminTokens,
+		jwksFile:    cfg.AdminJWKS,
+	}
+
+	if cfg.AdminRoleClaim == "" {
+		a.roleClaim = strings.Split(DefaultAdminRoleClaim, ".")
+	}
+
+	for name, role := range adminRoutes {
+		a.routes[name] = role
+	}
+
+	if err := a.overrideRoutes(cfg.AdminRoutes); err != nil {
+		return nil, err
+	}
+
+	if err := addRoleMembers(a.clientCerts, cfg.AdminClientCerts); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.AdminJWTRoles) == 0 {
+		for role, name := range roleNames {
+			a.jwtRoles[name] = role
+		}
+	} else if err := addRoleMembers(a.jwtRoles, cfg.AdminJWTRoles); err != nil {
+		return nil, err
+	}
+
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+
+	if a.tokensFile == "" && a.jwksFile == "" && len(a.clientCerts) == 0 {
+		log.Printf("No admin authentication is configured, the admin routes reject every request")
+	}
+
+	return a, nil
+}
+
+// overrideRoutes sets the roles required by the routes in overrides, or makes
+// them public. Route names are matched case insensitively since the config
+// keys are lower cased.
+func (a *AdminAuthenticator) overrideRoutes(overrides map[string]string) error {
+	for key, value := range overrides {
+		name := ""
+
+		for _, route := range append(routes, v2Routes...) {
+			if strings.EqualFold(route.Name, key) {
+				name = route.Name
+				break
+			}
+		}
+
+		if name == "" {
+			return fmt.Errorf("unknown route %q in admin routes", key)
+		}
+
+		if strings.EqualFold(value, adminRoutePublic) {
+			delete(a.routes, name)
+			continue
+		}
+
+		role, err := ParseRole(value)
+		if err != nil {
+			return fmt.Errorf("route %s: %w", name, err)
+		}
+
+		a.routes[name] = role
+	}
+
+	return nil
+}
+
+// addRoleMembers adds the members of each role in roles to members. A member
+// of several roles gets the highest.
+func addRoleMembers(members map[string]Role, roles map[string][]string) error {
+	for name, names := range roles {
+		role, err := ParseRole(name)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range names {
+			if role > members[member] {
+				members[member] = role
+			}
+		}
+	}
+
+	return nil
+}
+
+// reload reads the tokens and JWKS files when they have changed since they
+// were last read.
+func (a *AdminAuthenticator) reload() error {
+	if a.tokensFile != "" {
+		if err := a.reloadTokens(); err != nil {
+			return fmt.Errorf("admin tokens: %w", err)
+		}
+	}
+
+	if a.jwksFile != "" {
+		if err := a.reloadJWKS(); err != nil {
+			return fmt.Errorf("admin JWKS: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (a *AdminAuthenticator) reloadTokens() error {
+	info, err := os.Stat(a.tokensFile)
+	if err != nil {
+		return err
+	}
+
+	a.mu.RLock()
+	current := a.tokens != nil && info.ModTime().Equal(a.tokensModified)
+	a.mu.RUnlock()
+
+	if current {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.tokensFile)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := parseAdminTokens(data)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.tokens = tokens
+	a.tokensModified = info.ModTime()
+	a.mu.Unlock()
+
+	log.Printf("Loaded %d admin tokens from %s", len(tokens), a.tokensFile)
+
+	return nil
+}
+
+func (a *AdminAuthenticator) reloadJWKS() error {
+	info, err := os.Stat(a.jwksFile)
+	if err != nil {
+		return err
+	}
+
+	a.mu.RLock()
+	current := a.jwks != nil && info.ModTime().Equal(a.jwksModified)
+	a.mu.RUnlock()
+
+	if current {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.jwksFile)
+	if err != nil {
+		return err
+	}
+
+	var jwks jose.JSONWebKeySet
+
+	if err = json.Unmarshal(data, &jwks); err != nil {
+		return err
+	}
+
+	for _, key := range jwks.Keys {
+		if !key.IsPublic() {
+			return fmt.Errorf("key %q is not a public key", key.KeyID)
+		}
+	}
+
+	a.mu.Lock()
+	a.jwks = &jwks
+	a.jwksModified = info.ModTime()
+	a.mu.Unlock()
+
+	log.Printf("Loaded %d admin JWT keys from %s", len(jwks.Keys), a.jwksFile)
+
+	return nil
+}
+
+// parseAdminTokens parses an admin tokens file into the identities keyed by
+// the SHA-256 of their token.
+func parseAdminTokens(data []byte) (map[[sha256.Size]byte]AdminIdentity, error) {
+	var file adminTokens
+
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	tokens := map[[sha256.Size]byte]AdminIdentity{}
+
+	for _, t := range file.Tokens {
+		if t.Name == "" {
+			return nil, errors.New("token without a name")
+		}
+
+		role, err := ParseRole(t.Role)
+		if err != nil {
+			return nil, fmt.Errorf("token %s: %w", t.Name, err)
+		}
+
+		var sum [sha256.Size]byte
+
+		if n, err := hex.Decode(sum[:], []byte(t.SHA256)); err != nil || n != sha256.Size {
+			return nil, fmt.Errorf("token %s: sha256 is not a hex encoded SHA-256", t.Name)
+		}
+
+		tokens[sum] = AdminIdentity{Name: t.Name, Role: role, Method: AdminMethodToken}
+	}
+
+	return tokens, nil
+}
+
+// Authenticate returns the admin caller of r, identified by a verified client
+// certificate whose common name has a role, or else by the bearer token.
+func (a *AdminAuthenticator) Authenticate(r *http.Request) (*AdminIdentity, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if role, ok := a.clientCerts[cn]; ok {
+			return &AdminIdentity{Name: cn, Role: role, Method: AdminMethodMTLS}, nil
+		}
+	}
+
+	token := bearerToken(r.Header.Get("Authorization"))
+	if token == "" {
+		return nil, apiErrorf(CodeUnauthenticated, "admin authentication required")
+	}
+
+	if err := a.reload(); err != nil {
+		// Keep using the last good tokens and keys, the files may be mid
+		// update.
+		log.Printf("Unable to reload admin credentials: %v", err)
+	}
+
+	a.mu.RLock()
+	jwks := a.jwks
+	id, ok := a.tokens[sha256.Sum256([]byte(token))]
+	a.mu.RUnlock()
+
+	if ok {
+		return &id, nil
+	}
+
+	if jwks != nil && strings.Count(token, ".") == 2 {
+		return a.authenticateJWT(token, jwks)
+	}
+
+	return nil, apiErrorf(CodeUnauthenticated, "invalid admin token")
+}
+
+// authenticateJWT validates a JWT signed by a key in jwks and returns the
+// caller with the highest role found in the role claim.
+func (a *AdminAuthenticator) authenticateJWT(token string, jwks *jose.JSONWebKeySet) (*AdminIdentity, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, apiErrorf(CodeUnauthenticated, "invalid admin JWT: %w", err)
+	}
+
+	var claims jwt.Claims
+
+	var raw map[string]any
+
+	if err = tok.Claims(jwks, &claims, &raw); err != nil {
+		return nil, apiErrorf(CodeUnauthenticated, "invalid admin JWT: %w", err)
+	}
+
+	if claims.Expiry == nil {
+		return nil, apiErrorf(CodeUnauthenticated, "admin JWT has no expiry")
+	}
+
+	expected := jwt.Expected{Issuer: a.issuer, Time: time.Now()}
+	if a.audience != "" {
+		expected.Audience = jwt.Audience{a.audience}
+	}
+
+	if err = claims.Validate(expected); err != nil {
+		return nil, apiErrorf(CodeUnauthenticated, "invalid admin JWT: %w", err)
+	}
+
+	id := &AdminIdentity{Name: claims.Subject, Method: AdminMethodJWT}
+	if username, ok := raw["preferred_username"].(string); ok && username != "" {
+		id.Name = username
+	}
+
+	for _, value := range claimValues(raw, a.roleClaim) {
+		if role := a.jwtRoles[value]; role > id.Role {
+			id.Role = role
+		}
+	}
+
+	return id, nil
+}
+
+// claimValues returns the string values of the claim at path, a list of
+// nested claim names.
+func claimValues(claims map[string]any, path []string) []string {
+	var v any = claims
+
+	for _, name := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		v = m[name]
+	}
+
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+
+		return values
+	}
+
+	return nil
+}
+
+// RequireAdmin authenticates the callers of the admin routes and rejects
+// those without the role the route requires. The caller is added to the
+// request context.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := AdminAuth
+		route := mux.CurrentRoute(r)
+
+		if a == nil || route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		required, ok := a.routes[route.GetName()]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := a.Authenticate(r)
+		if id != nil {
+			r = r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, id))
+
+			if id.Role < required {
+				err = apiErrorf(CodeForbidden, "%s requires the %s role, %s has %s", route.GetName(), required, id.Name, id.Role)
+			}
+		}
+
+		if err != nil {
+			log.Printf("%s %s rejected: %v", r.Method, r.RequestURI, err)
+			auditRequest(r, AuditEvent{
+				Event:   AuditAdminAuth,
+				Details: map[string]string{"route": route.GetName(), "role": required.String()},
+			}, err)
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			sendResponseError(w, err)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
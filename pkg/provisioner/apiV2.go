@@ -0,0 +1,296 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	_ "embed" // embeds the OpenAPI document
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OpenAPI is the OpenAPI 3 document of the v2 api.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// SessionRequest contains the request for the v2 create session api.
+type SessionRequest struct {
+	Xname string `json:"xname"`
+	Type  string `json:"type"`
+}
+
+// SessionResponse contains the response to the v2 create session api. The
+// session token is set in the session cookie.
+type SessionResponse struct {
+	Success   bool      `json:"success"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// RevokeRequest contains the request for the v2 revocation api. Exactly one
+// of Serial, Xname or EK selects the certificates to revoke.
+type RevokeRequest struct {
+	Serial string `json:"serial,omitempty"`
+	Xname  string `json:"xname,omitempty"`
+	EK     string `json:"ek,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// BindingRequest contains the request for the v2 set EK binding api.
+type BindingRequest struct {
+	EKFingerprint string `json:"ekFingerprint"`
+}
+
+// decodeJSON decodes the JSON request body into v.
+func decodeJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	return apiError(CodeBadRequest, decoder.Decode(v))
+}
+
+// sendJSON sends v with status.
+func sendJSON(w http.ResponseWriter, status int, v any) {
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Error encoding json response: %v", err)
+	}
+}
+
+// CreateSessionV2 authorizes an xname and starts its enrollment session.
+func CreateSessionV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var req SessionRequest
+
+	err := decodeJSON(r, &req)
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	expiresAt, err := startSession(w, r, req.Xname, req.Type)
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	sendJSON(w, http.StatusCreated, SessionResponse{Success: true, ExpiresAt: expiresAt})
+}
+
+// PutWhiteListEntryV2 sets the white list entry with the id from the optional
+// JSON body, replacing an existing entry.
+func PutWhiteListEntryV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var entry WhiteListEntry
+
+	err := decodeJSON(r, &entry)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	if err == nil {
+		entry.Pattern, err = whiteListPattern(mux.Vars(r)["id"])
+	}
+
+	entry.CreatedBy = requestActor(r)
+	entry.CreatedAt = time.Now().UTC()
+
+	created := false
+
+	if err == nil {
+		entry, created, err = PutWhiteListItem(CFG.WhiteList, entry)
+	}
+
+	auditRequest(r, AuditEvent{Event: AuditWhiteListAdd, Details: map[string]string{"pattern": entry.Pattern}}, err)
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	sendJSON(w, status, entry)
+}
+
+// DeleteWhiteListEntryV2 removes the white list entry with the id.
+func DeleteWhiteListEntryV2(w http.ResponseWriter, r *http.Request) {
+	pattern, err := whiteListPattern(mux.Vars(r)["id"])
+	if err == nil {
+		err = RemoveWhiteListItem(CFG.WhiteList, pattern)
+	}
+
+	auditRequest(r, AuditEvent{Event: AuditWhiteListRemove, Details: map[string]string{"pattern": pattern}}, err)
+
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		sendResponseError(w, err)
+
+		return
+	}
+
+	sendNoContent(w)
+}
+
+// ListIssuedV2 returns the certificates issued to the xname or for the ek
+// query value.
+func ListIssuedV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if Issued == nil {
+		sendResponseError(w, errLedgerDisabled)
+		return
+	}
+
+	xname := r.URL.Query().Get("xname")
+	ek := normalizeHex(r.URL.Query().Get("ek"))
+
+	var (
+		recs []IssuedCertificate
+		err  error
+	)
+
+	switch {
+	case xname != "" && ek == "":
+		recs, err = Issued.ByXname(xname)
+	case ek != "" && xname == "":
+		recs, err = Issued.ByEK(ek)
+	default:
+		err = apiError(CodeBadRequest, errors.New("exactly one of xname or ek is required"))
+	}
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	sendIssued(w, recs)
+}
+
+// CreateRevocationV2 revokes certificates.
+func CreateRevocationV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var req RevokeRequest
+
+	err := decodeJSON(r, &req)
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	reason, err := parseRevocationReason(req.Reason)
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	revoked, err := revokeCertificates(req.Serial, req.Xname, req.EK, reason)
+	auditRevoke(r, req.Serial, req.Xname, req.EK, reason, revoked, err)
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, RevokeResponse{Success: true, Revoked: revoked})
+}
+
+// PutEKBindingV2 binds an xname to an EK.
+func PutEKBindingV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var req BindingRequest
+
+	err := decodeJSON(r, &req)
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	err = setEKBinding(mux.Vars(r)["xname"], req.EKFingerprint)
+	auditRequest(r, AuditEvent{Event: AuditBindingSet, Xname: mux.Vars(r)["xname"], EKFingerprint: normalizeHex(req.EKFingerprint)}, err)
+
+	if err != nil {
+		sendResponseError(w, err)
+		return
+	}
+
+	sendSuccess(w)
+}
+
+// DeleteEKBindingV2 removes the EK binding of an xname.
+func DeleteEKBindingV2(w http.ResponseWriter, r *http.Request) {
+	err := clearEKBinding(mux.Vars(r)["xname"])
+	auditRequest(r, AuditEvent{Event: AuditBindingClear, Xname: mux.Vars(r)["xname"]}, err)
+
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		sendResponseError(w, err)
+
+		return
+	}
+
+	sendNoContent(w)
+}
+
+// DeleteEKInventoryV2 removes an EK from the inventory.
+func DeleteEKInventoryV2(w http.ResponseWriter, r *http.Request) {
+	err := removeEKInventory(mux.Vars(r)["fingerprint"])
+	auditRequest(r, AuditEvent{Event: AuditInventoryRemove, EKFingerprint: normalizeHex(mux.Vars(r)["fingerprint"])}, err)
+
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		sendResponseError(w, err)
+
+		return
+	}
+
+	sendNoContent(w)
+}
+
+// GetOpenAPI serves the OpenAPI document of the v2 api.
+func GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	_, err := w.Write(OpenAPI)
+	if err != nil {
+		log.Printf("Error writing the OpenAPI document: %v", err)
+	}
+}
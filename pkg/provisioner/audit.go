@@ -0,0 +1,343 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Audit event names.
+const (
+	AuditAuthorize        = "authorize"
+	AuditChallengeRequest = "challenge_request"
+	AuditEnroll           = "enroll"
+	AuditWhiteListAdd     = "whitelist_add"
+	AuditWhiteListRemove  = "whitelist_remove"
+	AuditRevoke           = "revoke"
+	AuditBindingSet       = "binding_set"
+	AuditBindingClear     = "binding_clear"
+	AuditInventoryImport  = "inventory_import"
+	AuditInventoryRemove  = "inventory_remove"
+	AuditAdminAuth        = "admin_auth"
+)
+
+// Audit event outcomes.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// requestIDHeader is the header carrying the request ID.
+const requestIDHeader = "X-Request-Id"
+
+// auditHashField is the JSON field holding the record hash. It is always the
+// last field of a record.
+const auditHashField = `,"hash":"`
+
+// AuditEvent is a record of the audit log.
+type AuditEvent struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	RequestID string    `json:"requestId,omitempty"`
+	SourceIP  string    `json:"sourceIp,omitempty"`
+	// ForwardedFor is the unverified X-Forwarded-For header of the request.
+	ForwardedFor string `json:"forwardedFor,omitempty"`
+	// Subject is the unverified subject of the request's bearer token.
+	Subject       string            `json:"subject,omitempty"`
+	Xname         string            `json:"xname,omitempty"`
+	EKFingerprint string            `json:"ekFingerprint,omitempty"`
+	Outcome       string            `json:"outcome"`
+	Reason        string            `json:"reason,omitempty"`
+	Details       map[string]string `json:"details,omitempty"`
+	// PrevHash is the hash of the previous record, empty for the first one.
+	PrevHash string `json:"prevHash"`
+}
+
+// AuditLog writes hash chained JSON lines audit events. Each record's hash is
+// the SHA-256 of the record without its hash field, and the record includes
+// the hash of the previous record, so edits, deletions and reordering break
+// the chain.
+type AuditLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	f    *os.File
+	seq  uint64
+	prev string
+}
+
+// Audit is the audit log. Auditing is disabled when it is nil.
+var Audit *AuditLog
+
+// OpenAuditLog opens the audit log at path for appending, continuing the hash
+// chain of its last record. The log is written to stdout when path is "-".
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if path == "-" {
+		return &AuditLog{w: os.Stdout}, nil
+	}
+
+	f, err := os.OpenFile(filepath.Clean(path), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AuditLog{w: f, f: f}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+
+	var last []byte
+
+	for scanner.Scan() {
+		last = append(last[:0], scanner.Bytes()...)
+	}
+
+	if err = scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if len(last) > 0 {
+		var ev AuditEvent
+
+		_, hash, err := splitAuditRecord(last)
+		if err == nil {
+			err = json.Unmarshal(last, &ev)
+		}
+
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading the last audit record: %w", err)
+		}
+
+		a.seq = ev.Seq
+		a.prev = hash
+	}
+
+	return a, nil
+}
+
+// Close closes the audit log file.
+func (a *AuditLog) Close() error {
+	if a.f == nil {
+		return nil
+	}
+
+	return a.f.Close()
+}
+
+// Write appends ev to the log, setting its sequence number, time and previous
+// record hash.
+func (a *AuditLog) Write(ev AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ev.Seq = a.seq + 1
+	ev.PrevHash = a.prev
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	ev.Time = ev.Time.UTC()
+
+	record, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.Sum256(record)
+	hash := hex.EncodeToString(h[:])
+
+	line := append(record[:len(record)-1], auditHashField+hash+"\"}\n"...)
+
+	if _, err = a.w.Write(line); err != nil {
+		return err
+	}
+
+	a.seq = ev.Seq
+	a.prev = hash
+
+	return nil
+}
+
+// splitAuditRecord returns the bytes a record's hash is computed over and the
+// hash recorded in it.
+func splitAuditRecord(line []byte) ([]byte, string, error) {
+	i := bytes.LastIndex(line, []byte(auditHashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", errors.New("missing hash")
+	}
+
+	hash := string(line[i+len(auditHashField) : len(line)-2])
+
+	return append(line[:i:i], '}'), hash, nil
+}
+
+// VerifyAuditLog checks the hash chain of the audit log read from r. The first
+// record must follow prevHash, empty for a log that starts with the first
+// record. It returns the number of records and the hash of the last one,
+// which can be kept to detect a later truncation of the log.
+func VerifyAuditLog(r io.Reader, prevHash string) (int, string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	var (
+		n   int
+		seq uint64
+	)
+
+	for scanner.Scan() {
+		n++
+
+		content, hash, err := splitAuditRecord(scanner.Bytes())
+		if err != nil {
+			return n, prevHash, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		h := sha256.Sum256(content)
+		if hex.EncodeToString(h[:]) != hash {
+			return n, prevHash, fmt.Errorf("line %d: record hash mismatch", n)
+		}
+
+		var ev AuditEvent
+
+		if err = json.Unmarshal(content, &ev); err != nil {
+			return n, prevHash, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		if ev.PrevHash != prevHash {
+			return n, prevHash, fmt.Errorf("line %d: chain broken, previous hash %q expected %q", n, ev.PrevHash, prevHash)
+		}
+
+		if seq != 0 && ev.Seq != seq+1 {
+			return n, prevHash, fmt.Errorf("line %d: sequence %d does not follow %d", n, ev.Seq, seq)
+		}
+
+		if prevHash == "" && ev.Seq != 1 {
+			return n, prevHash, fmt.Errorf("line %d: log does not start with the first record", n)
+		}
+
+		seq = ev.Seq
+		prevHash = hash
+	}
+
+	return n, prevHash, scanner.Err()
+}
+
+// WithRequestID sets a request ID on requests that do not carry one and
+// returns it in the response headers.
+func WithRequestID(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = uuid.NewString()
+			r.Header.Set(requestIDHeader, id)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// auditRequest writes ev for the request r with the outcome of err.
+func auditRequest(r *http.Request, ev AuditEvent, err error) {
+	ev.RequestID = r.Header.Get(requestIDHeader)
+	ev.ForwardedFor = r.Header.Get("X-Forwarded-For")
+	ev.Subject = bearerSubject(r.Header.Get("Authorization"))
+
+	if id := AdminIdentityFromContext(r.Context()); id != nil {
+		ev.Subject = id.Name
+	}
+
+	ev.SourceIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	if ev.SourceIP == "" {
+		ev.SourceIP = r.RemoteAddr
+	}
+
+	audit(ev, err)
+}
+
+// audit writes ev with the outcome of err.
+func audit(ev AuditEvent, err error) {
+	if Audit == nil {
+		return
+	}
+
+	ev.Outcome = AuditSuccess
+
+	if err != nil {
+		ev.Outcome = AuditFailure
+		ev.Reason = err.Error()
+	}
+
+	if err = Audit.Write(ev); err != nil {
+		log.Printf("ALERT: unable to write audit event %s: %v", ev.Event, err)
+	}
+}
+
+// bearerSubject returns the sub claim of the bearer token in the
+// Authorization header h without validating the token.
+func bearerSubject(h string) string {
+	parts := strings.Split(bearerToken(h), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+
+	if json.Unmarshal(payload, &claims) != nil {
+		return ""
+	}
+
+	return claims.Subject
+}
@@ -29,6 +29,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
 )
 
 // AuthorizeResponse provides the structure for the authorize response.
@@ -41,36 +42,58 @@ type AuthorizeResponse struct {
 func Authorize(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
-	xname := r.FormValue("xname")
-	nodeType := r.FormValue("type")
-
 	var resp AuthorizeResponse
 
-	log.Printf("Xname: %s  Type: %s", xname, nodeType)
-
-	if err := validateXname(xname); err != nil {
+	_, err := startSession(w, r, r.FormValue("xname"), r.FormValue("type"))
+	if err != nil {
 		sendResponseError(w, err)
 		return
 	}
 
-	sessionCookie, sessionExpiresAt := createSessionCookie(xname, nodeType)
-
-	http.SetCookie(w, &http.Cookie{
-		Name:    "session",
-		Value:   sessionCookie,
-		Expires: sessionExpiresAt,
-	})
-
 	w.WriteHeader(http.StatusOK)
 
 	resp = AuthorizeResponse{Success: true}
 
-	err := json.NewEncoder(w).Encode(resp)
+	err = json.NewEncoder(w).Encode(resp)
 	if err != nil {
 		log.Printf("error encoding the authorize response: %v", err)
 	}
+}
+
+// startSession authorizes xname, creates its session and sets the session
+// cookie. It returns when the session expires.
+func startSession(w http.ResponseWriter, r *http.Request, xname string, claimedType string) (_ time.Time, err error) {
+	log.Printf("Xname: %s  Type: %s", xname, claimedType)
+
+	nodeType := claimedType
+
+	defer func() {
+		auditRequest(r, AuditEvent{Event: AuditAuthorize, Xname: xname, Details: nodeTypeDetails(nodeType, claimedType)}, err)
+	}()
+
+	if nodeType, err = NodeTypes.Resolve(xname, claimedType); err != nil {
+		return time.Time{}, err
+	}
+
+	if err = validateXname(xname, nodeType); err != nil {
+		return time.Time{}, err
+	}
+
+	if err = checkComponent(r.Context(), xname, nodeType); err != nil {
+		return time.Time{}, err
+	}
+
+	if _, err = JWTAuth.Authenticate(r, xname, nodeType); err != nil {
+		log.Printf("JWT-SVID authentication failed for %s: %v", xname, err)
+		return time.Time{}, err
+	}
+
+	sessionCookie, sessionExpiresAt, err := Sessions.Create(xname, nodeType)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	setSessionCookie(w, sessionCookie, sessionExpiresAt)
 
-	session := sessions[sessionCookie]
-	session.step = 1
-	sessions[sessionCookie] = session
+	return sessionExpiresAt, nil
 }
@@ -0,0 +1,199 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Binding sources.
+const (
+	BindingSourceEnrollment = "enrollment"
+	BindingSourceAdmin      = "admin"
+)
+
+var (
+	bucketBindings = []byte("bindings")
+
+	errEKMismatch = apiError(CodeEKMismatch, errors.New("EK does not match the EK bound to the xname"))
+)
+
+// EKBinding binds an xname to the EK that first enrolled it.
+type EKBinding struct {
+	Xname         string    `json:"xname"`
+	EKFingerprint string    `json:"ekFingerprint"`
+	BoundAt       time.Time `json:"boundAt"`
+	Source        string    `json:"source"`
+}
+
+// Binding returns the EK binding of xname.
+func (l *Ledger) Binding(xname string) (EKBinding, error) {
+	var b EKBinding
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketBindings).Get([]byte(xname))
+		if data == nil {
+			return errNotFound
+		}
+
+		return json.Unmarshal(data, &b)
+	})
+
+	return b, err
+}
+
+// Bindings returns every EK binding.
+func (l *Ledger) Bindings() ([]EKBinding, error) {
+	bindings := []EKBinding{}
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBindings).ForEach(func(_, v []byte) error {
+			var b EKBinding
+
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+
+			bindings = append(bindings, b)
+
+			return nil
+		})
+	})
+
+	return bindings, err
+}
+
+// Bind binds xname to the EK fingerprint on first use. It fails with
+// errEKMismatch when xname is bound to a different EK.
+func (l *Ledger) Bind(xname string, fingerprint string) (EKBinding, error) {
+	var b EKBinding
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketBindings)
+
+		if data := bucket.Get([]byte(xname)); data != nil {
+			if err := json.Unmarshal(data, &b); err != nil {
+				return err
+			}
+
+			if b.EKFingerprint != fingerprint {
+				return errEKMismatch
+			}
+
+			return nil
+		}
+
+		b = EKBinding{
+			Xname:         xname,
+			EKFingerprint: fingerprint,
+			BoundAt:       time.Now().UTC(),
+			Source:        BindingSourceEnrollment,
+		}
+
+		return putBinding(bucket, b)
+	})
+
+	return b, err
+}
+
+// SetBinding creates or replaces the binding of b.Xname.
+func (l *Ledger) SetBinding(b EKBinding) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return putBinding(tx.Bucket(bucketBindings), b)
+	})
+}
+
+// ClearBinding removes the binding of xname so the next enrollment binds it
+// again.
+func (l *Ledger) ClearBinding(xname string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBindings).Delete([]byte(xname))
+	})
+}
+
+// putBinding stores b in the bindings bucket.
+func putBinding(bucket *bolt.Bucket, b EKBinding) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put([]byte(b.Xname), data)
+}
+
+// validateFingerprint validates a hex encoded SHA-256 fingerprint.
+func validateFingerprint(fingerprint string) error {
+	b, err := hex.DecodeString(fingerprint)
+	if err != nil || len(b) != 32 {
+		return apiErrorf(CodeBadRequest, "invalid EK fingerprint %q", fingerprint)
+	}
+
+	return nil
+}
+
+// checkEKBinding validates that the EK with the fingerprint may enroll xname.
+// Bindings are only enforced when the ledger is enabled.
+func checkEKBinding(xname string, fingerprint string) error {
+	if Issued == nil {
+		return nil
+	}
+
+	b, err := Issued.Binding(xname)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if b.EKFingerprint != fingerprint {
+		log.Printf("ALERT: EK binding mismatch for %s: bound to %s, presented %s", xname, b.EKFingerprint, fingerprint)
+		return errEKMismatch
+	}
+
+	return nil
+}
+
+// bindEK binds xname to the EK fingerprint on first enrollment.
+func bindEK(xname string, fingerprint string) error {
+	if Issued == nil {
+		return nil
+	}
+
+	b, err := Issued.Bind(xname, fingerprint)
+	if errors.Is(err, errEKMismatch) {
+		log.Printf("ALERT: EK binding mismatch for %s: bound to %s, presented %s", xname, b.EKFingerprint, fingerprint)
+	}
+
+	return err
+}
@@ -26,10 +26,12 @@
 package provisioner
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -38,12 +40,124 @@ import (
 type Config struct {
 	ManufactuerCAs *x509.CertPool
 	ProviderCA     *x509.Certificate
-	ProviderKey    *rsa.PrivateKey
+	// ProviderKey signs certificates, CRLs and OCSP responses with the
+	// platform CA key. It is opened by the server with casigner.New.
+	ProviderKey    crypto.Signer
 	Port           int
+	GRPCPort       int
 	WhiteList      string
 	SpireTokensURL string
+	SessionTTL     time.Duration
+	SessionMode    string
+	SessionKeys    string
+	JWTMode        string
+	JWTTrustDomain string
+	JWTBundle      string
+	JWTAudience    string
+	JWTIDTemplate  string
+	Ledger         string
+	CRLInterval    time.Duration
+	CRLURL         string
+	OCSPURL        string
+	OCSPCacheTTL   time.Duration
+	// OCSPResponderCert is a delegated OCSP responder certificate. OCSP
+	// responses are signed by the provider CA when it is nil.
+	OCSPResponderCert *x509.Certificate
+	OCSPResponderKey  crypto.Signer
+	EKInventoryMode   string
+	// AuditLog is the audit log file, "-" for stdout. Auditing is disabled
+	// when it is empty.
+	AuditLog string
+	// SourceRateLimit and XnameRateLimit are the requests per second allowed
+	// per source IP and per enrolling xname, zero for no limit.
+	SourceRateLimit       float64
+	SourceRateBurst       int
+	XnameRateLimit        float64
+	XnameRateBurst        int
+	RateLimitForwardedFor bool
+	// LockoutThreshold is the number of failed challenge responses after
+	// which an xname or EK is locked out for LockoutDuration, zero to never
+	// lock out.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// AdminAuthMode is off or required. When required the admin routes
+	// need a caller authenticated by client certificate, a JWT signed by a
+	// key in AdminJWKS or a static token in AdminTokens, with the role in
+	// AdminRoutes.
+	AdminAuthMode    string
+	AdminTokens      string
+	AdminJWKS        string
+	AdminJWTIssuer   string
+	AdminJWTAudience string
+	// AdminRoleClaim is the dotted path of the JWT claim with the caller's
+	// roles, AdminJWTRoles maps each role to the claim values granting it.
+	AdminRoleClaim string
+	AdminJWTRoles  map[string][]string
+	// AdminClientCerts maps each role to the client certificate common
+	// names granting it.
+	AdminClientCerts map[string][]string
+	// AdminRoutes overrides the role required by a route, or makes it
+	// public.
+	AdminRoutes map[string]string
+	// TLSCert and TLSKey serve the api over TLS, asking for client
+	// certificates issued by AdminClientCAs when set.
+	TLSCert        string
+	TLSKey         string
+	AdminClientCAs *x509.CertPool
+	// NodeTypeMode is off, verify or required. Unless off, the node type of
+	// an xname is derived from NodeTypeRules or the white list and a
+	// different node type claimed by the client is rejected.
+	NodeTypeMode  string
+	NodeTypeRules []NodeTypeRule
+	// HSMURL is the Hardware State Manager api, for example
+	// http://cray-smd/hsm/v2. When set, enrolling xnames must be enabled
+	// nodes in one of HSMStates, and the node type of their role in
+	// HSMRoles must match. HSMFailurePolicy is open or closed.
+	HSMURL           string
+	HSMFailurePolicy string
+	HSMCacheTTL      time.Duration
+	HSMTimeout       time.Duration
+	HSMStates        []string
+	HSMRoles         map[string]string
+	// CertProfiles are the certificate profiles by name, selected by the
+	// white list entry allowing an xname or by its node type.
+	CertProfiles map[string]CertProfile
+	// SPIFFEIDTemplate is the SPIFFE ID template, for example
+	// spiffe://shasta/{type}/{xname}, added as a URI SAN to the certificates
+	// of profiles that do not set their own.
+	SPIFFEIDTemplate string
+	// SubjectMode is client, override or reject. Unless client, the subject
+	// of issued certificates is built from the enrolling xname and node type
+	// and a different subject requested by the client is replaced or
+	// rejected.
+	SubjectMode string
+	// CAKeyBackend is file, pkcs11 or tpm. The platform CA key is read from
+	// CAKeyFile, found by PKCS11KeyLabel on the PKCS #11 token labelled
+	// PKCS11TokenLabel, or used at the persistent handle TPMKeyHandle of the
+	// TPM at TPMDevice.
+	CAKeyBackend     string
+	CAKeyFile        string
+	PKCS11Module     string
+	PKCS11TokenLabel string
+	PKCS11PINFile    string
+	PKCS11KeyLabel   string
+	TPMDevice        string
+	TPMKeyHandle     uint32
 }
 
+// CA key backends.
+const (
+	// CAKeyBackendFile reads the platform CA key from a PEM file.
+	CAKeyBackendFile = "file"
+	// CAKeyBackendPKCS11 signs with a key pair on a PKCS #11 token.
+	CAKeyBackendPKCS11 = "pkcs11"
+	// CAKeyBackendTPM signs with a key persisted in the TPM of the server.
+	CAKeyBackendTPM = "tpm"
+)
+
+// DefaultTPMDevice is the TPM device of the TPM CA key backend.
+const DefaultTPMDevice = "/dev/tpmrm0"
+
 // CFG stores the config in a global variable.
 var CFG Config
 
@@ -52,6 +166,24 @@ func ParseConfig(path string, file string) error {
 	viper.SetConfigName(file)
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(path)
+	viper.SetDefault("sessionTTL", DefaultSessionTTL)
+	viper.SetDefault("sessionMode", "memory")
+	viper.SetDefault("jwtMode", JWTModeOff)
+	viper.SetDefault("jwtTrustDomain", "shasta")
+	viper.SetDefault("jwtAudience", "system-compute")
+	viper.SetDefault("crlInterval", DefaultCRLInterval)
+	viper.SetDefault("ocspCacheTTL", DefaultOCSPCacheTTL)
+	viper.SetDefault("ekInventoryMode", EKInventoryModeOff)
+	viper.SetDefault("lockoutDuration", DefaultLockoutDuration)
+	viper.SetDefault("adminAuthMode", AdminAuthModeRequired)
+	viper.SetDefault("adminRoleClaim", DefaultAdminRoleClaim)
+	viper.SetDefault("nodeTypeMode", NodeTypeModeVerify)
+	viper.SetDefault("hsmFailurePolicy", HSMFailClosed)
+	viper.SetDefault("hsmCacheTTL", DefaultHSMCacheTTL)
+	viper.SetDefault("hsmTimeout", DefaultHSMTimeout)
+	viper.SetDefault("subjectMode", SubjectModeOverride)
+	viper.SetDefault("caKeyBackend", CAKeyBackendFile)
+	viper.SetDefault("tpmDevice", DefaultTPMDevice)
 
 	if err := viper.ReadInConfig(); err != nil {
 		return err
@@ -77,26 +209,159 @@ func ParseConfig(path string, file string) error {
 		return err
 	}
 
-	pKeyFile, err := os.ReadFile(viper.GetString("platformKey"))
-	if err != nil {
+	CFG = Config{
+		ManufactuerCAs: certPool,
+		ProviderCA:     platformCA,
+		Port:           viper.GetInt("port"),
+		GRPCPort:       viper.GetInt("grpcPort"),
+		WhiteList:      viper.GetString("whitelist"),
+		SpireTokensURL: viper.GetString("spiretokensurl"),
+		SessionTTL:     viper.GetDuration("sessionTTL"),
+		SessionMode:    viper.GetString("sessionMode"),
+		SessionKeys:    viper.GetString("sessionKeys"),
+		JWTMode:        viper.GetString("jwtMode"),
+		JWTTrustDomain: viper.GetString("jwtTrustDomain"),
+		JWTBundle:      viper.GetString("jwtBundle"),
+		JWTAudience:    viper.GetString("jwtAudience"),
+		JWTIDTemplate:  viper.GetString("jwtIDTemplate"),
+		Ledger:         viper.GetString("ledger"),
+		CRLInterval:    viper.GetDuration("crlInterval"),
+		CRLURL:         viper.GetString("crlURL"),
+		OCSPURL:        viper.GetString("ocspURL"),
+		OCSPCacheTTL:   viper.GetDuration("ocspCacheTTL"),
+
+		EKInventoryMode: viper.GetString("ekInventoryMode"),
+		AuditLog:        viper.GetString("auditLog"),
+
+		SourceRateLimit:       viper.GetFloat64("sourceRateLimit"),
+		SourceRateBurst:       viper.GetInt("sourceRateBurst"),
+		XnameRateLimit:        viper.GetFloat64("xnameRateLimit"),
+		XnameRateBurst:        viper.GetInt("xnameRateBurst"),
+		RateLimitForwardedFor: viper.GetBool("rateLimitForwardedFor"),
+		LockoutThreshold:      viper.GetInt("lockoutThreshold"),
+		LockoutDuration:       viper.GetDuration("lockoutDuration"),
+
+		AdminAuthMode:    viper.GetString("adminAuthMode"),
+		AdminTokens:      viper.GetString("adminTokens"),
+		AdminJWKS:        viper.GetString("adminJWKS"),
+		AdminJWTIssuer:   viper.GetString("adminJWTIssuer"),
+		AdminJWTAudience: viper.GetString("adminJWTAudience"),
+		AdminRoleClaim:   viper.GetString("adminRoleClaim"),
+		AdminJWTRoles:    viper.GetStringMapStringSlice("adminJWTRoles"),
+		AdminClientCerts: viper.GetStringMapStringSlice("adminClientCerts"),
+		AdminRoutes:      viper.GetStringMapString("adminRoutes"),
+		TLSCert:          viper.GetString("tlsCert"),
+		TLSKey:           viper.GetString("tlsKey"),
+
+		NodeTypeMode: viper.GetString("nodeTypeMode"),
+
+		HSMURL:           viper.GetString("hsmURL"),
+		HSMFailurePolicy: viper.GetString("hsmFailurePolicy"),
+		HSMCacheTTL:      viper.GetDuration("hsmCacheTTL"),
+		HSMTimeout:       viper.GetDuration("hsmTimeout"),
+		HSMStates:        viper.GetStringSlice("hsmStates"),
+
+		SPIFFEIDTemplate: viper.GetString("spiffeIDTemplate"),
+		SubjectMode:      viper.GetString("subjectMode"),
+
+		CAKeyBackend:     viper.GetString("caKeyBackend"),
+		CAKeyFile:        viper.GetString("platformKey"),
+		PKCS11Module:     viper.GetString("pkcs11Module"),
+		PKCS11TokenLabel: viper.GetString("pkcs11TokenLabel"),
+		PKCS11PINFile:    viper.GetString("pkcs11PINFile"),
+		PKCS11KeyLabel:   viper.GetString("pkcs11KeyLabel"),
+		TPMDevice:        viper.GetString("tpmDevice"),
+		TPMKeyHandle:     viper.GetUint32("tpmKeyHandle"),
+	}
+
+	if err = viper.UnmarshalKey("nodeTypes", &CFG.NodeTypeRules); err != nil {
 		return err
 	}
 
-	dPKey, _ := pem.Decode(pKeyFile)
+	if err = viper.UnmarshalKey("hsmRoles", &CFG.HSMRoles); err != nil {
+		return err
+	}
 
-	platformKey, err := x509.ParsePKCS8PrivateKey(dPKey.Bytes)
-	if err != nil {
+	if err = viper.UnmarshalKey("certProfiles", &CFG.CertProfiles); err != nil {
 		return err
 	}
 
-	CFG = Config{
-		ManufactuerCAs: certPool,
-		ProviderCA:     platformCA,
-		ProviderKey:    platformKey.(*rsa.PrivateKey),
-		Port:           viper.GetInt("port"),
-		WhiteList:      viper.GetString("whitelist"),
-		SpireTokensURL: viper.GetString("spiretokensurl"),
+	if viper.GetString("adminClientCAs") != "" {
+		CFG.AdminClientCAs, err = loadCertPool(viper.GetString("adminClientCAs"))
+		if err != nil {
+			return err
+		}
+	}
+
+	if viper.GetString("ocspResponderCert") != "" {
+		CFG.OCSPResponderCert, CFG.OCSPResponderKey, err = loadOCSPResponder(
+			viper.GetString("ocspResponderCert"),
+			viper.GetString("ocspResponderKey"),
+		)
+		if err != nil {
+			return err
+		}
+
+		if err = CheckOCSPResponder(CFG.ProviderCA, CFG.OCSPResponderCert); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// loadCertPool reads a pool of PEM encoded certificates.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	return pool, nil
+}
+
+// loadOCSPResponder reads a delegated OCSP responder certificate and its
+// PKCS #8 private key.
+func loadOCSPResponder(certFile string, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no certificate found in %s", certFile)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no private key found in %s", keyFile)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported OCSP responder key in %s", keyFile)
+	}
+
+	return cert, signer, nil
+}
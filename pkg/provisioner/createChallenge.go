@@ -28,6 +28,7 @@ package provisioner
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 
@@ -49,26 +50,65 @@ func CreateChallenge(data string) (string, string, string, error) {
 		return "", "", "", err
 	}
 
-	hash, err := sr.EndorsementKey.NameAlg.Hash()
+	blob, secret, nonce, err := createChallenge(&sr)
 	if err != nil {
 		return "", "", "", err
 	}
 
+	blob64 := base64.RawStdEncoding.EncodeToString(blob)
+	secret64 := base64.RawStdEncoding.EncodeToString(secret)
+	nonce64 := base64.StdEncoding.EncodeToString(nonce)
+
+	return blob64, secret64, nonce64, nil
+}
+
+// endorsementCertificate returns the EK certificate of the base64 encoded
+// signing request.
+func endorsementCertificate(data string) (*x509.Certificate, error) {
+	var sr devid.SigningRequest
+
+	decodedData, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sr.UnmarshalBinary(decodedData)
+	if err != nil {
+		return nil, err
+	}
+
+	if sr.EndorsementCertificate == nil {
+		return nil, errors.New("missing EK certificate")
+	}
+
+	return sr.EndorsementCertificate, nil
+}
+
+// createChallenge creates a credential activation challenge for the signing
+// request's AK, encrypted to its EK. It returns the credential blob and
+// encrypted secret without their TPM2B size prefixes, and the nonce the client
+// must recover.
+func createChallenge(sr *devid.SigningRequest) ([]byte, []byte, []byte, error) {
+	hash, err := sr.EndorsementKey.NameAlg.Hash()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	credName, err := sr.AttestationKey.Name()
 	if err != nil {
-		return "", "", "", err
+		return nil, nil, nil, err
 	}
 
 	nonce := make([]byte, hash.Size())
 
 	_, err = rand.Read(nonce)
 	if err != nil {
-		return "", "", "", err
+		return nil, nil, nil, err
 	}
 
 	encKey, err := sr.EndorsementKey.Key()
 	if err != nil {
-		return "", "", "", err
+		return nil, nil, nil, err
 	}
 
 	var symBlockSize int
@@ -77,7 +117,7 @@ func CreateChallenge(data string) (string, string, string, error) {
 		symBlockSize = int(sr.EndorsementKey.RSAParameters.Symmetric.KeyBits) / 8
 
 	default:
-		return "", "", "", errors.New("unsupported algorithm")
+		return nil, nil, nil, errors.New("unsupported algorithm")
 	}
 
 	blob, secret, err := credactivation.Generate(
@@ -87,12 +127,8 @@ func CreateChallenge(data string) (string, string, string, error) {
 		nonce,
 	)
 	if err != nil {
-		return "", "", "", err
+		return nil, nil, nil, err
 	}
 
-	blob64 := base64.RawStdEncoding.EncodeToString(blob[2:])
-	secret64 := base64.RawStdEncoding.EncodeToString(secret[2:])
-	nonce64 := base64.StdEncoding.EncodeToString(nonce)
-
-	return blob64, secret64, nonce64, nil
+	return blob[2:], secret[2:], nonce, nil
 }
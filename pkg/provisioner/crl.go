@@ -0,0 +1,167 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultCRLInterval is how often the CRL is regenerated.
+const DefaultCRLInterval = time.Hour
+
+var crl struct {
+	// generate serializes GenerateCRL so that CRLs are published in the order
+	// of their numbers.
+	generate sync.Mutex
+	mu       sync.RWMutex
+	der      []byte
+}
+
+// GenerateCRL signs a new CRL listing every revoked certificate in the ledger
+// with the provider CA. The CRL is valid for two intervals so relying parties
+// survive a missed regeneration.
+func GenerateCRL(interval time.Duration) error {
+	if Issued == nil {
+		return errLedgerDisabled
+	}
+
+	if interval <= 0 {
+		interval = DefaultCRLInterval
+	}
+
+	crl.generate.Lock()
+	defer crl.generate.Unlock()
+
+	revoked, err := Issued.Revoked()
+	if err != nil {
+		return err
+	}
+
+	number, err := Issued.NextCRLNumber()
+	if err != nil {
+		return err
+	}
+
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+
+	for _, rec := range revoked {
+		if rec.RevokedAt == nil {
+			log.Printf("Revoked certificate %s has no revocation time, not listed in the CRL", rec.Serial)
+			continue
+		}
+
+		serial, err := hex.DecodeString(rec.Serial)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   new(big.Int).SetBytes(serial),
+			RevocationTime: *rec.RevokedAt,
+			ReasonCode:     rec.RevocationReason,
+		})
+	}
+
+	now := time.Now()
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    new(big.Int).SetUint64(number),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(2 * interval),
+	}, CFG.ProviderCA, CFG.ProviderKey)
+	if err != nil {
+		return err
+	}
+
+	crl.mu.Lock()
+	crl.der = der
+	crl.mu.Unlock()
+
+	return nil
+}
+
+// PublishCRL regenerates the CRL every interval until ctx is cancelled.
+func PublishCRL(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultCRLInterval
+	}
+
+	if err := GenerateCRL(interval); err != nil {
+		log.Printf("Unable to generate CRL: %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := GenerateCRL(interval); err != nil {
+				log.Printf("Unable to generate CRL: %v", err)
+			}
+		}
+	}
+}
+
+// GetCRL serves the DER encoded CRL of the provider CA.
+func GetCRL(w http.ResponseWriter, r *http.Request) {
+	crl.mu.RLock()
+	der := crl.der
+	crl.mu.RUnlock()
+
+	if der == nil {
+		err := GenerateCRL(CFG.CRLInterval)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			sendResponseError(w, err)
+
+			return
+		}
+
+		crl.mu.RLock()
+		der = crl.der
+		crl.mu.RUnlock()
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.WriteHeader(http.StatusOK)
+
+	_, err := w.Write(der)
+	if err != nil {
+		log.Printf("error writing the CRL: %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/pkg/devid"
+	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/proto/enrollapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// EnrollmentServer implements the enrollapi Enrollment gRPC service. A whole
+// enrollment runs over a single stream, so no session cookie is needed. The
+// xname, node type and JWT-SVID are sent as the xname, type and authorization
+// request metadata.
+type EnrollmentServer struct {
+	enrollapi.UnimplementedEnrollmentServer
+}
+
+// NewGRPCServer returns a gRPC server with the Enrollment service registered.
+func NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	enrollapi.RegisterEnrollmentServer(s, &EnrollmentServer{})
+
+	return s
+}
+
+// Enroll implements enrollapi.EnrollmentServer. The enrollment must complete
+// within the session TTL.
+func (s *EnrollmentServer) Enroll(stream enrollapi.Enrollment_EnrollServer) (err error) {
+	start := time.Now()
+
+	defer func() {
+		observeStep(StepEnroll, start, err)
+	}()
+
+	ttl := CFG.SessionTTL
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+
+	ctx, cancel := context.WithTimeout(stream.Context(), ttl)
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- s.enroll(ctx, stream)
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		// Returning cancels the stream which unblocks the enrollment, which
+		// checks ctx before issuing anything.
+		return status.Error(codes.DeadlineExceeded, errSessionExpired.Error())
+	}
+}
+
+// enroll runs the verify, credential activation challenge and DevID issuance
+// steps over stream. Nothing is issued, bound or recorded once ctx is done.
+func (s *EnrollmentServer) enroll(ctx context.Context, stream enrollapi.Enrollment_EnrollServer) (err error) {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+
+	xname := metadataValue(md, "xname")
+	claimedType := metadataValue(md, "type")
+	nodeType := claimedType
+
+	log.Printf("gRPC enrollment Xname: %s  Type: %s", xname, claimedType)
+
+	var (
+		fingerprint, sourceIP string
+		certs                 issuedCertificates
+	)
+
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		sourceIP, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+
+	defer func() {
+		details := nodeTypeDetails(nodeType, claimedType)
+		details["transport"] = "grpc"
+
+		if certs.requestedSubject != "" {
+			details["requestedSubject"] = certs.requestedSubject
+		}
+
+		audit(AuditEvent{
+			Event:         AuditEnroll,
+			SourceIP:      sourceIP,
+			Subject:       bearerSubject(metadataValue(md, "authorization")),
+			Xname:         xname,
+			EKFingerprint: fingerprint,
+			Details:       details,
+		}, err)
+	}()
+
+	if err := Limiter.AllowSource(sourceIP); err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	if err := Limiter.AllowXname(xname); err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	if nodeType, err = NodeTypes.Resolve(xname, claimedType); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if err := validateXname(xname, nodeType); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if err := checkComponent(stream.Context(), xname, nodeType); err != nil {
+		if asAPIError(err).Code == CodeUnavailable {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	jwt := bearerToken(metadataValue(md, "authorization"))
+
+	if _, err := JWTAuth.AuthenticateToken(jwt, xname, nodeType); err != nil {
+		log.Printf("JWT-SVID authentication failed for %s: %v", xname, err)
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	raw := req.GetSigningRequest()
+	if raw == nil {
+		return status.Error(codes.InvalidArgument, "expected a signing request")
+	}
+
+	err = validateRequest(
+		base64.StdEncoding.EncodeToString(raw.GetData()),
+		base64.StdEncoding.EncodeToString(raw.GetSignature()),
+	)
+	if err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	var sr devid.SigningRequest
+
+	err = sr.UnmarshalBinary(raw.GetData())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if sr.EndorsementCertificate == nil {
+		return status.Error(codes.InvalidArgument, "missing EK certificate")
+	}
+
+	fingerprint = EKFingerprint(sr.EndorsementCertificate)
+
+	err = Limiter.AllowEK(fingerprint)
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	err = checkEKInventory(xname, fingerprint)
+	if err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	err = checkEKBinding(xname, fingerprint)
+	if err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	blob, secret, nonce, err := createChallenge(&sr)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	err = stream.Send(&enrollapi.EnrollResponse{
+		ChallengeOrResponse: &enrollapi.EnrollResponse_Challenge{
+			Challenge: &enrollapi.Challenge{
+				CredentialBlob: blob,
+				Secret:         secret,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err = stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(req.GetChallengeResponse(), nonce) != 1 {
+		Limiter.ChallengeFailed(xname, fingerprint)
+		return status.Error(codes.PermissionDenied, "challenge response does not match nonce")
+	}
+
+	Limiter.ChallengeSucceeded(xname, fingerprint)
+
+	if err = enrollmentExpired(ctx); err != nil {
+		return err
+	}
+
+	certs, err = issueCertificates(raw.GetData(), xname, nodeType)
+	if err != nil {
+		if asAPIError(err).Code == CodeSubjectMismatch {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if err = enrollmentExpired(ctx); err != nil {
+		return err
+	}
+
+	err = bindEK(xname, EKFingerprint(certs.ek))
+	if err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if err = enrollmentExpired(ctx); err != nil {
+		return err
+	}
+
+	err = recordIssuance(xname, nodeType, certs)
+	if err != nil {
+		log.Printf("Unable to record issuance for %s: %v", xname, err)
+		return status.Error(codes.Internal, "unable to record issuance")
+	}
+
+	err = stream.Send(&enrollapi.EnrollResponse{
+		ChallengeOrResponse: &enrollapi.EnrollResponse_SigningResponse{
+			SigningResponse: &enrollapi.SigningResponse{
+				DevIDCertificate:       certs.devID,
+				AttestationCertificate: certs.attestation,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = requestSpireWorkloads(nodeType, xname, CFG.SpireTokensURL)
+	if err != nil {
+		log.Printf("error requesting the creation of spire workloads: %v", err)
+	}
+
+	return nil
+}
+
+// enrollmentExpired returns the gRPC error of an enrollment whose ctx is done.
+func enrollmentExpired(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, errSessionExpired.Error())
+	default:
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// metadataValue returns the first value of key in md.
+func metadataValue(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
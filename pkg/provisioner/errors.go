@@ -0,0 +1,134 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrorCode is a machine readable API error code.
+type ErrorCode string
+
+// API error codes.
+const (
+	CodeBadRequest          ErrorCode = "bad_request"
+	CodeUnauthenticated     ErrorCode = "unauthenticated"
+	CodeForbidden           ErrorCode = "forbidden"
+	CodeInvalidSession      ErrorCode = "invalid_session"
+	CodeNotWhitelisted      ErrorCode = "not_whitelisted"
+	CodeEKUntrusted         ErrorCode = "ek_untrusted"
+	CodeEKMismatch          ErrorCode = "ek_mismatch"
+	CodeNodeTypeMismatch    ErrorCode = "node_type_mismatch"
+	CodeChallengeMismatch   ErrorCode = "challenge_mismatch"
+	CodeNotFound            ErrorCode = "not_found"
+	CodeOutOfOrder          ErrorCode = "out_of_order"
+	CodeConflict            ErrorCode = "conflict"
+	CodeSessionExpired      ErrorCode = "session_expired"
+	CodeInternal            ErrorCode = "internal"
+	CodeNotEnabled          ErrorCode = "not_enabled"
+	CodeRateLimited         ErrorCode = "rate_limited"
+	CodeComponentIneligible ErrorCode = "component_ineligible"
+	CodeUnavailable         ErrorCode = "unavailable"
+	CodeSubjectMismatch     ErrorCode = "subject_mismatch"
+)
+
+// errorStatus maps error codes to their HTTP status.
+var errorStatus = map[ErrorCode]int{
+	CodeBadRequest:          http.StatusBadRequest,
+	CodeUnauthenticated:     http.StatusUnauthorized,
+	CodeForbidden:           http.StatusForbidden,
+	CodeInvalidSession:      http.StatusUnauthorized,
+	CodeNotWhitelisted:      http.StatusForbidden,
+	CodeEKUntrusted:         http.StatusForbidden,
+	CodeEKMismatch:          http.StatusForbidden,
+	CodeNodeTypeMismatch:    http.StatusForbidden,
+	CodeChallengeMismatch:   http.StatusForbidden,
+	CodeNotFound:            http.StatusNotFound,
+	CodeOutOfOrder:          http.StatusConflict,
+	CodeConflict:            http.StatusConflict,
+	CodeSessionExpired:      http.StatusGone,
+	CodeInternal:            http.StatusInternalServerError,
+	CodeNotEnabled:          http.StatusNotImplemented,
+	CodeRateLimited:         http.StatusTooManyRequests,
+	CodeComponentIneligible: http.StatusForbidden,
+	CodeUnavailable:         http.StatusServiceUnavailable,
+	CodeSubjectMismatch:     http.StatusForbidden,
+}
+
+// APIError is an error with an API error code.
+type APIError struct {
+	Code ErrorCode
+	Err  error
+	// RetryAfter is how long the client should wait before retrying.
+	RetryAfter time.Duration
+}
+
+// Error returns the error message.
+func (e *APIError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the HTTP status of the error code.
+func (e *APIError) Status() int {
+	if status, ok := errorStatus[e.Code]; ok {
+		return status
+	}
+
+	return http.StatusInternalServerError
+}
+
+// apiError annotates err with code. It returns nil when err is nil.
+func apiError(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &APIError{Code: code, Err: err}
+}
+
+// apiErrorf returns a new error with code.
+func apiErrorf(code ErrorCode, format string, a ...any) error {
+	return &APIError{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+// asAPIError returns err as an API error. Errors without a code are internal
+// errors.
+func asAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	return &APIError{Code: CodeInternal, Err: err}
+}
@@ -0,0 +1,299 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HSM failure policies, applied when the Hardware State Manager can not be
+// queried.
+const (
+	HSMFailOpen   = "open"
+	HSMFailClosed = "closed"
+)
+
+// Defaults of the Hardware State Manager client.
+const (
+	DefaultHSMCacheTTL = time.Minute
+	DefaultHSMTimeout  = 5 * time.Second
+)
+
+// DefaultHSMStates are the component states allowed to enroll when none are
+// configured.
+var DefaultHSMStates = []string{"On", "Ready"}
+
+// DefaultHSMRoles map the HSM roles and role/subrole pairs to node types when
+// none are configured.
+var DefaultHSMRoles = map[string]string{
+	"Compute":            "compute",
+	"Management/Master":  "ncn",
+	"Management/Worker":  "ncn",
+	"Management/Storage": "storage",
+}
+
+// Component is a component as returned by the Hardware State Manager.
+type Component struct {
+	ID      string `json:"ID"`
+	Type    string `json:"Type"`
+	State   string `json:"State"`
+	Flag    string `json:"Flag,omitempty"`
+	Enabled bool   `json:"Enabled"`
+	Role    string `json:"Role,omitempty"`
+	SubRole string `json:"SubRole,omitempty"`
+	Class   string `json:"Class,omitempty"`
+}
+
+// HSMClient checks enrolling xnames against the components of a Hardware
+// State Manager.
+type HSMClient struct {
+	url      string
+	client   *http.Client
+	failOpen bool
+	cacheTTL time.Duration
+	states   map[string]bool
+	roles    map[string]string
+
+	mu    sync.Mutex
+	cache map[string]hsmCacheEntry
+}
+
+// hsmCacheEntry is a cached lookup, a nil component for an unknown xname.
+type hsmCacheEntry struct {
+	component *Component
+	expires   time.Time
+}
+
+// HSM is the Hardware State Manager client used when authorizing
+// enrollments. Components are not checked when it is nil.
+var HSM *HSMClient
+
+var errHSMUnavailable = errors.New("hardware state manager unavailable")
+
+// NewHSMClient returns the HSMClient configured by cfg, or nil when no
+// Hardware State Manager URL is configured.
+func NewHSMClient(cfg Config) (*HSMClient, error) {
+	if cfg.HSMURL == "" {
+		return nil, nil
+	}
+
+	c := &HSMClient{
+		url:      strings.TrimSuffix(cfg.HSMURL, "/"),
+		cacheTTL: cfg.HSMCacheTTL,
+		states:   map[string]bool{},
+		roles:    map[string]string{},
+		cache:    map[string]hsmCacheEntry{},
+	}
+
+	switch cfg.HSMFailurePolicy {
+	case "", HSMFailClosed:
+	case HSMFailOpen:
+		c.failOpen = true
+	default:
+		return nil, fmt.Errorf("unknown HSM failure policy %q", cfg.HSMFailurePolicy)
+	}
+
+	timeout := cfg.HSMTimeout
+	if timeout <= 0 {
+		timeout = DefaultHSMTimeout
+	}
+
+	c.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12}},
+		Timeout:   timeout,
+	}
+
+	if c.cacheTTL <= 0 {
+		c.cacheTTL = DefaultHSMCacheTTL
+	}
+
+	states := cfg.HSMStates
+	if len(states) == 0 {
+		states = DefaultHSMStates
+	}
+
+	for _, s := range states {
+		c.states[strings.ToLower(s)] = true
+	}
+
+	roles := cfg.HSMRoles
+	if len(roles) == 0 {
+		roles = DefaultHSMRoles
+	}
+
+	// Roles are matched case insensitively since the config keys are lower
+	// cased.
+	for role, nodeType := range roles {
+		c.roles[strings.ToLower(role)] = nodeType
+	}
+
+	return c, nil
+}
+
+// Check checks that the Hardware State Manager knows xname as an enabled node
+// in an enrollable state and returns it. When the Hardware State Manager can
+// not be queried the xname is rejected, or allowed with a nil component when
+// failing open.
+func (c *HSMClient) Check(ctx context.Context, xname string) (*Component, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	if err := parseNodeXname(xname); err != nil {
+		return nil, err
+	}
+
+	component, err := c.lookup(ctx, xname)
+	if err != nil {
+		if c.failOpen {
+			log.Printf("ALERT: allowing %s without checking the hardware state manager: %v", xname, err)
+			return nil, nil
+		}
+
+		return nil, apiError(CodeUnavailable, fmt.Errorf("%w: %v", errHSMUnavailable, err))
+	}
+
+	switch {
+	case component == nil:
+		return nil, apiErrorf(CodeComponentIneligible, "xname %s is not a hardware state manager component", xname)
+	case component.Type != "Node":
+		return component, apiErrorf(CodeComponentIneligible, "xname %s is a %s, not a node", xname, component.Type)
+	case !component.Enabled:
+		return component, apiErrorf(CodeComponentIneligible, "xname %s is disabled", xname)
+	case !c.states[strings.ToLower(component.State)]:
+		return component, apiErrorf(CodeComponentIneligible, "xname %s is %s", xname, component.State)
+	}
+
+	return component, nil
+}
+
+// NodeType returns the node type of the role of component, or an empty
+// string when the component is nil or its role has no node type.
+func (c *HSMClient) NodeType(component *Component) string {
+	if c == nil || component == nil {
+		return ""
+	}
+
+	if t, ok := c.roles[strings.ToLower(component.Role+"/"+component.SubRole)]; ok {
+		return t
+	}
+
+	return c.roles[strings.ToLower(component.Role)]
+}
+
+// checkComponent checks xname against the Hardware State Manager, and that
+// the node type of its role is nodeType unless node types are not verified.
+func checkComponent(ctx context.Context, xname string, nodeType string) error {
+	component, err := HSM.Check(ctx, xname)
+	if err != nil {
+		log.Printf("Hardware state manager check failed for %s: %v", xname, err)
+		return err
+	}
+
+	if t := HSM.NodeType(component); t != "" && t != nodeType && NodeTypes.verifies() {
+		log.Printf("ALERT: %s enrolling as %s has the %s role of a %s node", xname, nodeType, component.Role, t)
+		return apiErrorf(CodeNodeTypeMismatch, "xname %s is a %s node, not %s", xname, t, nodeType)
+	}
+
+	return nil
+}
+
+// lookup returns the component xname, or nil when the Hardware State Manager
+// does not know it. Lookups are cached, failed lookups are not.
+func (c *HSMClient) lookup(ctx context.Context, xname string) (*Component, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.cache[xname]
+	c.mu.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		return entry.component, nil
+	}
+
+	component, err := c.get(ctx, xname)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, v := range c.cache {
+		if now.After(v.expires) {
+			delete(c.cache, k)
+		}
+	}
+
+	c.cache[xname] = hsmCacheEntry{component: component, expires: now.Add(c.cacheTTL)}
+
+	return component, nil
+}
+
+// get queries the Hardware State Manager for the component xname.
+func (c *HSMClient) get(ctx context.Context, xname string) (*Component, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/State/Components/"+url.PathEscape(xname), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("component %s: %s: %s", xname, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var component Component
+
+	if err = json.NewDecoder(resp.Body).Decode(&component); err != nil {
+		return nil, fmt.Errorf("component %s: %w", xname, err)
+	}
+
+	return &component, nil
+}
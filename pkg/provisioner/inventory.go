@@ -0,0 +1,321 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// EK inventory modes.
+const (
+	// EKInventoryModeOff enrolls any EK signed by a manufacturer CA.
+	EKInventoryModeOff = "off"
+	// EKInventoryModeRequired requires the EK to be in the inventory. When the
+	// inventory entry has an xname it must match the xname being enrolled.
+	EKInventoryModeRequired = "required"
+	// EKInventoryModeXname requires the EK to be in the inventory for the
+	// xname being enrolled.
+	EKInventoryModeXname = "xname"
+)
+
+// EK inventory import formats.
+const (
+	InventoryFormatPEM  = "pem"
+	InventoryFormatCSV  = "csv"
+	InventoryFormatJSON = "json"
+)
+
+var (
+	bucketInventory = []byte("inventory")
+
+	errEKNotInInventory = apiError(CodeEKUntrusted, errors.New("EK is not in the inventory"))
+)
+
+// EKInventoryEntry is a pre-registered EK.
+type EKInventoryEntry struct {
+	EKFingerprint string    `json:"ekFingerprint"`
+	Xname         string    `json:"xname,omitempty"`
+	Serial        string    `json:"serial,omitempty"`
+	ImportedAt    time.Time `json:"importedAt,omitempty"`
+	// Certificate is a PEM encoded EK certificate. It is only used on import to
+	// fill in the fingerprint and serial.
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// ParseEKInventory parses an EK inventory in the pem, csv or json format. A
+// pem inventory is a bundle of EK certificates. A csv inventory has the EK
+// SHA-256 fingerprint and an optional expected xname on every line, with an
+// optional header line. A json
+// inventory is a list of entries.
+func ParseEKInventory(format string, r io.Reader) ([]EKInventoryEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []EKInventoryEntry
+
+	switch format {
+	case InventoryFormatPEM:
+		entries, err = parsePEMInventory(data)
+	case InventoryFormatCSV:
+		entries, err = parseCSVInventory(data)
+	case InventoryFormatJSON:
+		entries, err = parseJSONInventory(data)
+	default:
+		err = fmt.Errorf("unsupported inventory format %q", format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("empty inventory")
+	}
+
+	return entries, nil
+}
+
+// inventoryEntryFromCertificate creates the inventory entry of an EK
+// certificate.
+func inventoryEntryFromCertificate(cert *x509.Certificate, xname string) EKInventoryEntry {
+	return EKInventoryEntry{
+		EKFingerprint: EKFingerprint(cert),
+		Xname:         xname,
+		Serial:        SerialString(cert.SerialNumber.Bytes()),
+	}
+}
+
+func parsePEMInventory(data []byte) ([]EKInventoryEntry, error) {
+	var entries []EKInventoryEntry
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, inventoryEntryFromCertificate(cert, ""))
+	}
+
+	return entries, nil
+}
+
+func parseCSVInventory(data []byte) ([]EKInventoryEntry, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []EKInventoryEntry
+
+	for i, record := range records {
+		fingerprint := normalizeHex(record[0])
+
+		// Skip a header line.
+		if i == 0 && validateFingerprint(fingerprint) != nil {
+			continue
+		}
+
+		if err = validateFingerprint(fingerprint); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		entry := EKInventoryEntry{EKFingerprint: fingerprint}
+
+		if len(record) > 1 {
+			entry.Xname = strings.TrimSpace(record[1])
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func parseJSONInventory(data []byte) ([]EKInventoryEntry, error) {
+	var entries []EKInventoryEntry
+
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, entry := range entries {
+		if entry.Certificate != "" {
+			block, _ := pem.Decode([]byte(entry.Certificate))
+			if block == nil {
+				return nil, fmt.Errorf("entry %d: invalid certificate", i)
+			}
+
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("entry %d: %w", i, err)
+			}
+
+			entries[i] = inventoryEntryFromCertificate(cert, entry.Xname)
+
+			continue
+		}
+
+		entries[i].EKFingerprint = normalizeHex(entry.EKFingerprint)
+
+		if err = validateFingerprint(entries[i].EKFingerprint); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+	}
+
+	return entries, nil
+}
+
+// AddInventory adds or replaces inventory entries.
+func (l *Ledger) AddInventory(entries []EKInventoryEntry) error {
+	now := time.Now().UTC()
+
+	return l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketInventory)
+
+		for _, entry := range entries {
+			entry.ImportedAt = now
+			entry.Certificate = ""
+
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+
+			if err = bucket.Put([]byte(entry.EKFingerprint), data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// InventoryEntry returns the inventory entry of the EK with the fingerprint.
+func (l *Ledger) InventoryEntry(fingerprint string) (EKInventoryEntry, error) {
+	var entry EKInventoryEntry
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketInventory).Get([]byte(fingerprint))
+		if data == nil {
+			return errNotFound
+		}
+
+		return json.Unmarshal(data, &entry)
+	})
+
+	return entry, err
+}
+
+// Inventory returns every inventory entry.
+func (l *Ledger) Inventory() ([]EKInventoryEntry, error) {
+	entries := []EKInventoryEntry{}
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketInventory).ForEach(func(_, v []byte) error {
+			var entry EKInventoryEntry
+
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+
+			entries = append(entries, entry)
+
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+// RemoveInventory removes the EK with the fingerprint from the inventory.
+func (l *Ledger) RemoveInventory(fingerprint string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketInventory).Delete([]byte(fingerprint))
+	})
+}
+
+// checkEKInventory validates that the EK with the fingerprint is in the
+// inventory for xname according to the configured inventory mode.
+func checkEKInventory(xname string, fingerprint string) error {
+	mode := CFG.EKInventoryMode
+	if mode == "" || mode == EKInventoryModeOff {
+		return nil
+	}
+
+	if Issued == nil {
+		return errLedgerDisabled
+	}
+
+	entry, err := Issued.InventoryEntry(fingerprint)
+	if errors.Is(err, errNotFound) {
+		log.Printf("EK %s presented for %s is not in the inventory", fingerprint, xname)
+		return errEKNotInInventory
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if entry.Xname == xname || (entry.Xname == "" && mode == EKInventoryModeRequired) {
+		return nil
+	}
+
+	log.Printf("EK %s presented for %s is in the inventory for %q", fingerprint, xname, entry.Xname)
+
+	return apiErrorf(CodeEKUntrusted, "EK is not in the inventory for %s", xname)
+}
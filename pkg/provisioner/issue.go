@@ -0,0 +1,220 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/pkg/common"
+	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/pkg/devid"
+	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/pkg/x509tcg"
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+var (
+	// oidTCGDevIDCertificate is the extended key usage of DevID certificates.
+	oidTCGDevIDCertificate = asn1.ObjectIdentifier{2, 23, 133, 11, 1, 2}
+
+	// oidTCGKpAIKCertificate (tcg-kp-AIKCertificate) is the extended key usage
+	// of IAK and LAK certificates.
+	oidTCGKpAIKCertificate = asn1.ObjectIdentifier{2, 23, 133, 8, 3}
+)
+
+// issuedCertificates contains the DER encoded certificates issued for a signing
+// request.
+type issuedCertificates struct {
+	devID       []byte
+	attestation []byte
+	ek          *x509.Certificate
+	// profile is the name of the certificate profile they were issued with.
+	profile string
+	// requestedSubject is the subject requested by the client when it
+	// differs from the issued subject.
+	requestedSubject string
+}
+
+// issueCertificates issues the DevID certificate and the AK certificate for the
+// signing request in data with the certificate profile of xname enrolling as
+// nodeType. Both certificates carry the same subject and TCG
+// hardwareModuleName SAN. The subject is built from xname and nodeType, the
+// PlatformIdentity requested by the client is only trusted in client subject
+// mode.
+func issueCertificates(data []byte, xname string, nodeType string) (issuedCertificates, error) {
+	var subExtras *common.DistinguishedName
+
+	var sr devid.SigningRequest
+
+	err := sr.UnmarshalBinary(data)
+	if err != nil {
+		return issuedCertificates{}, err
+	}
+
+	if sr.DevIDKey == nil {
+		return issuedCertificates{}, errors.New("missing DevID key")
+	}
+
+	if sr.AttestationKey == nil {
+		return issuedCertificates{}, errors.New("missing attestation key")
+	}
+
+	profile, err := selectProfile(xname, nodeType)
+	if err != nil {
+		return issuedCertificates{}, err
+	}
+
+	var requested pkix.Name
+
+	requested.FillFromRDNSequence(&sr.PlatformIdentity)
+
+	subExtras.AppendInto(&requested)
+
+	subj, err := profile.subjectFor(xname, nodeType, requested)
+	if err != nil {
+		return issuedCertificates{}, err
+	}
+
+	subjectIsEmpty := len(subj.ToRDNSequence()) == 0
+
+	sanExtension, err := x509tcg.DevIDSANFromEKCertificate(
+		subjectIsEmpty,
+		sr.EndorsementCertificate,
+	)
+	if err != nil {
+		return issuedCertificates{}, err
+	}
+
+	sanExtension, err = profile.extendSAN(sanExtension, xname, nodeType)
+	if err != nil {
+		return issuedCertificates{}, err
+	}
+
+	devID, err := issueKeyCertificate(sr.DevIDKey, profile, subj, sanExtension, profile.extKeyUsage, profile.ca)
+	if err != nil {
+		return issuedCertificates{}, err
+	}
+
+	ak, err := issueKeyCertificate(sr.AttestationKey, profile, subj, sanExtension, profile.attestationExtKeyUsage, false)
+	if err != nil {
+		return issuedCertificates{}, err
+	}
+
+	return issuedCertificates{
+		devID:            devID,
+		attestation:      ak,
+		ek:               sr.EndorsementCertificate,
+		profile:          profile.name,
+		requestedSubject: subjectDiscrepancy(requested, subj),
+	}, nil
+}
+
+// serialNumberLimit bounds the serial numbers to 159 bits, so that they encode
+// in at most 20 octets as RFC 5280 requires.
+var serialNumberLimit = new(big.Int).Lsh(big.NewInt(1), 159)
+
+// newSerialNumber returns a random positive certificate serial number. Serials
+// are not derived from the key so that every certificate has its own.
+func newSerialNumber() (*big.Int, error) {
+	for {
+		serial, err := rand.Int(rand.Reader, serialNumberLimit)
+		if err != nil || serial.Sign() > 0 {
+			return serial, err
+		}
+	}
+}
+
+// issueKeyCertificate issues a certificate for a TPM resident key with the
+// provider CA, as configured by profile. Only ca certificates carry the CA
+// basic constraints of the profile.
+func issueKeyCertificate(key *tpm2.Public, profile *certProfile, subj pkix.Name, san pkix.Extension, eku []asn1.ObjectIdentifier, ca bool) ([]byte, error) {
+	pub, err := key.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		PublicKey:    pub,
+
+		Subject:   subj,
+		NotBefore: now,
+		NotAfter:  now.Add(profile.validity),
+
+		KeyUsage:              profile.keyUsage &^ x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+
+		UnknownExtKeyUsage: eku,
+
+		ExtraExtensions: []pkix.Extension{
+			san,
+		},
+	}
+
+	if ca {
+		template.KeyUsage = profile.keyUsage
+		template.IsCA = true
+		template.MaxPathLen = profile.maxPathLen
+		template.MaxPathLenZero = profile.maxPathLenZero
+	}
+
+	if url := firstNonEmpty(profile.crlURL, CFG.CRLURL); url != "" {
+		template.CRLDistributionPoints = []string{url}
+	}
+
+	if url := firstNonEmpty(profile.ocspURL, CFG.OCSPURL); url != "" {
+		template.OCSPServer = []string{url}
+	}
+
+	if profile.issuerURL != "" {
+		template.IssuingCertificateURL = []string{profile.issuerURL}
+	}
+
+	return x509.CreateCertificate(rand.Reader, &template, CFG.ProviderCA, template.PublicKey, CFG.ProviderKey)
+}
+
+// firstNonEmpty returns the first of values that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,213 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// JWT-SVID enforcement modes.
+const (
+	JWTModeOff      = "off"
+	JWTModeOptional = "optional"
+	JWTModeRequired = "required"
+)
+
+var errMissingJWT = apiError(CodeUnauthenticated, errors.New("missing JWT-SVID"))
+
+// JWTAuthenticator validates the JWT-SVIDs sent by the TPM Provisioner client
+// as an Authorization Bearer token.
+type JWTAuthenticator struct {
+	mode        string
+	trustDomain spiffeid.TrustDomain
+	bundleFile  string
+	audience    []string
+	idTemplate  string
+
+	mu       sync.RWMutex
+	bundle   *jwtbundle.Bundle
+	modified time.Time
+}
+
+// JWTAuth is the authenticator used by the enrollment api handlers. A nil
+// JWTAuth does not check JWT-SVIDs.
+var JWTAuth *JWTAuthenticator
+
+// NewJWTAuthenticator returns a JWTAuthenticator for the configured mode,
+// trust bundle, audience and SPIFFE ID template. It returns nil when the mode
+// is off.
+func NewJWTAuthenticator(cfg Config) (*JWTAuthenticator, error) {
+	switch cfg.JWTMode {
+	case "", JWTModeOff:
+		return nil, nil
+	case JWTModeOptional, JWTModeRequired:
+	default:
+		return nil, fmt.Errorf("unknown JWT mode %q", cfg.JWTMode)
+	}
+
+	td, err := spiffeid.TrustDomainFromString(cfg.JWTTrustDomain)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &JWTAuthenticator{
+		mode:        cfg.JWTMode,
+		trustDomain: td,
+		bundleFile:  cfg.JWTBundle,
+		audience:    []string{cfg.JWTAudience},
+		idTemplate:  cfg.JWTIDTemplate,
+	}
+
+	if err = a.reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// reload reads the trust bundle when the bundle file has changed since it was
+// last read.
+func (a *JWTAuthenticator) reload() error {
+	info, err := os.Stat(a.bundleFile)
+	if err != nil {
+		return err
+	}
+
+	a.mu.RLock()
+	current := a.bundle != nil && info.ModTime().Equal(a.modified)
+	a.mu.RUnlock()
+
+	if current {
+		return nil
+	}
+
+	bundle, err := jwtbundle.Load(a.trustDomain, a.bundleFile)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.bundle = bundle
+	a.modified = info.ModTime()
+	a.mu.Unlock()
+
+	log.Printf("Loaded JWT trust bundle for %s from %s", a.trustDomain, a.bundleFile)
+
+	return nil
+}
+
+// Authenticate validates the JWT-SVID in the request's Authorization header
+// and, when a SPIFFE ID template is configured, that the SPIFFE ID belongs to
+// xname. It returns the SPIFFE ID of the caller, which is empty when no token
+// was sent and the mode is optional.
+func (a *JWTAuthenticator) Authenticate(r *http.Request, xname string, nodeType string) (string, error) {
+	return a.AuthenticateToken(bearerToken(r.Header.Get("Authorization")), xname, nodeType)
+}
+
+// AuthenticateToken is Authenticate for a raw JWT-SVID. An empty token means
+// the caller did not send one.
+func (a *JWTAuthenticator) AuthenticateToken(token string, xname string, nodeType string) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+
+	if token == "" {
+		if a.mode == JWTModeRequired {
+			return "", errMissingJWT
+		}
+
+		return "", nil
+	}
+
+	if err := a.reload(); err != nil {
+		// Keep using the last good bundle, the file may be mid update.
+		log.Printf("Unable to reload JWT trust bundle: %v", err)
+	}
+
+	a.mu.RLock()
+	bundle := a.bundle
+	a.mu.RUnlock()
+
+	svid, err := jwtsvid.ParseAndValidate(token, bundle, a.audience)
+	if err != nil {
+		return "", apiErrorf(CodeUnauthenticated, "invalid JWT-SVID: %w", err)
+	}
+
+	id := svid.ID.String()
+
+	if a.idTemplate != "" && !spiffePathMatches(svid.ID.Path(), a.idTemplate, xname, nodeType) {
+		return id, apiErrorf(CodeUnauthenticated, "SPIFFE ID %s is not authorized for xname %s", id, xname)
+	}
+
+	return id, nil
+}
+
+// authenticateSession authenticates the caller against the xname of the
+// session identified by token.
+func authenticateSession(r *http.Request, token string) error {
+	if JWTAuth == nil {
+		return nil
+	}
+
+	session, err := Sessions.Get(token)
+	if err != nil {
+		return err
+	}
+
+	_, err = JWTAuth.Authenticate(r, session.xname, session.nodeType)
+
+	return err
+}
+
+// spiffePathMatches reports whether path is the SPIFFE ID path built from
+// template, or is below it. The template may contain {xname} and {type}.
+func spiffePathMatches(path string, template string, xname string, nodeType string) bool {
+	expected := strings.NewReplacer("{xname}", xname, "{type}", nodeType).Replace(template)
+	expected = "/" + strings.Trim(expected, "/")
+
+	return path == expected || strings.HasPrefix(path, expected+"/")
+}
+
+// bearerToken returns the bearer token from an Authorization header value.
+func bearerToken(h string) string {
+	token, ok := strings.CutPrefix(h, "Bearer ")
+	if !ok {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
@@ -0,0 +1,367 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Certificate kinds recorded in the issuance ledger.
+const (
+	KindDevID       = "devid"
+	KindAttestation = "attestation"
+)
+
+var (
+	bucketCertificates = []byte("certificates")
+	bucketByXname      = []byte("xname")
+	bucketByEK         = []byte("ek")
+	bucketRevoked      = []byte("revoked")
+	bucketMeta         = []byte("meta")
+
+	keyCRLNumber = []byte("crlNumber")
+
+	errNotFound = apiError(CodeNotFound, errors.New("not found"))
+	errRecorded = apiError(CodeConflict, errors.New("certificate already recorded"))
+)
+
+// IssuedCertificate is an issuance ledger record.
+type IssuedCertificate struct {
+	Serial        string    `json:"serial"`
+	Kind          string    `json:"kind"`
+	Xname         string    `json:"xname"`
+	NodeType      string    `json:"nodeType"`
+	EKFingerprint string    `json:"ekFingerprint"`
+	PublicKeyHash string    `json:"publicKeyHash"`
+	NotBefore     time.Time `json:"notBefore"`
+	NotAfter      time.Time `json:"notAfter"`
+	Issuer        string    `json:"issuer"`
+	IssuedAt      time.Time `json:"issuedAt"`
+	Profile       string    `json:"profile,omitempty"`
+
+	// RevokedAt is set once the certificate is revoked.
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	RevocationReason int        `json:"revocationReason,omitempty"`
+}
+
+// Ledger records every certificate issued by the server in a bbolt database.
+type Ledger struct {
+	db *bolt.DB
+}
+
+// Issued is the issuance ledger, issuance is not recorded when nil.
+var Issued *Ledger
+
+// OpenLedger opens or creates the issuance ledger at path.
+func OpenLedger(path string) (*Ledger, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketCertificates, bucketByXname, bucketByEK, bucketRevoked, bucketMeta, bucketBindings, bucketInventory} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Ledger{db: db}, nil
+}
+
+// Close closes the ledger database.
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+// NewIssuedCertificate creates the ledger record for the DER encoded
+// certificate der issued to xname for the EK certificate ek.
+func NewIssuedCertificate(der []byte, kind string, xname string, nodeType string, ek *x509.Certificate) (IssuedCertificate, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+
+	keyHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	rec := IssuedCertificate{
+		Serial:        SerialString(cert.SerialNumber.Bytes()),
+		Kind:          kind,
+		Xname:         xname,
+		NodeType:      nodeType,
+		PublicKeyHash: hex.EncodeToString(keyHash[:]),
+		NotBefore:     cert.NotBefore,
+		NotAfter:      cert.NotAfter,
+		Issuer:        cert.Issuer.String(),
+		IssuedAt:      time.Now().UTC(),
+	}
+
+	if ek != nil {
+		rec.EKFingerprint = EKFingerprint(ek)
+	}
+
+	return rec, nil
+}
+
+// SerialString formats a certificate serial number as lower case hex.
+func SerialString(serial []byte) string {
+	return hex.EncodeToString(serial)
+}
+
+// EKFingerprint returns the SHA-256 fingerprint of an EK certificate.
+func EKFingerprint(ek *x509.Certificate) string {
+	sum := sha256.Sum256(ek.Raw)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// indexKey returns the index key of serial under value.
+func indexKey(value string, serial string) []byte {
+	return []byte(value + "\x00" + serial)
+}
+
+// Record adds rec to the ledger. A recorded certificate is never replaced, so
+// that its revocation is kept.
+func (l *Ledger) Record(rec IssuedCertificate) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		certs := tx.Bucket(bucketCertificates)
+
+		if certs.Get([]byte(rec.Serial)) != nil {
+			return errRecorded
+		}
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+
+		err = certs.Put([]byte(rec.Serial), data)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketByXname).Put(indexKey(rec.Xname, rec.Serial), nil)
+		if err != nil {
+			return err
+		}
+
+		if rec.EKFingerprint == "" {
+			return nil
+		}
+
+		return tx.Bucket(bucketByEK).Put(indexKey(rec.EKFingerprint, rec.Serial), nil)
+	})
+}
+
+// BySerial returns the certificate with the hex encoded serial.
+func (l *Ledger) BySerial(serial string) (IssuedCertificate, error) {
+	var rec IssuedCertificate
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketCertificates).Get([]byte(serial))
+		if data == nil {
+			return errNotFound
+		}
+
+		return json.Unmarshal(data, &rec)
+	})
+
+	return rec, err
+}
+
+// ByXname returns the certificates issued to xname.
+func (l *Ledger) ByXname(xname string) ([]IssuedCertificate, error) {
+	return l.byIndex(bucketByXname, xname)
+}
+
+// ByEK returns the certificates issued for the EK with the SHA-256
+// fingerprint.
+func (l *Ledger) ByEK(fingerprint string) ([]IssuedCertificate, error) {
+	return l.byIndex(bucketByEK, fingerprint)
+}
+
+// byIndex returns the certificates listed under value in the index bucket.
+func (l *Ledger) byIndex(index []byte, value string) ([]IssuedCertificate, error) {
+	recs := []IssuedCertificate{}
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		certs := tx.Bucket(bucketCertificates)
+		prefix := []byte(value + "\x00")
+		c := tx.Bucket(index).Cursor()
+
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			data := certs.Get(k[len(prefix):])
+			if data == nil {
+				continue
+			}
+
+			var rec IssuedCertificate
+
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return err
+			}
+
+			recs = append(recs, rec)
+		}
+
+		return nil
+	})
+
+	return recs, err
+}
+
+// Revoke marks the certificate with serial as revoked with an RFC 5280 reason
+// code. Revoking a revoked certificate keeps the original revocation.
+func (l *Ledger) Revoke(serial string, reason int, at time.Time) (IssuedCertificate, error) {
+	var rec IssuedCertificate
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		certs := tx.Bucket(bucketCertificates)
+
+		data := certs.Get([]byte(serial))
+		if data == nil {
+			return errNotFound
+		}
+
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+
+		if rec.RevokedAt != nil {
+			return nil
+		}
+
+		at = at.UTC()
+		rec.RevokedAt = &at
+		rec.RevocationReason = reason
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+
+		if err = certs.Put([]byte(serial), data); err != nil {
+			return err
+		}
+
+		return tx.Bucket(bucketRevoked).Put([]byte(serial), nil)
+	})
+
+	return rec, err
+}
+
+// Revoked returns every revoked certificate.
+func (l *Ledger) Revoked() ([]IssuedCertificate, error) {
+	recs := []IssuedCertificate{}
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		certs := tx.Bucket(bucketCertificates)
+
+		return tx.Bucket(bucketRevoked).ForEach(func(k, _ []byte) error {
+			var rec IssuedCertificate
+
+			if err := json.Unmarshal(certs.Get(k), &rec); err != nil {
+				return err
+			}
+
+			recs = append(recs, rec)
+
+			return nil
+		})
+	})
+
+	return recs, err
+}
+
+// NextCRLNumber increments and returns the persisted CRL number.
+func (l *Ledger) NextCRLNumber() (uint64, error) {
+	var n uint64
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+
+		if v := meta.Get(keyCRLNumber); len(v) == 8 {
+			n = binary.BigEndian.Uint64(v)
+		}
+
+		n++
+
+		return meta.Put(keyCRLNumber, binary.BigEndian.AppendUint64(nil, n))
+	})
+
+	return n, err
+}
+
+// recordIssuance counts the certificates issued to xname and records them in
+// the ledger.
+func recordIssuance(xname string, nodeType string, certs issuedCertificates) error {
+	certificatesIssued.WithLabelValues(nodeType, KindDevID).Inc()
+
+	if certs.attestation != nil {
+		certificatesIssued.WithLabelValues(nodeType, KindAttestation).Inc()
+	}
+
+	if Issued == nil {
+		return nil
+	}
+
+	for _, c := range []struct {
+		der  []byte
+		kind string
+	}{
+		{certs.devID, KindDevID},
+		{certs.attestation, KindAttestation},
+	} {
+		rec, err := NewIssuedCertificate(c.der, c.kind, xname, nodeType, certs.ek)
+		if err != nil {
+			return err
+		}
+
+		rec.Profile = certs.profile
+
+		if err = Issued.Record(rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/verify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Enrollment steps reported by the enrollment metrics.
+const (
+	StepAuthorize        = "authorize"
+	StepChallengeRequest = "challenge_request"
+	StepSubmit           = "submit"
+	StepEnroll           = "grpc_enroll"
+)
+
+var (
+	enrollmentSteps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tpm_provisioner",
+		Name:      "enrollment_steps_total",
+		Help:      "Enrollment steps by step and outcome.",
+	}, []string{"step", "outcome"})
+
+	enrollmentStepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tpm_provisioner",
+		Name:      "enrollment_step_duration_seconds",
+		Help:      "Enrollment step latency by step and outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"step", "outcome"})
+
+	verificationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tpm_provisioner",
+		Name:      "verification_failures_total",
+		Help:      "Signing request verification failures by stage.",
+	}, []string{"stage"})
+
+	certificatesIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tpm_provisioner",
+		Name:      "certificates_issued_total",
+		Help:      "Certificates issued by node type and kind.",
+	}, []string{"node_type", "kind"})
+
+	spireRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tpm_provisioner",
+		Name:      "spire_tokens_request_duration_seconds",
+		Help:      "Spire tokens workload request latency by outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "tpm_provisioner",
+		Name:      "whitelist_entries",
+		Help:      "Number of xname regexps in the white list.",
+	}, func() float64 {
+		return float64(len(WhiteListEntries()))
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "tpm_provisioner",
+		Name:      "active_sessions",
+		Help:      "Number of enrollment sessions held by the server. Stateless session stores report 0.",
+	}, func() float64 {
+		if s, ok := Sessions.(interface{ Len() int }); ok {
+			return float64(s.Len())
+		}
+
+		return 0
+	})
+)
+
+// stepRoutes maps the route names to the enrollment step they run.
+var stepRoutes = map[string]string{
+	"Authorize":          StepAuthorize,
+	"CreateSessionV2":    StepAuthorize,
+	"RequestChallenge":   StepChallengeRequest,
+	"RequestChallengeV2": StepChallengeRequest,
+	"SubmitChallenge":    StepSubmit,
+	"SubmitChallengeV2":  StepSubmit,
+}
+
+// Metrics serves the Prometheus metrics.
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	promhttp.Handler().ServeHTTP(w, r)
+}
+
+// outcome returns the metrics outcome label of err.
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+
+	return "success"
+}
+
+// observeStep records an enrollment step that started at start.
+func observeStep(step string, start time.Time, err error) {
+	enrollmentSteps.WithLabelValues(step, outcome(err)).Inc()
+	enrollmentStepDuration.WithLabelValues(step, outcome(err)).Observe(time.Since(start).Seconds())
+}
+
+// statusRecorder records the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentStep records the outcome and latency of the enrollment step
+// handled by inner.
+func instrumentStep(inner http.Handler, step string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		inner.ServeHTTP(rec, r)
+
+		var err error
+		if rec.status >= http.StatusBadRequest {
+			err = errors.New(strconv.Itoa(rec.status))
+		}
+
+		observeStep(step, start, err)
+	})
+}
+
+// validateRequest validates a signing request and counts failures by the
+// verification stage that failed.
+func validateRequest(data string, sig string) error {
+	err := verify.ValidateRequest(data, sig, CFG.ManufactuerCAs)
+	if err != nil {
+		stage := "unknown"
+
+		var stageErr verify.StageError
+		if errors.As(err, &stageErr) {
+			stage = stageErr.Stage
+		}
+
+		verificationFailures.WithLabelValues(stage).Inc()
+	}
+
+	return err
+}
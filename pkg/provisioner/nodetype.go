@@ -0,0 +1,195 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/xname"
+)
+
+// Node type modes.
+const (
+	// NodeTypeModeOff trusts the node type claimed by the client.
+	NodeTypeModeOff = "off"
+	// NodeTypeModeVerify rejects a claimed node type that differs from the
+	// derived one, and trusts the claim when none can be derived.
+	NodeTypeModeVerify = "verify"
+	// NodeTypeModeRequired rejects xnames whose node type can not be
+	// derived.
+	NodeTypeModeRequired = "required"
+)
+
+// NodeTypeRule maps the xnames matching an xname pattern to a node type.
+type NodeTypeRule struct {
+	Xname string `mapstructure:"xname"`
+	Type  string `mapstructure:"type"`
+}
+
+// NodeTypeMapper derives the node type of an xname from the node type rules
+// or else from the white list entries allowing it.
+type NodeTypeMapper struct {
+	mode  string
+	rules []compiledNodeTypeRule
+}
+
+type compiledNodeTypeRule struct {
+	pattern  *xname.Pattern
+	nodeType string
+}
+
+// NodeTypes is the node type mapper used when authorizing enrollments. A nil
+// NodeTypes verifies claimed node types against the white list.
+var NodeTypes *NodeTypeMapper
+
+// NewNodeTypeMapper returns the NodeTypeMapper for the configured mode and
+// rules. Rules are tried in order.
+func NewNodeTypeMapper(cfg Config) (*NodeTypeMapper, error) {
+	m := &NodeTypeMapper{mode: cfg.NodeTypeMode}
+
+	switch m.mode {
+	case "":
+		m.mode = NodeTypeModeVerify
+	case NodeTypeModeOff, NodeTypeModeVerify, NodeTypeModeRequired:
+	default:
+		return nil, fmt.Errorf("unknown node type mode %q", cfg.NodeTypeMode)
+	}
+
+	for _, rule := range cfg.NodeTypeRules {
+		if rule.Type == "" {
+			return nil, fmt.Errorf("node type rule %q has no type", rule.Xname)
+		}
+
+		p, err := xname.Compile(rule.Xname)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.Level() != xname.Node {
+			return nil, fmt.Errorf("node type rule %q does not name nodes", rule.Xname)
+		}
+
+		m.rules = append(m.rules, compiledNodeTypeRule{pattern: p, nodeType: rule.Type})
+	}
+
+	return m, nil
+}
+
+// verifies reports whether claimed node types are verified.
+func (m *NodeTypeMapper) verifies() bool {
+	return m == nil || m.mode != NodeTypeModeOff
+}
+
+// Derive returns the node type of the node xname name from the first rule
+// matching it, or else the node type all the white list entries allowing it
+// agree on. It returns an empty string when the node type is unknown.
+func (m *NodeTypeMapper) Derive(name string) string {
+	if m != nil {
+		for _, rule := range m.rules {
+			if rule.pattern.MatchString(name) {
+				return rule.nodeType
+			}
+		}
+	}
+
+	return whiteListNodeType(name, time.Now())
+}
+
+// Resolve returns the node type the node xname name enrolls as. A claimed
+// node type that differs from the derived one is rejected, an empty claim
+// takes the derived node type. The derived node type is returned with the
+// error of a mismatch.
+func (m *NodeTypeMapper) Resolve(name string, claimed string) (string, error) {
+	mode := NodeTypeModeVerify
+	if m != nil {
+		mode = m.mode
+	}
+
+	if mode == NodeTypeModeOff {
+		return claimed, nil
+	}
+
+	if err := parseNodeXname(name); err != nil {
+		return claimed, err
+	}
+
+	derived := m.Derive(name)
+
+	switch {
+	case derived != "" && claimed != "" && claimed != derived:
+		log.Printf("ALERT: %s claimed node type %s but is %s", name, claimed, derived)
+		return derived, apiErrorf(CodeNodeTypeMismatch, "xname %s is a %s node, not %s", name, derived, claimed)
+	case derived != "":
+		return derived, nil
+	case mode == NodeTypeModeRequired:
+		return claimed, apiErrorf(CodeNotWhitelisted, "node type of xname %s is unknown", name)
+	case claimed == "":
+		return claimed, apiErrorf(CodeBadRequest, "missing node type")
+	}
+
+	return claimed, nil
+}
+
+// whiteListNodeType returns the node type of the white list entries matching
+// the node xname name at now when they all allow a single node type, and an
+// empty string otherwise.
+func whiteListNodeType(name string, now time.Time) string {
+	whiteListMu.RLock()
+	defer whiteListMu.RUnlock()
+
+	nodeType := ""
+
+	for _, e := range WhiteList {
+		if ok, err := e.matches(name); !ok || err != nil {
+			continue
+		}
+
+		if e.NotBefore != nil && now.Before(*e.NotBefore) || e.NotAfter != nil && now.After(*e.NotAfter) {
+			continue
+		}
+
+		if len(e.NodeTypes) != 1 || nodeType != "" && nodeType != e.NodeTypes[0] {
+			return ""
+		}
+
+		nodeType = e.NodeTypes[0]
+	}
+
+	return nodeType
+}
+
+// nodeTypeDetails returns the audit details of the node type an xname
+// enrolls as, with the claimed node type when it differs.
+func nodeTypeDetails(nodeType string, claimed string) map[string]string {
+	details := map[string]string{"type": nodeType}
+	if claimed != nodeType {
+		details["claimedType"] = claimed
+	}
+
+	return details
+}
@@ -0,0 +1,276 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspPathPrefix precedes the request in the path of OCSP GET requests.
+const ocspPathPrefix = "/ocsp/"
+
+// DefaultOCSPCacheTTL is how long an OCSP response is valid and cached.
+const DefaultOCSPCacheTTL = 5 * time.Minute
+
+// oidOCSPNonce is the id-pkix-ocsp-nonce request and response extension.
+var oidOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+// ocspRequest is the part of an RFC 6960 OCSPRequest ocsp.ParseRequest does
+// not expose.
+type ocspRequest struct {
+	TBSRequest struct {
+		Version       int           `asn1:"explicit,tag:0,default:0,optional"`
+		RequestorName asn1.RawValue `asn1:"explicit,tag:1,optional"`
+		RequestList   []asn1.RawValue
+		Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+	}
+	Signature asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspCacheEntry struct {
+	der     []byte
+	expires time.Time
+}
+
+// ocspCache caches signed responses to requests without a nonce by serial.
+var ocspCache = struct {
+	mu      sync.Mutex
+	entries map[string]ocspCacheEntry
+}{entries: map[string]ocspCacheEntry{}}
+
+// purgeOCSPCache drops every cached OCSP response.
+func purgeOCSPCache() {
+	ocspCache.mu.Lock()
+	ocspCache.entries = map[string]ocspCacheEntry{}
+	ocspCache.mu.Unlock()
+}
+
+// OCSP answers RFC 6960 OCSP requests sent with POST or base64 encoded in the
+// GET request path.
+func OCSP(w http.ResponseWriter, r *http.Request) {
+	var (
+		der []byte
+		err error
+	)
+
+	if r.Method == http.MethodGet {
+		der, err = ocspGetRequest(r)
+	} else {
+		der, err = io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	}
+
+	if err != nil {
+		sendOCSP(w, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	sendOCSP(w, ocspResponse(der, time.Now()))
+}
+
+// ocspGetRequest returns the DER encoded request of a GET request, the URL
+// encoded base64 path remainder after ocsp/. The base64 may contain / and +,
+// escaped or not, so the raw path is decoded rather than the route variable.
+func ocspGetRequest(r *http.Request) ([]byte, error) {
+	path := r.URL.EscapedPath()
+
+	i := strings.Index(path, ocspPathPrefix)
+	if i < 0 {
+		return nil, errors.New("missing OCSP request")
+	}
+
+	encoded, err := url.PathUnescape(path[i+len(ocspPathPrefix):])
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+// ocspResponse returns the signed response to the DER encoded request.
+func ocspResponse(der []byte, now time.Time) []byte {
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+
+	var raw ocspRequest
+
+	_, err = asn1.Unmarshal(der, &raw)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+
+	var nonce *pkix.Extension
+
+	for i, ext := range raw.TBSRequest.Extensions {
+		if ext.Id.Equal(oidOCSPNonce) {
+			nonce = &raw.TBSRequest.Extensions[i]
+		}
+	}
+
+	if !issuedByProvider(req) {
+		return ocsp.UnauthorizedErrorResponse
+	}
+
+	if Issued == nil {
+		return ocsp.InternalErrorErrorResponse
+	}
+
+	serial := SerialString(req.SerialNumber.Bytes())
+
+	if nonce == nil {
+		ocspCache.mu.Lock()
+		entry, ok := ocspCache.entries[serial]
+		ocspCache.mu.Unlock()
+
+		if ok && now.Before(entry.expires) {
+			return entry.der
+		}
+	}
+
+	ttl := CFG.OCSPCacheTTL
+	if ttl <= 0 {
+		ttl = DefaultOCSPCacheTTL
+	}
+
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(ttl),
+	}
+
+	rec, err := Issued.BySerial(serial)
+
+	switch {
+	case errors.Is(err, errNotFound):
+		template.Status = ocsp.Unknown
+	case err != nil:
+		log.Printf("Unable to look up %s: %v", serial, err)
+		return ocsp.InternalErrorErrorResponse
+	case rec.RevokedAt != nil:
+		template.Status = ocsp.Revoked
+		template.RevokedAt = *rec.RevokedAt
+		template.RevocationReason = rec.RevocationReason
+	}
+
+	if nonce != nil {
+		template.ExtraExtensions = []pkix.Extension{{Id: oidOCSPNonce, Value: nonce.Value}}
+	}
+
+	responder := CFG.ProviderCA
+	key := CFG.ProviderKey
+
+	if CFG.OCSPResponderCert != nil {
+		responder = CFG.OCSPResponderCert
+		key = CFG.OCSPResponderKey
+		template.Certificate = CFG.OCSPResponderCert
+	}
+
+	resp, err := ocsp.CreateResponse(CFG.ProviderCA, responder, template, key)
+	if err != nil {
+		log.Printf("Unable to sign OCSP response: %v", err)
+		return ocsp.InternalErrorErrorResponse
+	}
+
+	if nonce == nil {
+		ocspCache.mu.Lock()
+		ocspCache.entries[serial] = ocspCacheEntry{der: resp, expires: template.NextUpdate}
+		ocspCache.mu.Unlock()
+	}
+
+	return resp
+}
+
+// CheckOCSPResponder validates that a delegated OCSP responder certificate
+// is issued by ca and authorized for OCSP signing, as RFC 6960 clients
+// require.
+func CheckOCSPResponder(ca *x509.Certificate, cert *x509.Certificate) error {
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		return fmt.Errorf("OCSP responder certificate is not issued by the platform CA: %w", err)
+	}
+
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageOCSPSigning {
+			return nil
+		}
+	}
+
+	return errors.New("OCSP responder certificate lacks the OCSP signing extended key usage")
+}
+
+// issuedByProvider returns whether req identifies the provider CA as issuer.
+func issuedByProvider(req *ocsp.Request) bool {
+	if CFG.ProviderCA == nil || !req.HashAlgorithm.Available() {
+		return false
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+
+	_, err := asn1.Unmarshal(CFG.ProviderCA.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return false
+	}
+
+	h := req.HashAlgorithm.New()
+	h.Write(CFG.ProviderCA.RawSubject)
+	nameHash := h.Sum(nil)
+
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	keyHash := h.Sum(nil)
+
+	return bytes.Equal(nameHash, req.IssuerNameHash) && bytes.Equal(keyHash, req.IssuerKeyHash)
+}
+
+// sendOCSP sends a DER encoded OCSP response.
+func sendOCSP(w http.ResponseWriter, resp []byte) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.WriteHeader(http.StatusOK)
+
+	_, err := w.Write(resp)
+	if err != nil {
+		log.Printf("error writing the OCSP response: %v", err)
+	}
+}
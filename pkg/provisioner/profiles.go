@@ -0,0 +1,549 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// DefaultProfileName is the name of the certificate profile used when no
+// other profile is selected. The built in default profile is used when it is
+// not configured.
+const DefaultProfileName = "default"
+
+// Subject modes.
+const (
+	// SubjectModeClient keeps the subject requested by the client when the
+	// profile has no subject template.
+	SubjectModeClient = "client"
+	// SubjectModeOverride issues the subject built by the server, recording
+	// a different subject requested by the client.
+	SubjectModeOverride = "override"
+	// SubjectModeReject rejects signing requests for a different subject
+	// than the one built by the server.
+	SubjectModeReject = "reject"
+)
+
+// DefaultSubjectTemplate is the subject of profiles without a subject
+// template, the subject requested by the tpm-provisioner client.
+const DefaultSubjectTemplate = "CN={type}/{xname}"
+
+// DefaultCertValidity is the validity of certificates issued with a profile
+// that does not set one.
+const DefaultCertValidity = 365 * 24 * time.Hour
+
+// CertProfile configures the certificates issued to a node. Subject, DNS
+// names and URIs are templates that may contain {xname} and {type}.
+type CertProfile struct {
+	// NodeTypes selects the profile for these node types.
+	NodeTypes []string      `mapstructure:"nodeTypes"`
+	Validity  time.Duration `mapstructure:"validity"`
+	// KeyUsage names the key usages, digitalSignature when empty.
+	KeyUsage []string `mapstructure:"keyUsage"`
+	// ExtKeyUsage and AttestationExtKeyUsage are the extended key usages of
+	// the DevID and attestation certificates, devid and aik when empty. They
+	// are named devid, aik, clientAuth, serverAuth or given as dotted OIDs.
+	ExtKeyUsage            []string `mapstructure:"extKeyUsage"`
+	AttestationExtKeyUsage []string `mapstructure:"attestationExtKeyUsage"`
+	// Subject is a comma separated list of attribute=value, for example
+	// CN={type}/{xname},O=HPE, DefaultSubjectTemplate when empty.
+	Subject string `mapstructure:"subject"`
+	// SubjectMode overrides the server subjectMode.
+	SubjectMode string   `mapstructure:"subjectMode"`
+	DNSNames    []string `mapstructure:"dnsNames"`
+	URIs        []string `mapstructure:"uris"`
+	// CRLURL and OCSPURL override the server crlURL and ocspURL. IssuerURL
+	// is added to the AIA extension as the location of the provider CA.
+	CRLURL    string `mapstructure:"crlURL"`
+	OCSPURL   string `mapstructure:"ocspURL"`
+	IssuerURL string `mapstructure:"issuerURL"`
+	// SPIFFEID is a SPIFFE ID template such as spiffe://shasta/{type}/{xname}
+	// added as a URI SAN. It overrides the server spiffeIDTemplate.
+	SPIFFEID string `mapstructure:"spiffeID"`
+	// CA issues DevID certificates that may sign certificates, limited to
+	// MaxPathLen intermediate CAs below them when set. MaxPathLen is only
+	// valid for CA profiles.
+	CA         bool `mapstructure:"ca"`
+	MaxPathLen *int `mapstructure:"maxPathLen"`
+}
+
+// certProfile is a validated certificate profile.
+type certProfile struct {
+	name                   string
+	nodeTypes              []string
+	validity               time.Duration
+	keyUsage               x509.KeyUsage
+	extKeyUsage            []asn1.ObjectIdentifier
+	attestationExtKeyUsage []asn1.ObjectIdentifier
+	subject                []subjectAttribute
+	subjectMode            string
+	dnsNames               []string
+	uris                   []string
+	crlURL                 string
+	ocspURL                string
+	issuerURL              string
+	spiffeID               string
+	ca                     bool
+	maxPathLen             int
+	maxPathLenZero         bool
+}
+
+// subjectAttribute is an attribute of a subject template.
+type subjectAttribute struct {
+	oid   asn1.ObjectIdentifier
+	value string
+}
+
+// Profiles are the certificate profiles by lower cased name. The built in
+// default profile is used when it is nil.
+var Profiles map[string]*certProfile
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalsignature":  x509.KeyUsageDigitalSignature,
+	"contentcommitment": x509.KeyUsageContentCommitment,
+	"keyencipherment":   x509.KeyUsageKeyEncipherment,
+	"dataencipherment":  x509.KeyUsageDataEncipherment,
+	"keyagreement":      x509.KeyUsageKeyAgreement,
+}
+
+var extKeyUsages = map[string]asn1.ObjectIdentifier{
+	"devid":      oidTCGDevIDCertificate,
+	"aik":        oidTCGKpAIKCertificate,
+	"serverauth": {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	"clientauth": {1, 3, 6, 1, 5, 5, 7, 3, 2},
+}
+
+var subjectAttributes = map[string]asn1.ObjectIdentifier{
+	"cn":           {2, 5, 4, 3},
+	"serialnumber": {2, 5, 4, 5},
+	"c":            {2, 5, 4, 6},
+	"l":            {2, 5, 4, 7},
+	"st":           {2, 5, 4, 8},
+	"o":            {2, 5, 4, 10},
+	"ou":           {2, 5, 4, 11},
+}
+
+// defaultProfile is the built in default profile.
+var defaultProfile = &certProfile{
+	name:                   DefaultProfileName,
+	validity:               DefaultCertValidity,
+	keyUsage:               x509.KeyUsageDigitalSignature,
+	extKeyUsage:            []asn1.ObjectIdentifier{oidTCGDevIDCertificate},
+	attestationExtKeyUsage: []asn1.ObjectIdentifier{oidTCGKpAIKCertificate},
+	subject:                []subjectAttribute{{oid: subjectAttributes["cn"], value: "{type}/{xname}"}},
+	subjectMode:            SubjectModeOverride,
+}
+
+// NewProfiles validates the configured certificate profiles. Profile names
+// are lower cased since the config keys are. The default profile is added
+// when it is not configured.
+func NewProfiles(cfg Config) (map[string]*certProfile, error) {
+	profiles := map[string]*certProfile{}
+	nodeTypes := map[string]string{}
+	configured := map[string]CertProfile{DefaultProfileName: {}}
+
+	for name, p := range cfg.CertProfiles {
+		configured[strings.ToLower(name)] = p
+	}
+
+	for name, p := range configured {
+		if p.SPIFFEID == "" {
+			p.SPIFFEID = cfg.SPIFFEIDTemplate
+		}
+
+		if p.SubjectMode == "" {
+			p.SubjectMode = cfg.SubjectMode
+		}
+
+		profile, err := compileProfile(name, p)
+		if err != nil {
+			return nil, fmt.Errorf("certificate profile %s: %w", name, err)
+		}
+
+		for _, t := range p.NodeTypes {
+			if other, ok := nodeTypes[t]; ok {
+				return nil, fmt.Errorf("certificate profiles %s and %s both select node type %s", other, name, t)
+			}
+
+			nodeTypes[t] = name
+		}
+
+		profiles[name] = profile
+	}
+
+	return profiles, nil
+}
+
+// compileProfile validates the profile p.
+func compileProfile(name string, p CertProfile) (*certProfile, error) {
+	profile := &certProfile{
+		name:      name,
+		nodeTypes: p.NodeTypes,
+		validity:  p.Validity,
+		dnsNames:  p.DNSNames,
+		uris:      p.URIs,
+		crlURL:    p.CRLURL,
+		ocspURL:   p.OCSPURL,
+		issuerURL: p.IssuerURL,
+		spiffeID:  p.SPIFFEID,
+		ca:        p.CA,
+		// An unset path length is unlimited.
+		maxPathLen: -1,
+	}
+
+	if p.MaxPathLen != nil {
+		if !p.CA {
+			return nil, errors.New("maxPathLen requires a CA profile")
+		}
+
+		if *p.MaxPathLen < 0 {
+			return nil, fmt.Errorf("negative maxPathLen %d", *p.MaxPathLen)
+		}
+
+		profile.maxPathLen = *p.MaxPathLen
+		profile.maxPathLenZero = *p.MaxPathLen == 0
+	}
+
+	if profile.validity < 0 {
+		return nil, fmt.Errorf("negative validity %s", p.Validity)
+	}
+
+	if profile.validity == 0 {
+		profile.validity = DefaultCertValidity
+	}
+
+	if len(p.KeyUsage) == 0 {
+		profile.keyUsage = x509.KeyUsageDigitalSignature
+	}
+
+	for _, u := range p.KeyUsage {
+		ku, ok := keyUsages[strings.ToLower(u)]
+		if !ok {
+			return nil, fmt.Errorf("unknown key usage %q", u)
+		}
+
+		profile.keyUsage |= ku
+	}
+
+	if profile.ca {
+		profile.keyUsage |= x509.KeyUsageCertSign
+	}
+
+	var err error
+
+	if profile.extKeyUsage, err = parseExtKeyUsages(p.ExtKeyUsage, oidTCGDevIDCertificate); err != nil {
+		return nil, err
+	}
+
+	if profile.attestationExtKeyUsage, err = parseExtKeyUsages(p.AttestationExtKeyUsage, oidTCGKpAIKCertificate); err != nil {
+		return nil, err
+	}
+
+	switch profile.subjectMode = p.SubjectMode; profile.subjectMode {
+	case "":
+		profile.subjectMode = SubjectModeOverride
+	case SubjectModeClient, SubjectModeOverride, SubjectModeReject:
+	default:
+		return nil, fmt.Errorf("unknown subject mode %q", p.SubjectMode)
+	}
+
+	subject := p.Subject
+	if subject == "" && profile.subjectMode != SubjectModeClient {
+		subject = DefaultSubjectTemplate
+	}
+
+	if profile.subject, err = parseSubjectTemplate(subject); err != nil {
+		return nil, err
+	}
+
+	for _, u := range p.URIs {
+		if _, err = url.Parse(expand(u, "x0c0s0b0n0", "compute")); err != nil {
+			return nil, fmt.Errorf("invalid URI %q: %w", u, err)
+		}
+	}
+
+	// An X.509-SVID carries exactly one URI SAN, its SPIFFE ID.
+	if p.SPIFFEID != "" && len(p.URIs) > 0 {
+		return nil, fmt.Errorf("uris can not be added to certificates with the SPIFFE ID %q", p.SPIFFEID)
+	}
+
+	if p.SPIFFEID != "" {
+		if _, err = spiffeid.FromString(expand(p.SPIFFEID, "x0c0s0b0n0", "compute")); err != nil {
+			return nil, fmt.Errorf("invalid SPIFFE ID template %q: %w", p.SPIFFEID, err)
+		}
+	}
+
+	return profile, nil
+}
+
+// parseExtKeyUsages parses named or dotted OID extended key usages, def when
+// there are none.
+func parseExtKeyUsages(names []string, def asn1.ObjectIdentifier) ([]asn1.ObjectIdentifier, error) {
+	if len(names) == 0 {
+		return []asn1.ObjectIdentifier{def}, nil
+	}
+
+	oids := make([]asn1.ObjectIdentifier, 0, len(names))
+
+	for _, name := range names {
+		if oid, ok := extKeyUsages[strings.ToLower(name)]; ok {
+			oids = append(oids, oid)
+			continue
+		}
+
+		oid, err := parseOID(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown extended key usage %q", name)
+		}
+
+		oids = append(oids, oid)
+	}
+
+	return oids, nil
+}
+
+// parseOID parses a dotted OID.
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+
+	oid := make(asn1.ObjectIdentifier, len(parts))
+
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+
+		oid[i] = n
+	}
+
+	return oid, nil
+}
+
+// parseSubjectTemplate parses a comma separated list of attribute=value.
+func parseSubjectTemplate(s string) ([]subjectAttribute, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var attrs []subjectAttribute
+
+	for _, part := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(part, "=")
+		key = strings.TrimSpace(key)
+
+		oid, known := subjectAttributes[strings.ToLower(key)]
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid subject attribute %q", part)
+		}
+
+		attrs = append(attrs, subjectAttribute{oid: oid, value: strings.TrimSpace(value)})
+	}
+
+	return attrs, nil
+}
+
+// selectProfile returns the certificate profile for xname enrolling as
+// nodeType: the profile named by the white list entry allowing it, else the
+// profile selecting nodeType, else the default profile.
+func selectProfile(xname string, nodeType string) (*certProfile, error) {
+	if name := whiteListProfile(xname, nodeType); name != "" {
+		p, ok := profileNamed(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown certificate profile %q", name)
+		}
+
+		return p, nil
+	}
+
+	for _, p := range Profiles {
+		for _, t := range p.nodeTypes {
+			if t == nodeType {
+				return p, nil
+			}
+		}
+	}
+
+	p, _ := profileNamed(DefaultProfileName)
+
+	return p, nil
+}
+
+// profileNamed returns the certificate profile name, falling back to the
+// built in default profile when the default profile is not configured.
+func profileNamed(name string) (*certProfile, bool) {
+	name = strings.ToLower(name)
+
+	if p, ok := Profiles[name]; ok {
+		return p, true
+	}
+
+	if name == DefaultProfileName {
+		return defaultProfile, true
+	}
+
+	return nil, false
+}
+
+// knownProfile reports whether name is a configured certificate profile or
+// the default profile.
+func knownProfile(name string) bool {
+	_, ok := profileNamed(name)
+
+	return ok
+}
+
+// expand replaces {xname} and {type} in template.
+func expand(template string, xname string, nodeType string) string {
+	return strings.NewReplacer("{xname}", xname, "{type}", nodeType).Replace(template)
+}
+
+// subjectFor returns the subject issued to xname enrolling as nodeType that
+// requested the subject requested. In client mode a profile without a subject
+// template issues the requested subject. Otherwise the subject is built from
+// the template, and a different non empty requested subject is rejected in
+// reject mode.
+func (p *certProfile) subjectFor(xname string, nodeType string, requested pkix.Name) (pkix.Name, error) {
+	if len(p.subject) == 0 {
+		return requested, nil
+	}
+
+	var rdns pkix.RDNSequence
+
+	for _, a := range p.subject {
+		rdns = append(rdns, pkix.RelativeDistinguishedNameSET{
+			{Type: a.oid, Value: expand(a.value, xname, nodeType)},
+		})
+	}
+
+	var subj pkix.Name
+
+	subj.FillFromRDNSequence(&rdns)
+
+	if subjectDiscrepancy(requested, subj) == "" {
+		return subj, nil
+	}
+
+	log.Printf("ALERT: %s requested subject %s but is %s", xname, requested, subj)
+
+	if p.subjectMode == SubjectModeReject {
+		return subj, apiErrorf(CodeSubjectMismatch, "xname %s may not request subject %s", xname, requested)
+	}
+
+	return subj, nil
+}
+
+// subjectDiscrepancy returns the requested subject when it is not empty and
+// differs from the issued subject, and an empty string otherwise.
+func subjectDiscrepancy(requested pkix.Name, issued pkix.Name) string {
+	if len(requested.ToRDNSequence()) == 0 || requested.String() == issued.String() {
+		return ""
+	}
+
+	return requested.String()
+}
+
+// General name tags of the subject alternative name extension.
+const (
+	sanTagDNSName = 2
+	sanTagURI     = 6
+)
+
+// extendSAN returns the subject alternative name extension san with the DNS
+// names, SPIFFE ID and URIs of the profile for xname and nodeType appended.
+func (p *certProfile) extendSAN(san pkix.Extension, xname string, nodeType string) (pkix.Extension, error) {
+	if len(p.dnsNames) == 0 && len(p.uris) == 0 && p.spiffeID == "" {
+		return san, nil
+	}
+
+	var names []asn1.RawValue
+
+	rest, err := asn1.Unmarshal(san.Value, &names)
+	if err != nil {
+		return san, err
+	}
+
+	if len(rest) > 0 {
+		return san, fmt.Errorf("trailing data after subject alternative names")
+	}
+
+	for _, name := range p.dnsNames {
+		names = append(names, asn1.RawValue{
+			Class: asn1.ClassContextSpecific,
+			Tag:   sanTagDNSName,
+			Bytes: []byte(expand(name, xname, nodeType)),
+		})
+	}
+
+	if p.spiffeID != "" {
+		id, err := spiffeid.FromString(expand(p.spiffeID, xname, nodeType))
+		if err != nil {
+			return san, apiErrorf(CodeBadRequest, "invalid SPIFFE ID for xname %s: %w", xname, err)
+		}
+
+		names = append(names, asn1.RawValue{
+			Class: asn1.ClassContextSpecific,
+			Tag:   sanTagURI,
+			Bytes: []byte(id.String()),
+		})
+	}
+
+	for _, uri := range p.uris {
+		u, err := url.Parse(expand(uri, xname, nodeType))
+		if err != nil {
+			return san, err
+		}
+
+		names = append(names, asn1.RawValue{
+			Class: asn1.ClassContextSpecific,
+			Tag:   sanTagURI,
+			Bytes: []byte(u.String()),
+		})
+	}
+
+	value, err := asn1.Marshal(names)
+	if err != nil {
+		return san, err
+	}
+
+	san.Value = value
+
+	return san, nil
+}
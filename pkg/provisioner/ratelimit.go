@@ -0,0 +1,364 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// DefaultLockoutDuration is how long an xname or EK is locked out when none
+// is configured.
+const DefaultLockoutDuration = 15 * time.Minute
+
+// limiterIdleTTL is how long an unused per key limiter is kept.
+const limiterIdleTTL = 10 * time.Minute
+
+// RateLimiter enforces token bucket rate limits per source IP and per xname,
+// and locks out xnames and EKs after repeated failed challenge responses.
+type RateLimiter struct {
+	mu        sync.Mutex
+	source    *keyedLimiter
+	xname     *keyedLimiter
+	threshold int
+	lockout   time.Duration
+	failures  map[string]*failureCount
+	// forwardedFor takes the source IP from the X-Forwarded-For header.
+	forwardedFor bool
+}
+
+// failureCount counts the failed challenge responses of an xname or EK.
+type failureCount struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// keyedLimiter is a set of token bucket limiters sharing a rate and burst.
+type keyedLimiter struct {
+	limit     rate.Limit
+	burst     int
+	limiters  map[string]*limiterEntry
+	lastPurge time.Time
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limiter is the rate limiter used by the router. Rate limiting is disabled
+// when it is nil.
+var Limiter *RateLimiter
+
+// NewRateLimiter returns the RateLimiter configured by cfg, or nil when no
+// limit or lockout is configured. A rate of zero disables that limit and a
+// threshold of zero disables lockouts.
+func NewRateLimiter(cfg Config) *RateLimiter {
+	if cfg.SourceRateLimit <= 0 && cfg.XnameRateLimit <= 0 && cfg.LockoutThreshold <= 0 {
+		return nil
+	}
+
+	lockout := cfg.LockoutDuration
+	if lockout <= 0 {
+		lockout = DefaultLockoutDuration
+	}
+
+	return &RateLimiter{
+		source:       newKeyedLimiter(cfg.SourceRateLimit, cfg.SourceRateBurst),
+		xname:        newKeyedLimiter(cfg.XnameRateLimit, cfg.XnameRateBurst),
+		threshold:    cfg.LockoutThreshold,
+		lockout:      lockout,
+		failures:     map[string]*failureCount{},
+		forwardedFor: cfg.RateLimitForwardedFor,
+	}
+}
+
+// newKeyedLimiter returns a keyedLimiter allowing perSecond requests per key
+// with bursts of burst, or nil when perSecond is not positive.
+func newKeyedLimiter(perSecond float64, burst int) *keyedLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &keyedLimiter{
+		limit:    rate.Limit(perSecond),
+		burst:    burst,
+		limiters: map[string]*limiterEntry{},
+	}
+}
+
+// wait takes a token for key and returns how long to wait before retrying
+// when none is available.
+func (k *keyedLimiter) wait(key string, now time.Time) time.Duration {
+	if k == nil {
+		return 0
+	}
+
+	if now.Sub(k.lastPurge) > limiterIdleTTL {
+		for key, e := range k.limiters {
+			if now.Sub(e.lastSeen) > limiterIdleTTL {
+				delete(k.limiters, key)
+			}
+		}
+
+		k.lastPurge = now
+	}
+
+	e, ok := k.limiters[key]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(k.limit, k.burst)}
+		k.limiters[key] = e
+	}
+
+	e.lastSeen = now
+
+	r := e.limiter.ReserveN(now, 1)
+
+	delay := r.DelayFrom(now)
+	if delay > 0 {
+		r.CancelAt(now)
+	}
+
+	return delay
+}
+
+// rateLimited returns a rate_limited error asking the client to retry after
+// delay.
+func rateLimited(delay time.Duration, format string, a ...any) error {
+	return &APIError{Code: CodeRateLimited, Err: fmt.Errorf(format, a...), RetryAfter: delay}
+}
+
+// AllowSource takes a token from the limiter of the source IP.
+func (l *RateLimiter) AllowSource(ip string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if delay := l.source.wait(ip, time.Now()); delay > 0 {
+		return rateLimited(delay, "rate limit exceeded for %s", ip)
+	}
+
+	return nil
+}
+
+// AllowXname checks that xname is not locked out and takes a token from its
+// limiter.
+func (l *RateLimiter) AllowXname(xname string) error {
+	if l == nil || xname == "" {
+		return nil
+	}
+
+	if err := l.CheckLockout("xname:"+xname, xname); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if delay := l.xname.wait(xname, time.Now()); delay > 0 {
+		return rateLimited(delay, "rate limit exceeded for %s", xname)
+	}
+
+	return nil
+}
+
+// AllowEK checks that the EK with the SHA-256 fingerprint is not locked out.
+func (l *RateLimiter) AllowEK(fingerprint string) error {
+	if l == nil || fingerprint == "" {
+		return nil
+	}
+
+	return l.CheckLockout("ek:"+fingerprint, "EK "+fingerprint)
+}
+
+// CheckLockout returns a rate_limited error while key is locked out.
+func (l *RateLimiter) CheckLockout(key string, name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[key]
+	if !ok {
+		return nil
+	}
+
+	if remaining := time.Until(f.lockedUntil); remaining > 0 {
+		return rateLimited(remaining, "%s is locked out after repeated failed challenge responses", name)
+	}
+
+	return nil
+}
+
+// ChallengeFailed counts a failed challenge response for xname and the EK
+// with the SHA-256 fingerprint, locking them out when they reach the
+// threshold. Failures older than the lockout duration are forgotten.
+func (l *RateLimiter) ChallengeFailed(xname string, fingerprint string) {
+	if l == nil || l.threshold <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	for _, key := range []string{"xname:" + xname, "ek:" + fingerprint} {
+		if strings.HasSuffix(key, ":") {
+			continue
+		}
+
+		f, ok := l.failures[key]
+		if !ok || now.Sub(f.last) > l.lockout {
+			f = &failureCount{}
+			l.failures[key] = f
+		}
+
+		f.count++
+		f.last = now
+
+		if f.count >= l.threshold {
+			f.count = 0
+			f.lockedUntil = now.Add(l.lockout)
+
+			log.Printf("ALERT: %s locked out for %s after %d failed challenge responses", key, l.lockout, l.threshold)
+		}
+	}
+}
+
+// ChallengeSucceeded forgets the failed challenge responses of xname and the
+// EK with the SHA-256 fingerprint.
+func (l *RateLimiter) ChallengeSucceeded(xname string, fingerprint string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, "xname:"+xname)
+	delete(l.failures, "ek:"+fingerprint)
+}
+
+// sourceIP returns the IP address the request came from. Behind a proxy this
+// is the rightmost X-Forwarded-For entry, added by the proxy itself, as the
+// client controls every entry before it.
+func (l *RateLimiter) sourceIP(r *http.Request) string {
+	if xff := r.Header.Values("X-Forwarded-For"); l.forwardedFor && len(xff) > 0 {
+		hops := strings.Split(xff[len(xff)-1], ",")
+
+		if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+			return ip
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
+// RateLimit is the router middleware enforcing the Limiter. Every request is
+// limited by its source IP, and enrollment requests by their xname.
+func RateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := Limiter
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := l.AllowSource(l.sourceIP(r))
+
+		if route := mux.CurrentRoute(r); err == nil && route != nil {
+			if _, ok := stepRoutes[route.GetName()]; ok {
+				err = l.AllowXname(requestXname(r))
+			}
+		}
+
+		if err != nil {
+			log.Printf("%s %s rejected: %v", r.Method, r.RequestURI, err)
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			sendResponseError(w, err)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestXname returns the xname an enrollment request is for, from the
+// request query, the session or the JSON body of a v2 session request.
+func requestXname(r *http.Request) string {
+	if xname := r.URL.Query().Get("xname"); xname != "" {
+		return xname
+	}
+
+	if token, err := sessionToken(r); err == nil {
+		if session, err := Sessions.Get(token); err == nil {
+			return session.Xname()
+		}
+	}
+
+	if r.Method != http.MethodPost || r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+
+	if err != nil {
+		return ""
+	}
+
+	var req SessionRequest
+
+	if json.Unmarshal(body, &req) != nil {
+		return ""
+	}
+
+	return req.Xname
+}
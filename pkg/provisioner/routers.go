@@ -33,7 +33,8 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// Route is an http route.
+// Route is an http route. Its name is unique since the admin route roles,
+// enrollment steps and metrics are keyed by it.
 type Route struct {
 	Name        string
 	Method      string
@@ -46,12 +47,19 @@ type Routes []Route
 
 // NewRouter creates a new router.
 func NewRouter() *mux.Router {
-	router := mux.NewRouter().StrictSlash(true)
+	// Paths are not cleaned since base64 encoded OCSP GET requests may
+	// contain //.
+	router := mux.NewRouter().StrictSlash(true).SkipClean(true)
 
-	for _, route := range routes {
+	for _, route := range append(routes, v2Routes...) {
 		var handler http.Handler
 		handler = route.HandlerFunc
 		handler = Logger(handler, route.Name)
+		handler = WithRequestID(handler)
+
+		if step, ok := stepRoutes[route.Name]; ok {
+			handler = instrumentStep(handler, step)
+		}
 
 		router.
 			Methods(route.Method).
@@ -60,9 +68,13 @@ func NewRouter() *mux.Router {
 			Handler(handler)
 	}
 
+	router.Use(RateLimit)
+	router.Use(RequireAdmin)
+
 	return router
 }
 
+// routes are the v1 api routes. They are kept for existing clients.
 var routes = Routes{
 	{
 		"Authorize",
@@ -83,21 +95,247 @@ var routes = Routes{
 		SubmitChallenge,
 	},
 	{
-		"ClientPost",
+		"ListWhiteList",
 		strings.ToUpper("Get"),
 		"/apis/tpm-provisioner/whitelist/get",
 		ListWhiteList,
 	},
 	{
-		"ClientPost",
+		"AddWhiteList",
 		strings.ToUpper("Post"),
 		"/apis/tpm-provisioner/whitelist/add",
 		AddWhiteList,
 	},
 	{
-		"ClientPost",
+		"RemoveWhiteList",
 		strings.ToUpper("Post"),
 		"/apis/tpm-provisioner/whitelist/remove",
 		RemoveWhiteList,
 	},
+	{
+		"TestWhiteList",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/whitelist/test",
+		TestWhiteList,
+	},
+	{
+		"ListIssuedByXname",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/issued/xname/{xname}",
+		ListIssuedByXname,
+	},
+	{
+		"GetIssuedBySerial",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/issued/serial/{serial}",
+		GetIssuedBySerial,
+	},
+	{
+		"ListIssuedByEK",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/issued/ek/{fingerprint}",
+		ListIssuedByEK,
+	},
+	{
+		"RevokeCertificate",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/revoke",
+		RevokeCertificate,
+	},
+	{
+		"GetCRL",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/crl",
+		GetCRL,
+	},
+	{
+		"OCSPPost",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/ocsp",
+		OCSP,
+	},
+	{
+		"OCSPGet",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/ocsp/{request:.+}",
+		OCSP,
+	},
+	{
+		"GetEKBindings",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/bindings/get",
+		GetEKBindings,
+	},
+	{
+		"SetEKBinding",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/bindings/set",
+		SetEKBinding,
+	},
+	{
+		"ClearEKBinding",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/bindings/clear",
+		ClearEKBinding,
+	},
+	{
+		"ImportEKInventory",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/inventory/import",
+		ImportEKInventory,
+	},
+	{
+		"GetEKInventory",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/inventory/get",
+		GetEKInventory,
+	},
+	{
+		"RemoveEKInventory",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/inventory/remove",
+		RemoveEKInventory,
+	},
+	{
+		"Metrics",
+		strings.ToUpper("Get"),
+		"/metrics",
+		Metrics,
+	},
+}
+
+// v2Routes are the v2 api routes, documented by the OpenAPI document.
+var v2Routes = Routes{
+	{
+		"CreateSessionV2",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/v2/sessions",
+		CreateSessionV2,
+	},
+	{
+		"RequestChallengeV2",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/v2/challenges",
+		RequestChallenge,
+	},
+	{
+		"SubmitChallengeV2",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/v2/challenges/response",
+		SubmitChallenge,
+	},
+	{
+		"ListWhiteListV2",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/whitelist",
+		ListWhiteList,
+	},
+	{
+		"TestWhiteListV2",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/whitelist/test",
+		TestWhiteList,
+	},
+	{
+		"PutWhiteListEntryV2",
+		strings.ToUpper("Put"),
+		"/apis/tpm-provisioner/v2/whitelist/{id}",
+		PutWhiteListEntryV2,
+	},
+	{
+		"DeleteWhiteListEntryV2",
+		strings.ToUpper("Delete"),
+		"/apis/tpm-provisioner/v2/whitelist/{id}",
+		DeleteWhiteListEntryV2,
+	},
+	{
+		"ListIssuedV2",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/certificates",
+		ListIssuedV2,
+	},
+	{
+		"GetIssuedBySerialV2",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/certificates/{serial}",
+		GetIssuedBySerial,
+	},
+	{
+		"CreateRevocationV2",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/v2/revocations",
+		CreateRevocationV2,
+	},
+	{
+		"GetCRLV2",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/crl",
+		GetCRL,
+	},
+	{
+		"OCSPPostV2",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/v2/ocsp",
+		OCSP,
+	},
+	{
+		"OCSPGetV2",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/ocsp/{request:.+}",
+		OCSP,
+	},
+	{
+		"GetEKBindingsV2",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/bindings",
+		GetEKBindings,
+	},
+	{
+		"GetEKBindingV2",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/bindings/{xname}",
+		GetEKBindings,
+	},
+	{
+		"PutEKBindingV2",
+		strings.ToUpper("Put"),
+		"/apis/tpm-provisioner/v2/bindings/{xname}",
+		PutEKBindingV2,
+	},
+	{
+		"DeleteEKBindingV2",
+		strings.ToUpper("Delete"),
+		"/apis/tpm-provisioner/v2/bindings/{xname}",
+		DeleteEKBindingV2,
+	},
+	{
+		"ImportEKInventoryV2",
+		strings.ToUpper("Post"),
+		"/apis/tpm-provisioner/v2/inventory",
+		ImportEKInventory,
+	},
+	{
+		"GetEKInventoryV2",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/inventory",
+		GetEKInventory,
+	},
+	{
+		"GetEKInventoryEntryV2",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/inventory/{fingerprint}",
+		GetEKInventory,
+	},
+	{
+		"DeleteEKInventoryV2",
+		strings.ToUpper("Delete"),
+		"/apis/tpm-provisioner/v2/inventory/{fingerprint}",
+		DeleteEKInventoryV2,
+	},
+	{
+		"GetOpenAPI",
+		strings.ToUpper("Get"),
+		"/apis/tpm-provisioner/v2/openapi.json",
+		GetOpenAPI,
+	},
 }
@@ -0,0 +1,318 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package provisioner
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sessionTokenVersion is the format version of the sealed session tokens.
+const sessionTokenVersion = 1
+
+// sessionKeySize is the size of the AES-256 session keys.
+const sessionKeySize = 32
+
+// sessionKeyIDSize is the size of the key identifier carried in a token.
+const sessionKeyIDSize = 4
+
+// sessionClaims is the session state sealed into a session token.
+type sessionClaims struct {
+	Xname    string `json:"x"`
+	NodeType string `json:"t"`
+	Expiry   int64  `json:"e"`
+	Step     int    `json:"s"`
+	Nonce    string `json:"n,omitempty"`
+	ReqHash  []byte `json:"d,omitempty"`
+}
+
+// TokenSessionStore is a SessionStore that keeps no state on the server. The
+// session is sealed into the token with AES-GCM so that any server sharing the
+// session keys can continue an enrollment.
+//
+// Because nothing is recorded on the server a step can be retried with the
+// token that started it until the session expires, but a step can never be
+// skipped or run out of order.
+type TokenSessionStore struct {
+	ttl    time.Duration
+	mintID [sessionKeyIDSize]byte
+	keys   map[[sessionKeyIDSize]byte]cipher.AEAD
+}
+
+// NewTokenSessionStore returns a TokenSessionStore whose sessions last for ttl.
+// Tokens sealed with any of keys are accepted and new tokens are sealed with
+// the last key.
+func NewTokenSessionStore(ttl time.Duration, keys [][]byte) (*TokenSessionStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one session key is required")
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+
+	s := &TokenSessionStore{
+		ttl:  ttl,
+		keys: make(map[[sessionKeyIDSize]byte]cipher.AEAD, len(keys)),
+	}
+
+	for i, key := range keys {
+		if len(key) != sessionKeySize {
+			return nil, fmt.Errorf("session key %d is %d bytes, expected %d", i, len(key), sessionKeySize)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		id := sessionKeyID(key)
+		s.keys[id] = aead
+		s.mintID = id
+	}
+
+	return s, nil
+}
+
+// LoadSessionKeys reads session keys from a file. The file contains one base64
+// encoded 32 byte key per line, oldest first. Blank lines and lines starting
+// with # are ignored.
+func LoadSessionKeys(file string) ([][]byte, error) {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err = f.Close()
+		if err != nil {
+			log.Printf("Failed to close session key file: %v", err)
+		}
+	}()
+
+	var keys [][]byte
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session key: %w", err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// sessionKeyID returns the identifier of a session key.
+func sessionKeyID(key []byte) [sessionKeyIDSize]byte {
+	var id [sessionKeyIDSize]byte
+
+	h := sha256.Sum256(key)
+	copy(id[:], h[:])
+
+	return id
+}
+
+// seal encrypts the session into a token with the newest session key.
+func (s *TokenSessionStore) seal(session Session) (string, error) {
+	claims := sessionClaims{
+		Xname:    session.xname,
+		NodeType: session.nodeType,
+		Expiry:   session.expiry.Unix(),
+		Step:     session.step,
+		Nonce:    session.nonce,
+		ReqHash:  session.reqHash,
+	}
+
+	plaintext, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	aead := s.keys[s.mintID]
+
+	header := append([]byte{sessionTokenVersion}, s.mintID[:]...)
+
+	nonce := make([]byte, aead.NonceSize())
+
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	token := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	token = append(token, header...)
+	token = append(token, nonce...)
+	token = aead.Seal(token, nonce, plaintext, header)
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// open decrypts and authenticates a token.
+func (s *TokenSessionStore) open(token string) (Session, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Session{}, errInvalidSession
+	}
+
+	headerSize := 1 + sessionKeyIDSize
+
+	if len(raw) < headerSize || raw[0] != sessionTokenVersion {
+		return Session{}, errInvalidSession
+	}
+
+	var id [sessionKeyIDSize]byte
+
+	copy(id[:], raw[1:headerSize])
+
+	aead, ok := s.keys[id]
+	if !ok || len(raw) < headerSize+aead.NonceSize() {
+		return Session{}, errInvalidSession
+	}
+
+	header := raw[:headerSize]
+	nonce := raw[headerSize : headerSize+aead.NonceSize()]
+
+	plaintext, err := aead.Open(nil, nonce, raw[headerSize+aead.NonceSize():], header)
+	if err != nil {
+		return Session{}, errInvalidSession
+	}
+
+	var claims sessionClaims
+
+	err = json.Unmarshal(plaintext, &claims)
+	if err != nil {
+		return Session{}, errInvalidSession
+	}
+
+	return Session{
+		xname:    claims.Xname,
+		nodeType: claims.NodeType,
+		expiry:   time.Unix(claims.Expiry, 0),
+		step:     claims.Step,
+		nonce:    claims.Nonce,
+		reqHash:  claims.ReqHash,
+	}, nil
+}
+
+// Create implements SessionStore.
+func (s *TokenSessionStore) Create(xname string, nodeType string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(s.ttl)
+
+	token, err := s.seal(Session{
+		xname:    xname,
+		nodeType: nodeType,
+		expiry:   expiresAt,
+		step:     1,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// Get implements SessionStore.
+func (s *TokenSessionStore) Get(token string) (Session, error) {
+	return s.open(token)
+}
+
+// Advance implements SessionStore.
+func (s *TokenSessionStore) Advance(token string, step int) (string, Session, error) {
+	session, err := s.open(token)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	if session.step != step {
+		return "", Session{}, errOutOfOrder
+	}
+
+	if session.expiry.Before(time.Now()) {
+		return "", Session{}, errSessionExpired
+	}
+
+	next := session
+	next.step++
+
+	token, err = s.seal(next)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	return token, session, nil
+}
+
+// SetChallenge implements SessionStore. Only a digest of reqData is kept, the
+// client must send the request data again when submitting the challenge.
+func (s *TokenSessionStore) SetChallenge(token string, nonce string, reqData string) (string, error) {
+	session, err := s.open(token)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256([]byte(reqData))
+
+	session.nonce = nonce
+	session.reqHash = h[:]
+
+	return s.seal(session)
+}
+
+// Expire implements SessionStore. Token sessions expire on their own so there
+// is nothing to remove.
+func (s *TokenSessionStore) Expire(now time.Time) int {
+	return 0
+}
@@ -26,13 +26,29 @@
 package provisioner
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// DefaultSessionTTL is the session lifetime used when none is configured.
+const DefaultSessionTTL = 2 * time.Minute
+
+var (
+	errMissingSession = apiError(CodeInvalidSession, errors.New("missing session cookie"))
+	errInvalidSession = apiError(CodeInvalidSession, errors.New("invalid session cookie"))
+	errOutOfOrder     = apiError(CodeOutOfOrder, errors.New("request out of order"))
+	errSessionExpired = apiError(CodeSessionExpired, errors.New("session expired"))
+)
+
 // Session stores a TPM Provisioner session data.
 type Session struct {
 	xname    string
@@ -41,163 +57,233 @@ type Session struct {
 	step     int
 	nonce    string
 	reqData  string
+	reqHash  []byte
 }
 
-var sessions = map[string]Session{}
+// Xname returns the xname the session was authorized for.
+func (s Session) Xname() string {
+	return s.xname
+}
 
-// createSessionCookie returns a basic session cookie.
-func createSessionCookie(xname string, nodeType string) (string, time.Time) {
-	token := uuid.NewString()
-	expiresAt := time.Now().Add(2 * time.Minute)
+// NodeType returns the node type the session was authorized for.
+func (s Session) NodeType() string {
+	return s.nodeType
+}
 
-	sessions[token] = Session{
-		xname:    xname,
-		nodeType: nodeType,
-		expiry:   expiresAt,
-		step:     0,
-	}
+// matchesRequest reports whether reqData is the request data the session's
+// challenge was created from.
+func (s Session) matchesRequest(reqData string) bool {
+	h := sha256.Sum256([]byte(reqData))
+
+	return len(s.reqHash) == len(h) && subtle.ConstantTimeCompare(s.reqHash, h[:]) == 1
+}
 
-	return token, expiresAt
+// SessionStore stores the state of in progress enrollments.
+//
+// Stores may carry the session state in the token itself, so every method that
+// changes a session returns the token the client must present on its next
+// request.
+type SessionStore interface {
+	// Create starts a new session for xname and returns its token and expiry.
+	Create(xname string, nodeType string) (string, time.Time, error)
+
+	// Get returns the session associated with token.
+	Get(token string) (Session, error)
+
+	// Advance validates that the session is at step and has not expired, then
+	// moves it to the next step so that a step can not be run twice or run out
+	// of order. The session as it was at step is returned.
+	Advance(token string, step int) (string, Session, error)
+
+	// SetChallenge stores the challenge nonce and the request data the
+	// challenge was created from.
+	SetChallenge(token string, nonce string, reqData string) (string, error)
+
+	// Expire removes all sessions that expired before now and returns how many
+	// were removed.
+	Expire(now time.Time) int
 }
 
-// CleanSessions looks for expired sessions and removes them.
-func CleanSessions() {
-	for k, v := range sessions {
-		if v.expiry.Before(time.Now()) {
-			delete(sessions, k)
+// Sessions is the session store used by the api handlers.
+var Sessions SessionStore = NewMemorySessionStore(DefaultSessionTTL)
+
+// NewSessionStore returns the SessionStore selected by the configuration.
+func NewSessionStore(cfg Config) (SessionStore, error) {
+	switch cfg.SessionMode {
+	case "", "memory":
+		return NewMemorySessionStore(cfg.SessionTTL), nil
+	case "token":
+		keys, err := LoadSessionKeys(cfg.SessionKeys)
+		if err != nil {
+			return nil, err
 		}
+
+		return NewTokenSessionStore(cfg.SessionTTL, keys)
+	default:
+		return nil, fmt.Errorf("unknown session mode %q", cfg.SessionMode)
 	}
+}
 
-	time.Sleep(2 * time.Minute)
+// MemorySessionStore is a SessionStore that keeps sessions in process memory.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]Session
 }
 
-// validateCookie validates that a session cookie exists and that it's being
-// used in the correct step.
-func validateCookie(c []*http.Cookie, step int) error {
-	sessionCookie, err := getSession(c)
-	if err != nil {
-		return err
+// NewMemorySessionStore returns an empty MemorySessionStore whose sessions
+// last for ttl.
+func NewMemorySessionStore(ttl time.Duration) *MemorySessionStore {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
 	}
 
-	session := sessions[sessionCookie]
-
-	if (session == Session{}) {
-		return errors.New("invalid session cookie")
+	return &MemorySessionStore{
+		ttl:      ttl,
+		sessions: map[string]Session{},
 	}
+}
 
-	if session.step != step {
-		return errors.New("request out of order")
-	}
+// Create implements SessionStore.
+func (s *MemorySessionStore) Create(xname string, nodeType string) (string, time.Time, error) {
+	token := uuid.NewString()
+	expiresAt := time.Now().Add(s.ttl)
 
-	if session.expiry.Before(time.Now()) {
-		return errors.New("session expired")
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Increment the session step so that a step can not be run twice or run
-	// out of order
-	session.step += 1
-	sessions[sessionCookie] = session
+	// The authorize step is complete once the session exists.
+	s.sessions[token] = Session{
+		xname:    xname,
+		nodeType: nodeType,
+		expiry:   expiresAt,
+		step:     1,
+	}
 
-	return nil
+	return token, expiresAt, nil
 }
 
-// getSession returns a session associated with the session cookie.
-func getSession(c []*http.Cookie) (string, error) {
-	var sessionCookie string
+// Get implements SessionStore.
+func (s *MemorySessionStore) Get(token string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if len(c) == 0 {
-		return "", errors.New("missing session cookie")
+	session, ok := s.sessions[token]
+	if !ok {
+		return Session{}, errInvalidSession
 	}
 
-	for _, v := range c {
-		b := false
+	return session, nil
+}
 
-		if v.Name == "session" {
-			sessionCookie = v.Value
-			b = true
-		}
+// Advance implements SessionStore.
+func (s *MemorySessionStore) Advance(token string, step int) (string, Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		if !b {
-			return "", errors.New("missing session cookie")
-		}
+	session, ok := s.sessions[token]
+	if !ok {
+		return "", Session{}, errInvalidSession
 	}
-	return sessionCookie, nil
-}
 
-// setNonce adds the validation nonce to the session.
-func setNonce(c []*http.Cookie, nonce string) error {
-	sessionCookie, err := getSession(c)
-	if err != nil {
-		return err
+	if session.step != step {
+		return "", Session{}, errOutOfOrder
 	}
 
-	session := sessions[sessionCookie]
-	session.nonce = nonce
-	sessions[sessionCookie] = session
-
-	return nil
-}
-
-// getReqData returns the reqData from the session associated with the session
-// cookie.
-func getReqData(c []*http.Cookie) (string, error) {
-	sessionCookie, err := getSession(c)
-	if err != nil {
-		return "", err
+	if session.expiry.Before(time.Now()) {
+		return "", Session{}, errSessionExpired
 	}
 
-	session := sessions[sessionCookie]
+	next := session
+	next.step++
+	s.sessions[token] = next
 
-	return session.reqData, nil
+	return token, session, nil
 }
 
-// setReqData sets the reqData from the session associated with the session
-// cookie.
-func setReqData(c []*http.Cookie, reqData string) error {
-	sessionCookie, err := getSession(c)
-	if err != nil {
-		return err
+// SetChallenge implements SessionStore.
+func (s *MemorySessionStore) SetChallenge(token string, nonce string, reqData string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[token]
+	if !ok {
+		return "", errInvalidSession
 	}
 
-	session := sessions[sessionCookie]
+	h := sha256.Sum256([]byte(reqData))
+
+	session.nonce = nonce
 	session.reqData = reqData
-	sessions[sessionCookie] = session
+	session.reqHash = h[:]
+	s.sessions[token] = session
 
-	return nil
+	return token, nil
 }
 
-// getNonce gets the nonce from the session associated with the session cookie.
-func getNonce(c []*http.Cookie) (string, error) {
-	sessionCookie, err := getSession(c)
-	if err != nil {
-		return "", err
+// Expire implements SessionStore.
+func (s *MemorySessionStore) Expire(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+
+	for k, v := range s.sessions {
+		if v.expiry.Before(now) {
+			delete(s.sessions, k)
+			removed++
+		}
 	}
 
-	session := sessions[sessionCookie]
+	return removed
+}
 
-	return session.nonce, nil
+// Len returns the number of sessions in the store.
+func (s *MemorySessionStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.sessions)
 }
 
-// getXname gets the xname from the session associated with the session cookie.
-func getXname(c []*http.Cookie) (string, error) {
-	sessionCookie, err := getSession(c)
-	if err != nil {
-		return "", err
+// CleanSessions removes expired sessions from store every interval until ctx
+// is cancelled.
+func CleanSessions(ctx context.Context, store SessionStore, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSessionTTL
 	}
 
-	session := sessions[sessionCookie]
-
-	return session.xname, nil
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := store.Expire(now); n > 0 {
+				log.Printf("Removed %d expired sessions", n)
+			}
+		}
+	}
 }
 
-// getType gets the node type from the session associated with the session cookie.
-func getType(c []*http.Cookie) (string, error) {
-	sessionCookie, err := getSession(c)
-	if err != nil {
-		return "", err
+// sessionToken returns the session token from the request's session cookie.
+func sessionToken(r *http.Request) (string, error) {
+	c, err := r.Cookie("session")
+	if err != nil || c.Value == "" {
+		return "", errMissingSession
 	}
 
-	session := sessions[sessionCookie]
+	return c.Value, nil
+}
 
-	return session.nodeType, nil
+// setSessionCookie sets the session cookie the client must present on its next
+// request.
+func setSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:    "session",
+		Value:   token,
+		Expires: expiresAt,
+	})
 }
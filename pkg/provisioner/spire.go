@@ -33,11 +33,18 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 // requestSpireWorkloads sends a request to the spire tokens service to create
 // workloads for the newly joined via tpm spire client.
-func requestSpireWorkloads(nodeType string, xname string, spireTokensURL string) error {
+func requestSpireWorkloads(nodeType string, xname string, spireTokensURL string) (err error) {
+	start := time.Now()
+
+	defer func() {
+		spireRequestDuration.WithLabelValues(outcome(err)).Observe(time.Since(start).Seconds())
+	}()
+
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12},
 	}
@@ -26,22 +26,12 @@
 package provisioner
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/asn1"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"log"
-	"math/big"
 	"net/http"
-	"time"
-
-	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/pkg/common"
-	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/pkg/devid"
-	"github.com/cray-hpe/tpm-provisioner/third_party/devid-provisioning-tool/pkg/x509tcg"
 )
 
 // SubmitResponse contains the response to the submit challenge api request.
@@ -49,82 +39,136 @@ type SubmitResponse struct {
 	Success          bool   `json:"success"`
 	Reason           string `json:"reason,omitempty"`
 	DevIDCertificate string `json:"devIdCertificate"`
+	// AttestationCertificate is the certificate issued for the AK.
+	AttestationCertificate string `json:"attestationCertificate,omitempty"`
 }
 
 // SubmitRequest contains the request for the submit challenge api.
 type SubmitRequest struct {
 	Data string `json:"data"`
+	// Request is the data sent to the challenge request api. It is only
+	// required when the server does not keep session state.
+	Request string `json:"request,omitempty"`
 }
 
 // SubmitChallenge handles the challenge/submit api request.
 func SubmitChallenge(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
-	var submitResp SubmitResponse
+	var (
+		submitResp  SubmitResponse
+		session     Session
+		certs       issuedCertificates
+		fingerprint string
+		err         error
+	)
 
-	err := validateCookie(r.Cookies(), 2)
+	defer func() {
+		details := map[string]string{"type": session.nodeType}
+		if certs.requestedSubject != "" {
+			details["requestedSubject"] = certs.requestedSubject
+		}
+
+		auditRequest(r, AuditEvent{
+			Event:         AuditEnroll,
+			Xname:         session.xname,
+			EKFingerprint: fingerprint,
+			Details:       details,
+		}, err)
+	}()
+
+	token, err := sessionToken(r)
 	if err != nil {
 		sendResponseError(w, err)
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-
-	var data CertificateRequest
-
-	err = decoder.Decode(&data)
+	err = authenticateSession(r, token)
 	if err != nil {
 		sendResponseError(w, err)
 		return
 	}
 
-	xname, err := getXname(r.Cookies())
+	_, session, err = Sessions.Advance(token, 2)
 	if err != nil {
 		sendResponseError(w, err)
 		return
 	}
 
-	nodeType, err := getType(r.Cookies())
+	decoder := json.NewDecoder(r.Body)
+
+	var data SubmitRequest
+
+	err = decoder.Decode(&data)
 	if err != nil {
+		sendResponseError(w, apiError(CodeBadRequest, err))
+		return
+	}
+
+	reqData := session.reqData
+	if reqData == "" {
+		reqData = data.Request
+	}
+
+	// Only a request matching the challenge identifies the EK.
+	if session.matchesRequest(reqData) {
+		if ek, ekErr := endorsementCertificate(reqData); ekErr == nil {
+			fingerprint = EKFingerprint(ek)
+		}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(data.Data), []byte(session.nonce)) != 1 {
+		Limiter.ChallengeFailed(session.xname, fingerprint)
+
+		err = apiError(CodeChallengeMismatch, errors.New("challenge response does not match nonce"))
 		sendResponseError(w, err)
+
 		return
 	}
 
-	nonce, err := getNonce(r.Cookies())
-	if err != nil {
+	if !session.matchesRequest(reqData) {
+		err = apiError(CodeChallengeMismatch, errors.New("request data does not match the challenge request"))
 		sendResponseError(w, err)
+
 		return
 	}
 
-	if data.Data != nonce {
-		sendResponseError(w, errors.New("challenge response does not match nonce"))
+	decodedReqData, err := base64.StdEncoding.DecodeString(reqData)
+	if err != nil {
+		sendResponseError(w, apiError(CodeBadRequest, err))
 		return
 	}
 
-	reqData, err := getReqData(r.Cookies())
+	certs, err = issueCertificates(decodedReqData, session.xname, session.nodeType)
 	if err != nil {
 		sendResponseError(w, err)
 		return
 	}
 
-	decodedReqData, err := base64.StdEncoding.DecodeString(reqData)
+	Limiter.ChallengeSucceeded(session.xname, fingerprint)
+
+	err = bindEK(session.xname, fingerprint)
 	if err != nil {
 		sendResponseError(w, err)
 		return
 	}
 
-	devIDCert, err := issueDevIDCertificate(decodedReqData)
+	err = recordIssuance(session.xname, session.nodeType, certs)
 	if err != nil {
+		log.Printf("Unable to record issuance for %s: %v", session.xname, err)
+		err = errors.New("unable to record issuance")
 		sendResponseError(w, err)
+
 		return
 	}
 
 	submitResp = SubmitResponse{
-		Success:          true,
-		DevIDCertificate: devIDCert,
+		Success:                true,
+		DevIDCertificate:       base64.RawStdEncoding.EncodeToString(certs.devID),
+		AttestationCertificate: base64.RawStdEncoding.EncodeToString(certs.attestation),
 	}
 
-	w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(http.StatusOK)
 
 	err = json.NewEncoder(w).Encode(submitResp)
 	if err != nil {
@@ -132,81 +176,8 @@ func SubmitChallenge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = requestSpireWorkloads(nodeType, xname, CFG.SpireTokensURL)
-	if err != nil {
+	if err := requestSpireWorkloads(session.nodeType, session.xname, CFG.SpireTokensURL); err != nil {
 		log.Printf("error requesting the creation of spire workloads: %v", err)
 		return
 	}
 }
-
-func issueDevIDCertificate(data []byte) (string, error) {
-	var subExtras *common.DistinguishedName
-
-	var sr devid.SigningRequest
-
-	err := sr.UnmarshalBinary(data)
-	if err != nil {
-		return "", err
-	}
-
-	if sr.DevIDKey == nil {
-		return "", errors.New("missing DevID key")
-	}
-
-	pub, err := sr.DevIDKey.Key()
-	if err != nil {
-		return "", err
-	}
-
-	keyData, err := sr.DevIDKey.Encode()
-	if err != nil {
-		return "", err
-	}
-
-	var subj pkix.Name
-
-	subj.FillFromRDNSequence(&sr.PlatformIdentity)
-
-	subExtras.AppendInto(&subj)
-
-	subjectIsEmpty := len(subj.ToRDNSequence()) == 0
-
-	sanExtension, err := x509tcg.DevIDSANFromEKCertificate(
-		subjectIsEmpty,
-		sr.EndorsementCertificate,
-	)
-	if err != nil {
-		return "", err
-	}
-
-	keySha256 := sha256.Sum256(keyData)
-	serialNumber := new(big.Int).SetBytes(keySha256[:])
-
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		PublicKey:    pub,
-
-		Subject:   subj,
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().AddDate(1, 0, 0),
-
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		BasicConstraintsValid: true,
-		IsCA:                  false,
-
-		UnknownExtKeyUsage: []asn1.ObjectIdentifier{{2, 23, 133, 11, 1, 2}},
-
-		ExtraExtensions: []pkix.Extension{
-			sanExtension,
-		},
-	}
-
-	cert, err := x509.CreateCertificate(rand.Reader, &template, CFG.ProviderCA, template.PublicKey, CFG.ProviderKey)
-	if err != nil {
-		return "", err
-	}
-
-	encodedCert := base64.RawStdEncoding.EncodeToString(cert)
-
-	return encodedCert, nil
-}
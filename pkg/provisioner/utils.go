@@ -28,25 +28,68 @@ package provisioner
 import (
 	"encoding/json"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
 )
 
-type errorResponse struct {
-	Success bool
-	Reason  string
+// ErrorResponse is the body of every API error response.
+type ErrorResponse struct {
+	Success bool      `json:"success"`
+	Code    ErrorCode `json:"code"`
+	Reason  string    `json:"reason"`
 }
 
-// sendResponseError sends a generic error response.
+// sendResponseError sends an error response with the status of the error's
+// API error code.
 func sendResponseError(w http.ResponseWriter, err error) {
-	certResp := errorResponse{
+	apiErr := asAPIError(err)
+
+	certResp := ErrorResponse{
 		Success: false,
+		Code:    apiErr.Code,
 		Reason:  err.Error(),
 	}
 
-	w.WriteHeader(http.StatusInternalServerError)
+	if apiErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(apiErr.RetryAfter.Seconds()))))
+	}
+
+	w.WriteHeader(apiErr.Status())
 
 	err = json.NewEncoder(w).Encode(certResp)
 	if err != nil {
 		log.Printf("error encoding the response: %v", err)
 	}
 }
+
+type successResponse struct {
+	Success bool `json:"success"`
+}
+
+// sendSuccess sends a generic success response.
+func sendSuccess(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(successResponse{Success: true})
+	if err != nil {
+		log.Printf("error encoding the response: %v", err)
+	}
+}
+
+// sendNoContent sends an empty success response.
+func sendNoContent(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pathOrFormValue returns the path variable key, or the form value key when
+// the route has no such path variable.
+func pathOrFormValue(r *http.Request, key string) string {
+	if v, ok := mux.Vars(r)[key]; ok {
+		return v
+	}
+
+	return r.FormValue(key)
+}
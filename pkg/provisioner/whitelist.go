@@ -27,95 +27,517 @@ package provisioner
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/xname"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// White list entry types.
+const (
+	WhiteListTypeXname = "xname"
+	WhiteListTypeRegex = "regex"
 )
 
-// WhiteList contains the xname regexp white list.
-var WhiteList = make([]string, 0)
+// WhiteListEntry is an xname pattern allowed to enroll.
+type WhiteListEntry struct {
+	// ID identifies the entry in the v2 api paths, see WhiteListEntryID.
+	ID      string `json:"id,omitempty" yaml:"-"`
+	Pattern string `json:"pattern" yaml:"pattern"`
+	// Type is xname for an xname pattern such as x1000c[0-7]s*b0n[0-1], or
+	// regex for a regexp. Entries added through the API without a type are
+	// xname patterns when the pattern is one, and regexps otherwise. Entries
+	// without a type in the white list file are regexps.
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+	// NodeTypes are the node types the entry allows, any when empty.
+	NodeTypes []string `json:"nodeTypes,omitempty" yaml:"nodeTypes,omitempty"`
+	// NotBefore and NotAfter bound when the entry allows enrollment.
+	NotBefore *time.Time `json:"notBefore,omitempty" yaml:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty" yaml:"notAfter,omitempty"`
+	// Profile is the certificate profile of the xnames the entry allows,
+	// selected by node type when empty.
+	Profile   string    `json:"profile,omitempty" yaml:"profile,omitempty"`
+	CreatedBy string    `json:"createdBy,omitempty" yaml:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt" yaml:"createdAt"`
+	Comment   string    `json:"comment,omitempty" yaml:"comment,omitempty"`
+
+	// matcher is the compiled pattern.
+	matcher interface{ MatchString(string) bool }
+}
+
+// WhiteListEntryID returns the ID of the entry with pattern, the unpadded
+// base64url encoding of the pattern so that patterns with a / can be a path
+// segment.
+func WhiteListEntryID(pattern string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(pattern))
+}
+
+// whiteListPattern returns the pattern of the entry with id.
+func whiteListPattern(id string) (string, error) {
+	pattern, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(pattern) == 0 {
+		return "", apiErrorf(CodeBadRequest, "invalid white list entry id %q", id)
+	}
+
+	return string(pattern), nil
+}
+
+// compile returns the entry with its type resolved and its pattern compiled.
+// Entries without a type predate xname patterns and are regexps.
+func (e WhiteListEntry) compile() (WhiteListEntry, error) {
+	e.ID = WhiteListEntryID(e.Pattern)
+
+	switch e.Type {
+	case WhiteListTypeXname:
+		p, err := compileXnamePattern(e.Pattern)
+		if err != nil {
+			return e, apiError(CodeBadRequest, err)
+		}
+
+		e.matcher = p
+
+		return e, nil
+	case "", WhiteListTypeRegex:
+	default:
+		return e, apiErrorf(CodeBadRequest, "unknown white list entry type %q", e.Type)
+	}
 
-// LoadWhiteList loads the white list from a file.
+	r, err := regexp.Compile(e.Pattern)
+	if err != nil {
+		return e, apiErrorf(CodeBadRequest, "invalid xname pattern: %w", err)
+	}
+
+	e.Type = WhiteListTypeRegex
+	e.matcher = r
+
+	return e, nil
+}
+
+// compileXnamePattern compiles an xname pattern naming nodes.
+func compileXnamePattern(pattern string) (*xname.Pattern, error) {
+	p, err := xname.Compile(pattern)
+	if err == nil && p.Level() != xname.Node {
+		err = fmt.Errorf("xname pattern %q does not name nodes", pattern)
+	}
+
+	return p, err
+}
+
+// withDefaultType returns an entry created through the API with its type
+// defaulted to xname when the pattern is an xname pattern, and regex
+// otherwise.
+func (e WhiteListEntry) withDefaultType() WhiteListEntry {
+	if e.Type != "" {
+		return e
+	}
+
+	e.Type = WhiteListTypeRegex
+
+	if _, err := compileXnamePattern(e.Pattern); err == nil {
+		e.Type = WhiteListTypeXname
+	}
+
+	return e
+}
+
+// matches reports whether the pattern of the entry matches xname.
+func (e WhiteListEntry) matches(xname string) (bool, error) {
+	if e.matcher == nil {
+		var err error
+
+		if e, err = e.compile(); err != nil {
+			return false, err
+		}
+	}
+
+	return e.matcher.MatchString(xname), nil
+}
+
+// allows reports whether the entry allows xname to enroll as nodeType at now.
+func (e WhiteListEntry) allows(xname string, nodeType string, now time.Time) (bool, error) {
+	ok, err := e.matches(xname)
+	if !ok || err != nil {
+		return false, err
+	}
+
+	return e.active(nodeType, now) == "", nil
+}
+
+// active returns why the entry does not allow nodeType at now, or an empty
+// string when it does.
+func (e WhiteListEntry) active(nodeType string, now time.Time) string {
+	if len(e.NodeTypes) > 0 {
+		found := false
+
+		for _, t := range e.NodeTypes {
+			if t == nodeType {
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Sprintf("node type %q is not allowed", nodeType)
+		}
+	}
+
+	if e.NotBefore != nil && now.Before(*e.NotBefore) {
+		return "not valid before " + e.NotBefore.Format(time.RFC3339)
+	}
+
+	if e.NotAfter != nil && now.After(*e.NotAfter) {
+		return "expired at " + e.NotAfter.Format(time.RFC3339)
+	}
+
+	return ""
+}
+
+// whiteListFile is the white list file format.
+type whiteListFile struct {
+	Entries []WhiteListEntry `yaml:"entries"`
+}
+
+// WhiteList contains the xname regexp white list. It is guarded by
+// whiteListMu once the server is running.
+var WhiteList = make([]WhiteListEntry, 0)
+
+var (
+	whiteListMu sync.RWMutex
+	// whiteListHash is the SHA-256 of the white list file as last loaded or
+	// written, so that reloads skip unchanged files.
+	whiteListHash [sha256.Size]byte
+)
+
+// WhiteListEntries returns a copy of the white list.
+func WhiteListEntries() []WhiteListEntry {
+	whiteListMu.RLock()
+	defer whiteListMu.RUnlock()
+
+	return append([]WhiteListEntry{}, WhiteList...)
+}
+
+// LoadWhiteList loads the white list from a file. A white list in the legacy
+// format of one xname regexp per line is migrated, keeping the original file
+// with a .v1 suffix.
 func LoadWhiteList(file string) error {
 	if _, err := os.Stat(file); os.IsNotExist(err) {
 		log.Printf("Saved whitelist not found. This is expected if its the first time this has been run.")
 		return nil
 	}
 
-	f, err := os.Open(filepath.Clean(file))
+	data, err := os.ReadFile(filepath.Clean(file))
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		err = f.Close()
+	entries, legacy, err := parseWhiteList(data)
+	if err != nil {
+		log.Printf("Failed to Read Whitelist: %v", err)
+		return err
+	}
+
+	whiteListMu.Lock()
+	defer whiteListMu.Unlock()
+
+	WhiteList = entries
+	whiteListHash = sha256.Sum256(data)
+
+	if legacy {
+		log.Printf("Migrating whitelist %v from the line format", file)
+
+		err = os.WriteFile(filepath.Clean(file+".v1"), data, 0o600)
+		if err != nil {
+			return err
+		}
+
+		err = writeWhiteList(file, entries)
 		if err != nil {
-			log.Printf("Failed to close whitelist file: %v", err)
+			return err
 		}
-	}()
+	}
 
-	scanner := bufio.NewScanner(f)
+	log.Printf("Loaded Whitelist: %v", WhiteList)
 
-	for scanner.Scan() {
-		str := scanner.Text()
-		WhiteList = append(WhiteList, str)
-		log.Printf("DEBUG: Loading %v into Whitelist", str)
+	return nil
+}
+
+// ReloadWhiteList reloads the white list file when it changed since it was
+// last loaded or written. The current white list is kept when the file can
+// not be read or parsed. Legacy files are loaded but not migrated, the file
+// may be read only.
+func ReloadWhiteList(file string) error {
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return err
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("Failed to Read Whitelist: %v", err)
+	whiteListMu.Lock()
+	defer whiteListMu.Unlock()
+
+	hash := sha256.Sum256(data)
+	if hash == whiteListHash {
+		return nil
+	}
+
+	entries, _, err := parseWhiteList(data)
+	if err != nil {
 		return err
 	}
 
-	log.Printf("Loaded Whitelist: %v", WhiteList)
+	WhiteList = entries
+	whiteListHash = hash
+
+	log.Printf("Reloaded Whitelist: %v", WhiteList)
 
 	return nil
 }
 
-// AddWhiteListItem adds a xname regexp to the white list.
-func AddWhiteListItem(f string, str string) error {
+// WatchWhiteList reloads the white list file when it changes until ctx is
+// cancelled. The directory is watched so that files replaced by a rename, as
+// done by ConfigMap updates and by WriteWhiteList, are followed.
+func WatchWhiteList(ctx context.Context, file string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	defer watcher.Close()
+
+	err = watcher.Add(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+
+	// Changes often come as a burst of events, reload once they settle.
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			timer.Reset(100 * time.Millisecond)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+
+			log.Printf("Whitelist watch error: %v", err)
+		case <-timer.C:
+			if err := ReloadWhiteList(file); err != nil {
+				log.Printf("Unable to reload whitelist %v: %v", file, err)
+			}
+		}
+	}
+}
+
+// parseWhiteList parses and validates a white list file. It reports whether
+// the file used the legacy line format.
+func parseWhiteList(data []byte) ([]WhiteListEntry, bool, error) {
+	entries, legacy, err := decodeWhiteList(data)
+	if err != nil {
+		return nil, legacy, err
+	}
+
+	for i, entry := range entries {
+		if entries[i], err = compileWhiteListEntry(entry); err != nil {
+			return nil, legacy, fmt.Errorf("entry %q: %w", entry.Pattern, err)
+		}
+	}
+
+	return entries, legacy, nil
+}
+
+// yamlStructure matches the mapping keys, sequence items and document markers
+// of a YAML white list, none of which appear in a legacy regex line.
+var yamlStructure = regexp.MustCompile(`(?m)^(\s*[A-Za-z_][\w-]*\s*:(\s|$)|\s*-\s|---\s*$)`)
+
+// decodeWhiteList decodes a white list file. Only files without any YAML
+// structure are read as legacy regex lines.
+func decodeWhiteList(data []byte) ([]WhiteListEntry, bool, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []WhiteListEntry{}, false, nil
+	}
+
+	var doc yaml.Node
+
+	err := yaml.Unmarshal(data, &doc)
+	if err == nil && len(doc.Content) == 1 && doc.Content[0].Kind == yaml.MappingNode {
+		var f whiteListFile
+
+		if err := doc.Decode(&f); err != nil {
+			return nil, false, err
+		}
+
+		if f.Entries == nil {
+			f.Entries = []WhiteListEntry{}
+		}
+
+		return f.Entries, false, nil
+	}
+
+	// A broken YAML white list must not be migrated as regex lines.
+	if yamlStructure.Match(data) {
+		if err == nil {
+			err = errors.New("white list is not a YAML mapping")
+		}
+
+		return nil, false, err
+	}
+
+	entries := []WhiteListEntry{}
+	now := time.Now().UTC()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		str := strings.TrimSpace(scanner.Text())
+		if str == "" {
+			continue
+		}
+
+		entries = append(entries, WhiteListEntry{
+			Pattern:   str,
+			Type:      WhiteListTypeRegex,
+			CreatedBy: "migration",
+			CreatedAt: now,
+		})
+		log.Printf("DEBUG: Loading %v into Whitelist", str)
+	}
+
+	return entries, true, scanner.Err()
+}
+
+// AddWhiteListItem adds an xname regexp entry to the white list.
+func AddWhiteListItem(f string, entry WhiteListEntry) error {
+	whiteListMu.Lock()
+	defer whiteListMu.Unlock()
+
 	for _, v := range WhiteList {
-		if v == str {
-			log.Printf("xname %v already in white list.", str)
-			return fmt.Errorf("xname %v already in white list", str)
+		if v.Pattern == entry.Pattern {
+			log.Printf("xname %v already in white list.", entry.Pattern)
+			return apiErrorf(CodeConflict, "xname %v already in white list", entry.Pattern)
 		}
 	}
 
-	WhiteList = append(WhiteList, str)
+	entry, err := compileWhiteListEntry(entry.withDefaultType())
+	if err != nil {
+		return err
+	}
+
+	entries := append(append([]WhiteListEntry{}, WhiteList...), entry)
 
-	if err := WriteWhiteList(f); err != nil {
+	if err = writeWhiteList(f, entries); err != nil {
 		return err
 	}
 
-	log.Printf("xname %v added to white list.", str)
+	WhiteList = entries
+
+	log.Printf("xname %v added to white list.", entry.Pattern)
 
 	return nil
 }
 
+// PutWhiteListItem adds an xname regexp entry to the white list, replacing an
+// entry with the same pattern but keeping when and by whom it was created. It
+// returns the entry as stored and reports whether it was added.
+func PutWhiteListItem(f string, entry WhiteListEntry) (WhiteListEntry, bool, error) {
+	entry, err := compileWhiteListEntry(entry.withDefaultType())
+	if err != nil {
+		return entry, false, err
+	}
+
+	whiteListMu.Lock()
+	defer whiteListMu.Unlock()
+
+	created := true
+	entries := append([]WhiteListEntry{}, WhiteList...)
+
+	for i, v := range entries {
+		if v.Pattern == entry.Pattern {
+			if !v.CreatedAt.IsZero() {
+				entry.CreatedBy = v.CreatedBy
+				entry.CreatedAt = v.CreatedAt
+			}
+
+			entries[i] = entry
+			created = false
+		}
+	}
+
+	if created {
+		entries = append(entries, entry)
+	}
+
+	if err = writeWhiteList(f, entries); err != nil {
+		return entry, false, err
+	}
+
+	WhiteList = entries
+
+	log.Printf("xname %v set in white list.", entry.Pattern)
+
+	return entry, created, nil
+}
+
+// compileWhiteListEntry validates the pattern and time window of an entry
+// and returns it with its pattern compiled.
+func compileWhiteListEntry(entry WhiteListEntry) (WhiteListEntry, error) {
+	if entry.Pattern == "" {
+		return entry, apiErrorf(CodeBadRequest, "missing xname pattern")
+	}
+
+	if entry.NotBefore != nil && entry.NotAfter != nil && entry.NotAfter.Before(*entry.NotBefore) {
+		return entry, apiErrorf(CodeBadRequest, "notAfter is before notBefore")
+	}
+
+	if entry.Profile != "" && !knownProfile(entry.Profile) {
+		return entry, apiErrorf(CodeBadRequest, "unknown certificate profile %q", entry.Profile)
+	}
+
+	return entry.compile()
+}
+
 // RemoveWhiteListItem removes a xname regexp from the white list.
 func RemoveWhiteListItem(f string, str string) error {
-	exists := false
+	whiteListMu.Lock()
+	defer whiteListMu.Unlock()
 
-	for i, v := range WhiteList {
-		if v == str {
-			WhiteList[i] = WhiteList[len(WhiteList)-1]
-			WhiteList[len(WhiteList)-1] = ""
-			WhiteList = WhiteList[:len(WhiteList)-1]
-			exists = true
+	entries := make([]WhiteListEntry, 0, len(WhiteList))
+
+	for _, v := range WhiteList {
+		if v.Pattern != str {
+			entries = append(entries, v)
 		}
 	}
 
-	if !exists {
+	if len(entries) == len(WhiteList) {
 		log.Printf("xname %v is not in white list", str)
-		return fmt.Errorf("xname %v is not in white list", str)
+		return apiErrorf(CodeNotFound, "xname %v is not in white list", str)
 	}
 
-	if err := WriteWhiteList(f); err != nil {
+	if err := writeWhiteList(f, entries); err != nil {
 		return err
 	}
 
+	WhiteList = entries
+
 	log.Printf("xname %v removed from whitelist", str)
 
 	return nil
@@ -123,58 +545,191 @@ func RemoveWhiteListItem(f string, str string) error {
 
 // WriteWhiteList saves the white list to a file.
 func WriteWhiteList(file string) error {
-	f, err := os.Create(filepath.Clean(file))
+	whiteListMu.Lock()
+	defer whiteListMu.Unlock()
+
+	return writeWhiteList(file, WhiteList)
+}
+
+// writeWhiteList atomically replaces the white list file with entries. The
+// previous file is kept with a .bak suffix. whiteListMu must be held.
+func writeWhiteList(file string, entries []WhiteListEntry) error {
+	log.Printf("Writing WhiteList: %v", entries)
+
+	data, err := yaml.Marshal(whiteListFile{Entries: entries})
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		err = f.Close()
-		if err != nil {
-			log.Printf("Failed to close whitelist file: %v", err)
+	file = filepath.Clean(file)
+
+	if old, err := os.ReadFile(file); err == nil {
+		if err = writeFileAtomic(file+".bak", old); err != nil {
+			return err
 		}
-	}()
+	}
 
-	writer := bufio.NewWriter(f)
+	if err = writeFileAtomic(file, data); err != nil {
+		return err
+	}
 
-	log.Printf("Writing WhiteList: %v", WhiteList)
+	whiteListHash = sha256.Sum256(data)
 
-	for _, v := range WhiteList {
-		log.Printf("Debug: Write to %v: %v", file, v)
+	return nil
+}
 
-		_, err := writer.WriteString(v + "\n")
-		if err != nil {
-			return err
-		}
+// writeFileAtomic replaces file with data by writing and syncing a temporary
+// file in the same directory and renaming it over file.
+func writeFileAtomic(file string, data []byte) error {
+	dir := filepath.Dir(file)
 
-		err = writer.Flush()
-		if err != nil {
-			return err
-		}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
 	}
 
-	return nil
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0o600)
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(f.Name(), file); err != nil {
+		return err
+	}
+
+	d, err := os.Open(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
 }
 
-// validateXname validates that an xname matches a regexp in the white list.
-func validateXname(xname string) error {
+// validateXname validates that an xname names a node and matches an entry in
+// the white list that allows nodeType and is within its time window.
+func validateXname(name string, nodeType string) error {
+	if err := parseNodeXname(name); err != nil {
+		return err
+	}
+
+	whiteListMu.RLock()
+	defer whiteListMu.RUnlock()
+
 	exists := false
+	now := time.Now()
 
 	for _, v := range WhiteList {
-		r, err := regexp.Compile(v)
+		ok, err := v.allows(name, nodeType, now)
 		if err != nil {
 			return err
 		}
 
-		if r.MatchString(xname) {
+		if ok {
 			exists = true
 		}
 	}
 
 	if !exists {
-		log.Printf("xname %v is not white listed", xname)
-		return fmt.Errorf("xname %v is not white listed", xname)
+		log.Printf("xname %v is not white listed", name)
+		return apiErrorf(CodeNotWhitelisted, "xname %v is not white listed", name)
+	}
+
+	return nil
+}
+
+// whiteListProfile returns the certificate profile of the first white list
+// entry allowing xname to enroll as nodeType that names one, or an empty
+// string.
+func whiteListProfile(xname string, nodeType string) string {
+	whiteListMu.RLock()
+	defer whiteListMu.RUnlock()
+
+	now := time.Now()
+
+	for _, v := range WhiteList {
+		if v.Profile == "" {
+			continue
+		}
+
+		if ok, err := v.allows(xname, nodeType, now); ok && err == nil {
+			return v.Profile
+		}
+	}
+
+	return ""
+}
+
+// parseNodeXname validates that name is the xname of a node.
+func parseNodeXname(name string) error {
+	x, err := xname.Parse(name)
+	if err != nil {
+		return apiError(CodeBadRequest, err)
+	}
+
+	if x.Level() != xname.Node {
+		return apiErrorf(CodeBadRequest, "xname %s is not a node", name)
 	}
 
 	return nil
 }
+
+// WhiteListMatch is a white list entry whose pattern matches an xname.
+type WhiteListMatch struct {
+	Entry WhiteListEntry `json:"entry"`
+	// Allowed reports whether the entry allows the xname to enroll now,
+	// Reason is why it does not.
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// MatchWhiteList returns the white list entries whose pattern matches the
+// node xname name, and whether each allows it to enroll as nodeType now. The
+// node types of the entries are not checked when nodeType is empty.
+func MatchWhiteList(name string, nodeType string) ([]WhiteListMatch, error) {
+	if err := parseNodeXname(name); err != nil {
+		return nil, err
+	}
+
+	whiteListMu.RLock()
+	defer whiteListMu.RUnlock()
+
+	matches := []WhiteListMatch{}
+	now := time.Now()
+
+	for _, v := range WhiteList {
+		ok, err := v.matches(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		e := v
+		if nodeType == "" {
+			e.NodeTypes = nil
+		}
+
+		reason := e.active(nodeType, now)
+		matches = append(matches, WhiteListMatch{Entry: v, Allowed: reason == "", Reason: reason})
+	}
+
+	return matches, nil
+}
@@ -46,6 +46,29 @@ func (e KeyAttributeError) Error() string {
 	return fmt.Sprintf("key attribute error: %s", e.Reason)
 }
 
+// Verification stages reported by StageError.
+const (
+	StageDecode        = "decode"
+	StageSignature     = "signature"
+	StageEKChain       = "ek_chain"
+	StageResidency     = "residency"
+	StageKeyAttributes = "key_attributes"
+)
+
+// StageError is returned by ValidateRequest with the stage that failed.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e StageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e StageError) Unwrap() error {
+	return e.Err
+}
+
 var subjectAlternativeNameOID = asn1.ObjectIdentifier{2, 5, 29, 17}
 
 func ValidateRequest(data string, sig string, certPool *x509.CertPool) error {
@@ -53,26 +76,26 @@ func ValidateRequest(data string, sig string, certPool *x509.CertPool) error {
 
 	decodedData, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
-		return err
+		return StageError{StageDecode, err}
 	}
 
 	decodedSig, err := base64.StdEncoding.DecodeString(sig)
 	if err != nil {
-		return err
+		return StageError{StageDecode, err}
 	}
 
 	err = sr.UnmarshalBinary(decodedData)
 	if err != nil {
-		return err
+		return StageError{StageDecode, err}
 	}
 
 	err = validateSignature(sr.DevIDKey, decodedData, decodedSig)
 	if err != nil {
-		return err
+		return StageError{StageSignature, err}
 	}
 	err = validateEndorcement(sr.EndorsementCertificate, certPool)
 	if err != nil {
-		return err
+		return StageError{StageEKChain, err}
 	}
 
 	err = validateDevIDResidency(
@@ -82,17 +105,17 @@ func ValidateRequest(data string, sig string, certPool *x509.CertPool) error {
 		sr.CertifySignature,
 	)
 	if err != nil {
-		return err
+		return StageError{StageResidency, err}
 	}
 
 	err = checkDevIDProp(sr.DevIDKey.Attributes)
 	if err != nil {
-		return err
+		return StageError{StageKeyAttributes, err}
 	}
 
 	err = checkAKProp(sr.AttestationKey.Attributes)
 	if err != nil {
-		return err
+		return StageError{StageKeyAttributes, err}
 	}
 
 	return nil
@@ -0,0 +1,306 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+// Package xname parses HPE component names and matches them against xname
+// patterns.
+//
+// An xname names a component by its position in the hierarchy of cabinet x,
+// chassis c, slot s, BMC b and node n, for example x1000c0s0b0n0. A pattern
+// has the same levels, each an ordinal, a list of ordinals and ranges in
+// brackets or a * for any ordinal, for example x1000c[0-7]s*b0n[0,1] or
+// x3000c0s[1-10]b0n0.
+package xname
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Level is a level of the xname hierarchy.
+type Level int
+
+// Xname levels, from the top of the hierarchy down.
+const (
+	Cabinet Level = iota
+	Chassis
+	Slot
+	BMC
+	Node
+)
+
+// prefixes are the prefixes of the levels.
+const prefixes = "xcsbn"
+
+// maxOrdinal is the highest ordinal of each level.
+var maxOrdinal = [...]int{
+	Cabinet: 9999,
+	Chassis: 7,
+	Slot:    64,
+	BMC:     7,
+	Node:    7,
+}
+
+var levelNames = [...]string{
+	Cabinet: "cabinet",
+	Chassis: "chassis",
+	Slot:    "slot",
+	BMC:     "BMC",
+	Node:    "node",
+}
+
+// String returns the name of the level.
+func (l Level) String() string {
+	if l < Cabinet || l > Node {
+		return fmt.Sprintf("level %d", int(l))
+	}
+
+	return levelNames[l]
+}
+
+// Xname is a parsed xname, the ordinals of its levels from the cabinet down.
+type Xname []int
+
+// Parse parses an xname. Each level must follow its parent and be within the
+// range of ordinals of the level.
+func Parse(s string) (Xname, error) {
+	var x Xname
+
+	err := scanLevels(s, func(level Level, field string) error {
+		n, err := parseOrdinal(level, field)
+		if err != nil {
+			return err
+		}
+
+		x = append(x, n)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid xname %q: %w", s, err)
+	}
+
+	return x, nil
+}
+
+// Level returns the lowest level of the xname, Node for a node.
+func (x Xname) Level() Level {
+	return Level(len(x) - 1)
+}
+
+// String returns the xname.
+func (x Xname) String() string {
+	var b strings.Builder
+
+	for i, n := range x {
+		b.WriteByte(prefixes[i])
+		b.WriteString(strconv.Itoa(n))
+	}
+
+	return b.String()
+}
+
+// span is an inclusive range of ordinals.
+type span struct {
+	lo, hi int
+}
+
+// Pattern is a compiled xname pattern.
+type Pattern struct {
+	source string
+	// levels are the ordinals allowed at each level, any when nil.
+	levels [][]span
+}
+
+// Compile compiles an xname pattern. The pattern is validated like an xname,
+// with every ordinal and range within the range of its level.
+func Compile(pattern string) (*Pattern, error) {
+	p := &Pattern{source: pattern}
+
+	err := scanLevels(pattern, func(level Level, field string) error {
+		spans, err := parseSpans(level, field)
+		if err != nil {
+			return err
+		}
+
+		p.levels = append(p.levels, spans)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid xname pattern %q: %w", pattern, err)
+	}
+
+	return p, nil
+}
+
+// Level returns the lowest level of the xnames matched by the pattern.
+func (p *Pattern) Level() Level {
+	return Level(len(p.levels) - 1)
+}
+
+// String returns the source of the pattern.
+func (p *Pattern) String() string {
+	return p.source
+}
+
+// Match reports whether x has the levels of the pattern and each of its
+// ordinals is allowed by the pattern.
+func (p *Pattern) Match(x Xname) bool {
+	if len(x) != len(p.levels) {
+		return false
+	}
+
+	for i, spans := range p.levels {
+		if spans == nil {
+			continue
+		}
+
+		found := false
+
+		for _, s := range spans {
+			if x[i] >= s.lo && x[i] <= s.hi {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchString reports whether s is a valid xname matched by the pattern.
+func (p *Pattern) MatchString(s string) bool {
+	x, err := Parse(s)
+
+	return err == nil && p.Match(x)
+}
+
+// scanLevels splits s into its levels and calls f with the level and the
+// text following its prefix. Levels must start at the cabinet and follow the
+// hierarchy.
+func scanLevels(s string, f func(Level, string) error) error {
+	if s == "" {
+		return errors.New("empty")
+	}
+
+	level := Cabinet
+
+	for s != "" {
+		if level > Node {
+			return fmt.Errorf("unexpected %q after the node", s)
+		}
+
+		if s[0] != prefixes[level] {
+			return fmt.Errorf("expected %s prefix %q at %q", level, prefixes[level], s)
+		}
+
+		end := strings.IndexAny(s[1:], prefixes)
+		if end < 0 {
+			end = len(s)
+		} else {
+			end++
+		}
+
+		if err := f(level, s[1:end]); err != nil {
+			return err
+		}
+
+		s = s[end:]
+		level++
+	}
+
+	return nil
+}
+
+// parseOrdinal parses a decimal ordinal of level, without sign or leading
+// zeros.
+func parseOrdinal(level Level, s string) (int, error) {
+	if s == "" || strings.Trim(s, "0123456789") != "" || len(s) > 1 && s[0] == '0' {
+		return 0, fmt.Errorf("invalid %s ordinal %q", level, s)
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n > maxOrdinal[level] {
+		return 0, fmt.Errorf("%s ordinal %s is not between 0 and %d", level, s, maxOrdinal[level])
+	}
+
+	return n, nil
+}
+
+// parseSpans parses the ordinals of a pattern level, an ordinal, a * or a
+// bracketed comma separated list of ordinals and lo-hi ranges.
+func parseSpans(level Level, s string) ([]span, error) {
+	if s == "*" {
+		return nil, nil
+	}
+
+	list, ok := strings.CutPrefix(s, "[")
+	if !ok {
+		n, err := parseOrdinal(level, s)
+		if err != nil {
+			return nil, err
+		}
+
+		return []span{{n, n}}, nil
+	}
+
+	list, ok = strings.CutSuffix(list, "]")
+	if !ok {
+		return nil, fmt.Errorf("unterminated %s range %q", level, s)
+	}
+
+	spans := []span{}
+
+	for _, item := range strings.Split(list, ",") {
+		lo, hi, isRange := strings.Cut(item, "-")
+
+		first, err := parseOrdinal(level, lo)
+		if err != nil {
+			return nil, err
+		}
+
+		last := first
+
+		if isRange {
+			if last, err = parseOrdinal(level, hi); err != nil {
+				return nil, err
+			}
+
+			if last < first {
+				return nil, fmt.Errorf("empty %s range %q", level, item)
+			}
+		}
+
+		spans = append(spans, span{first, last})
+	}
+
+	return spans, nil
+}
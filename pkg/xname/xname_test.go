@@ -0,0 +1,139 @@
+/*
+ *
+ *  MIT License
+ *
+ *  (C) Copyright 2023 Hewlett Packard Enterprise Development LP
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a
+ *  copy of this software and associated documentation files (the "Software"),
+ *  to deal in the Software without restriction, including without limitation
+ *  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ *  and/or sell copies of the Software, and to permit persons to whom the
+ *  Software is furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included
+ *  in all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ *  THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ *  OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ *  ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ *  OTHER DEALINGS IN THE SOFTWARE.
+ *
+ */
+package xname_test
+
+import (
+	"testing"
+
+	"github.com/cray-hpe/tpm-provisioner/pkg/xname"
+)
+
+// TestParse validates the parsing of valid and invalid xnames.
+func TestParse(t *testing.T) {
+	valid := map[string]xname.Level{
+		"x1000":          xname.Cabinet,
+		"x3000c0s1b0":    xname.BMC,
+		"x1000c7s64b7n7": xname.Node,
+		"x0c0s0b0n0":     xname.Node,
+	}
+
+	for s, level := range valid {
+		x, err := xname.Parse(s)
+		if err != nil {
+			t.Fatalf("Unable to parse %s: %v", s, err)
+		}
+
+		if x.Level() != level || x.String() != s {
+			t.Fatalf("Parsed %s as %s at level %s", s, x, x.Level())
+		}
+	}
+
+	invalid := []string{
+		"",
+		"x",
+		"c0s0b0n0",
+		"x1000s0b0n0",
+		"x1000c8s0b0n0",
+		"x10000c0s0b0n0",
+		"x1000c0s0b0n08",
+		"x1000c0s0b0n-1",
+		"x1000c0s0b0n0p0",
+		"x1000c0s0b0n0x",
+		"X1000c0s0b0n0",
+		"x1000c0s0b0n[0-1]",
+	}
+
+	for _, s := range invalid {
+		if _, err := xname.Parse(s); err == nil {
+			t.Fatalf("Invalid xname %q parsed", s)
+		}
+	}
+}
+
+// TestPattern validates the matching of xname patterns.
+func TestPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{
+			"x1000c[0-7]s*b0n[0-1]",
+			[]string{"x1000c0s0b0n0", "x1000c7s64b0n1"},
+			[]string{"x1000c0s0b1n0", "x1000c0s0b0n2", "x1001c0s0b0n0", "x1000c0s0b0", "x1000c0s0b0n0p0"},
+		},
+		{
+			"x3000c0s[1-10]b0n0",
+			[]string{"x3000c0s1b0n0", "x3000c0s10b0n0"},
+			[]string{"x3000c0s0b0n0", "x3000c0s11b0n0", "x3000c0s1b0n00"},
+		},
+		{
+			"x1000c0s0b0n[0,2,4-5]",
+			[]string{"x1000c0s0b0n0", "x1000c0s0b0n2", "x1000c0s0b0n5"},
+			[]string{"x1000c0s0b0n1", "x1000c0s0b0n3", "x1000c0s0b0n6"},
+		},
+		{
+			"x1000c0s0b0n1",
+			[]string{"x1000c0s0b0n1"},
+			[]string{"x1000c0s0b0n10", "x11000c0s0b0n1"},
+		},
+	}
+
+	for _, tt := range tests {
+		p, err := xname.Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("Unable to compile %s: %v", tt.pattern, err)
+		}
+
+		for _, s := range tt.match {
+			if !p.MatchString(s) {
+				t.Errorf("%s does not match %s", tt.pattern, s)
+			}
+		}
+
+		for _, s := range tt.noMatch {
+			if p.MatchString(s) {
+				t.Errorf("%s matches %s", tt.pattern, s)
+			}
+		}
+	}
+
+	invalid := []string{
+		"x1000c0s0b0n.*",
+		"x1000c[0-8]s0b0n0",
+		"x1000c0s[10-1]b0n0",
+		"x1000c0s[1-]b0n0",
+		"x1000c0s[1b0n0",
+		"x1000c0s0b0n0|x1000c0s0b0n1",
+		"^x1000c0s0b0n0$",
+	}
+
+	for _, s := range invalid {
+		if _, err := xname.Compile(s); err == nil {
+			t.Fatalf("Invalid pattern %q compiled", s)
+		}
+	}
+}
@@ -36,7 +36,7 @@ func GenerateCA(cname string) (*x509.Certificate, *rsa.PrivateKey, *bytes.Buffer
 		IsCA:                  true,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		UnknownExtKeyUsage:    []asn1.ObjectIdentifier{{2, 23, 133, 8, 1}},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 	}
 
@@ -50,6 +50,11 @@ func GenerateCA(cname string) (*x509.Certificate, *rsa.PrivateKey, *bytes.Buffer
 		return &x509.Certificate{}, nil, nil, err
 	}
 
+	ca, err = x509.ParseCertificate(caBytes)
+	if err != nil {
+		return &x509.Certificate{}, nil, nil, err
+	}
+
 	caPEM := new(bytes.Buffer)
 
 	err = pem.Encode(caPEM, &pem.Block{